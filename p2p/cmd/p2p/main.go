@@ -1,11 +1,19 @@
 package main
 
 import (
+    "os"
+    "strings"
     "github.com/jiechenmc/seawolf/p2p/internal/api"
 )
 
 const listen_address = "127.0.0.1:8081"
+//Origins of the frontend, the dev server and the packaged app, overridden by a comma separated list in P2P_FRONTEND_ORIGINS
+const frontend_origins = "http://localhost:5173,file://"
 
 func main() {
-    api.APIServer().Start(listen_address)
+    origins := os.Getenv("P2P_FRONTEND_ORIGINS")
+    if origins == "" {
+        origins = frontend_origins
+    }
+    api.APIServer().Start(listen_address, strings.Split(origins, ","))
 }
@@ -2,19 +2,52 @@ package api
 
 import (
     "log"
+    "strings"
     "net/http"
     "github.com/ethereum/go-ethereum/rpc"
 )
 
 type API struct {
     rpcServer *rpc.Server
+    service *P2PService
 }
 
 func enableCORS(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Access-Control-Allow-Origin", "*")
         w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range")
+
+        if r.Method == "OPTIONS" {
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+//Like enableCORS, but only pages from origins may use the handler, other pages are turned away
+//Clients that send no Origin, such as media elements and tools like curl, are always allowed
+func enableOriginCORS(origins []string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        if origin != "" {
+            allowed := false
+            for _, allowedOrigin := range origins {
+                if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+                    allowed = true
+                    break
+                }
+            }
+            if !allowed {
+                http.Error(w, "Origin not allowed", http.StatusForbidden)
+                return
+            }
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", "Range")
+        }
+        w.Header().Add("Vary", "Origin")
 
         if r.Method == "OPTIONS" {
             return
@@ -29,13 +62,19 @@ func APIServer() *API {
     p2pService := new(P2PService)
     server := rpc.NewServer()
     server.RegisterName("p2p", p2pService)
-    api := &API{ rpcServer: server }
+    api := &API{ rpcServer: server, service: p2pService }
 
     return api
 }
 
-func (a *API) Start(listenAddr string) {
+//Only pages from frontendOrigins can open WebSockets, since every method can be called over them,
+//or read content through the gateway, which needs no login
+func (a *API) Start(listenAddr string, frontendOrigins []string) {
     http.Handle("/rpc", enableCORS(http.HandlerFunc(a.rpcServer.ServeHTTP)))
+    //WebSocket endpoint for subscriptions, the same methods can also be called over it
+    http.Handle("/ws", a.rpcServer.WebsocketHandler(frontendOrigins))
+    //Local gateway for streaming content by CID
+    http.Handle(gatewayContentPath, enableOriginCORS(frontendOrigins, http.HandlerFunc(a.handleContent)))
     err := http.ListenAndServe(listenAddr, nil)
     if err != nil {
         log.Printf("Error starting server. %v\n", err)
@@ -0,0 +1,203 @@
+package api
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "context"
+    "strconv"
+    "encoding/json"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+const fileShareDefaultCatalogLimit = 50
+//Most files in a page of a catalog, we ask for at most this many and serve at most this many
+const fileShareMaxCatalogLimit = 200
+const fileShareMaxCatalogSize = 16 * 1024 * 1024
+
+type fileShareCatalogItem struct {
+    Cid string                      `json:"cid"`
+    SignedMeta FileShareSignedMeta  `json:"signed_meta"`
+}
+
+type fileShareCatalogPage struct {
+    WalletAddress string            `json:"wallet_address"`
+    NextCursor string               `json:"next_cursor"`
+    Items []fileShareCatalogItem    `json:"items"`
+}
+
+type FileShareCatalogEntry struct {
+    DataCid string          `json:"data_cid"`
+    FileShareMeta
+}
+
+//A page of the files a peer shares
+type FileSharePeerCatalog struct {
+    PeerID string                   `json:"peer_id"`
+    WalletAddress string            `json:"wallet_address"`
+    Files []FileShareCatalogEntry   `json:"files"`
+    //Cursor of the next page, empty if this is the last page
+    NextCursor string               `json:"next_cursor"`
+}
+
+//Request:  "CATALOG\n<cursor>\n<max_count>\n"
+//Response: "CATALOG\n<size>\n<byte1><byte2>..." with the JSON encoded page of signed metadata
+//Only what we share is listed, in order of CID. The cursor is the last CID of the previous page and is
+//empty for the first page.
+func (f *FileShareNode) handleCatalog(stream *P2PStream) error {
+    cursorStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    cursor := cursorStr[:len(cursorStr) - 1]
+    maxCountStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    maxCount, err := strconv.Atoi(maxCountStr[:len(maxCountStr) - 1])
+    if err != nil || maxCount <= 0 {
+        return invalidParams
+    }
+    maxCount = min(maxCount, fileShareMaxCatalogLimit)
+
+    sharedCids := []cid.Cid{}
+    for _, c := range f.sharedCids() {
+        if c.String() > cursor {
+            sharedCids = append(sharedCids, c)
+        }
+    }
+    sort.Slice(sharedCids, func(i int, j int) bool {
+        return sharedCids[i].String() < sharedCids[j].String()
+    })
+
+    f.walletLock.Lock()
+    page := fileShareCatalogPage{ WalletAddress: f.walletAddress, Items: []fileShareCatalogItem{} }
+    f.walletLock.Unlock()
+    if len(sharedCids) > maxCount {
+        sharedCids = sharedCids[:maxCount]
+        page.NextCursor = sharedCids[maxCount - 1].String()
+    }
+    for _, c := range sharedCids {
+        f.mstoreLock.Lock()
+        fileMeta, ok := f.mstore[c]
+        f.mstoreLock.Unlock()
+        if !ok {
+            continue
+        }
+        signedMeta, err := f.signMeta(c, fileMeta)
+        if err != nil {
+            continue
+        }
+        page.Items = append(page.Items, fileShareCatalogItem{ Cid: c.String(), SignedMeta: *signedMeta })
+    }
+
+    pageBytes, err := json.Marshal(page)
+    if err != nil {
+        return err
+    }
+    err = stream.SendString(fmt.Sprintf("CATALOG\n%d\n", len(pageBytes)))
+    if err != nil {
+        return err
+    }
+    return stream.Send(pageBytes)
+}
+
+func (s *FileShareSession) SendCatalog(peerID peer.ID, cursor string, maxCount int) (*fileShareCatalogPage, error) {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+
+    err := s.sendString(peerID, fmt.Sprintf("CATALOG\n%s\n%d\n", cursor, maxCount))
+    if err != nil {
+        return nil, err
+    }
+    resp, err := s.readString(peerID, '\n', fileShareWantTimeout)
+    if err != nil {
+        return nil, err
+    }
+    if resp != "CATALOG\n" {
+        return nil, unexpectedResponse
+    }
+    sizeStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, err
+    }
+    size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
+    if err != nil || size <= 0 || size > fileShareMaxCatalogSize {
+        return nil, unexpectedResponse
+    }
+    pageBytes, err := s.read(peerID, size, fileShareWantTimeout)
+    if err != nil {
+        return nil, err
+    }
+    page := &fileShareCatalogPage{}
+    err = json.Unmarshal(pageBytes, page)
+    if err != nil || len(page.Items) > maxCount {
+        return nil, unexpectedResponse
+    }
+    return page, nil
+}
+
+//Gets a page of what a peer shares with its metadata, prices and wallet address
+//Files whose metadata doesn't carry the peer's signature are left out
+func (f *FileShareNode) GetPeerCatalog(ctx context.Context, peerIDStr string, cursor string, limit int) (FileSharePeerCatalog, error) {
+    peerID, err := peer.Decode(peerIDStr)
+    if err != nil || limit <= 0 || limit > fileShareMaxCatalogLimit {
+        return FileSharePeerCatalog{}, invalidParams
+    }
+    if cursor != "" {
+        _, err = cid.Decode(cursor)
+        if err != nil {
+            return FileSharePeerCatalog{}, invalidParams
+        }
+    }
+    if peerID == f.host.ID() {
+        return FileSharePeerCatalog{}, invalidParams
+    }
+
+    session := f.SessionCreate(ctx, "", fileShareSessionDiscovery)
+    defer f.SessionCleanup(session, 0)
+    page, err := session.SendCatalog(peerID, cursor, limit)
+    if err != nil {
+        log.Printf("Failed to get catalog of %v. %v\n", peerID, err)
+        return FileSharePeerCatalog{}, err
+    }
+
+    catalog := FileSharePeerCatalog{
+        PeerID: peerID.String(),
+        WalletAddress: page.WalletAddress,
+        Files: []FileShareCatalogEntry{},
+        NextCursor: page.NextCursor,
+    }
+    for _, item := range page.Items {
+        c, err := cid.Decode(item.Cid)
+        if err != nil {
+            continue
+        }
+        err = item.SignedMeta.verify(f.host, peerID, c)
+        if err != nil {
+            log.Printf("Metadata of %v from %v failed verification\n", c, peerID)
+            continue
+        }
+        fileMeta := FileShareMeta{}
+        err = fileMeta.Unmarshal(item.SignedMeta.Meta)
+        if err != nil {
+            continue
+        }
+        //The wallet address the peer signed takes precedence over the unsigned one of the page
+        catalog.WalletAddress = item.SignedMeta.WalletAddress
+        catalog.Files = append(catalog.Files, FileShareCatalogEntry{ DataCid: item.Cid, FileShareMeta: fileMeta })
+
+        //Peers can search for what we browse
+        f.searchIndex.add(c, fileMeta.Size, FileShareProvider{
+            PeerID: peerID,
+            Price: fileMeta.Price,
+            Name: fileMeta.Name,
+            WalletAddress: item.SignedMeta.WalletAddress,
+            Verified: true,
+            FileShareMetaDetails: fileMeta.FileShareMetaDetails,
+        })
+    }
+    return catalog, nil
+}
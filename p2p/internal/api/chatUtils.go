@@ -303,6 +303,7 @@ func (chatRoom *ChatRoom) handleMessage() error {
     chatRoom.chatLock.Lock()
     chatRoom.Messages = append(chatRoom.Messages, message)
     chatRoom.chatLock.Unlock()
+    events.publish(eventChatMessage, ChatMessageEvent{ PeerID: message.From.String(), ChatID: chatRoom.ChatID, Message: message })
     return nil
 }
 
@@ -497,6 +498,7 @@ func (cn *ChatNode) CreateIncomingRequest(id int, fileCid cid.Cid, p2pStream *P2
         cn.incomingRequests[p2pStream.RemotePeerID] = peerRequests
     }
     peerRequests[id] = request
+    events.publish(eventChatRequest, *request)
     return request
 }
 
@@ -0,0 +1,182 @@
+package api
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "strconv"
+    "github.com/klauspost/compress/zstd"
+    "github.com/libp2p/go-libp2p/core/peer"
+)
+
+//Encodings of the data phase. CIDs always cover the uncompressed bytes, compression only applies on the wire.
+const fileShareEncodingIdentity = "identity"
+const fileShareEncodingZstd = "zstd"
+//Encodings we accept, in order of preference
+var fileShareEncodings = []string{ fileShareEncodingZstd, fileShareEncodingIdentity }
+
+//EncodeAll and DecodeAll are safe to use concurrently
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(64 << 20))
+//Frames hold a single chunk, leave room for providers that use larger chunks
+var fileShareMaxFrameSize = int64(4 * chunkSize)
+
+//Request:  "ACCEPT ENCODING\n<encoding1>,<encoding2>,...\n"
+//Response: "ENCODING\n<encoding>\n"
+//Picks the first encoding we support, data sent on this stream afterwards uses it
+func (f *FileShareNode) handleAcceptEncoding(stream *P2PStream) (string, error) {
+    encodingsStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return fileShareEncodingIdentity, err
+    }
+    encoding := fileShareEncodingIdentity
+    for _, requested := range strings.Split(encodingsStr[:len(encodingsStr) - 1], ",") {
+        if requested == fileShareEncodingZstd || requested == fileShareEncodingIdentity {
+            encoding = requested
+            break
+        }
+    }
+    return encoding, stream.SendString("ENCODING\n" + encoding + "\n")
+}
+
+//Encodes a chunk with the stream's encoding, returning what goes on the wire
+//Compressed chunks are framed as "<length>\n<wire_length>\n<bytes>", and sent as they are if compression doesn't help
+func encodeChunk(encoding string, data []byte) []byte {
+    if encoding == fileShareEncodingIdentity {
+        return data
+    }
+    compressed := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+    if len(compressed) >= len(data) {
+        compressed = data
+    }
+    header := fmt.Sprintf("%d\n%d\n", len(data), len(compressed))
+    return append([]byte(header), compressed...)
+}
+
+//Agrees on an encoding with a provider for the current stream to it
+//Providers that don't know about encodings close the stream, after which we don't ask them again
+//Caller must hold the request lock of the peer
+func (s *FileShareSession) negotiateEncoding(peerID peer.ID) string {
+    stream, err := s.GetStream(peerID)
+    if err != nil {
+        return fileShareEncodingIdentity
+    }
+    s.streamLock.Lock()
+    encoding, ok := s.encodings[stream]
+    legacy := s.legacyPeers[peerID]
+    s.streamLock.Unlock()
+    if ok {
+        return encoding
+    }
+    if legacy {
+        return fileShareEncodingIdentity
+    }
+
+    encoding = fileShareEncodingIdentity
+    err = s.sendString(peerID, "ACCEPT ENCODING\n" + strings.Join(fileShareEncodings, ",") + "\n")
+    if err == nil {
+        var resp string
+        resp, err = s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err == nil && resp == "ENCODING\n" {
+            resp, err = s.readString(peerID, '\n', fileShareWantHaveTimeout)
+            if err == nil {
+                encoding = resp[:len(resp) - 1]
+            }
+        } else if err == nil {
+            err = unexpectedResponse
+        }
+    }
+    if err != nil {
+        log.Printf("Provider %v does not support encodings, sending data uncompressed\n", peerID)
+        s.DeleteStream(peerID)
+        s.streamLock.Lock()
+        s.legacyPeers[peerID] = true
+        s.streamLock.Unlock()
+        return fileShareEncodingIdentity
+    }
+    if encoding != fileShareEncodingZstd && encoding != fileShareEncodingIdentity {
+        log.Printf("Provider %v picked unknown encoding %v\n", peerID, encoding)
+        s.DeleteStream(peerID)
+        return fileShareEncodingIdentity
+    }
+
+    s.streamLock.Lock()
+    s.encodings[stream] = encoding
+    s.streamLock.Unlock()
+    return encoding
+}
+
+//Reads size bytes of data sent with the given encoding, chunk by chunk
+func (s *FileShareSession) receiveData(peerID peer.ID, size int64, encoding string) chan DataBuffer {
+    dataChannel := make(chan DataBuffer)
+    go func() {
+        var chunkData []byte
+        var wireBytes int
+        var err error
+        for byteOffset := int64(0); byteOffset < size; byteOffset += int64(len(chunkData)) {
+            //If paused wait till resumed
+            s.Wait()
+
+            if encoding == fileShareEncodingZstd {
+                chunkData, wireBytes, err = s.readCompressedChunk(peerID, size - byteOffset)
+            } else {
+                chunkData, err = s.read(peerID, int(min(size - byteOffset, int64(chunkSize))), fileShareWantHaveTimeout)
+                wireBytes = len(chunkData)
+            }
+            if err == nil && len(chunkData) == 0 {
+                err = unexpectedResponse
+            }
+            if err != nil {
+                dataChannel <- DataBuffer{ nil, err }
+                close(dataChannel)
+                return
+            }
+            dataChannel <- DataBuffer{ chunkData, nil }
+            s.statsLock.Lock()
+            s.RxBytes += int64(len(chunkData))
+            s.WireBytes += int64(wireBytes)
+            s.recordReceived(peerID, int64(len(chunkData)))
+            s.statsLock.Unlock()
+        }
+        close(dataChannel)
+    }()
+    return dataChannel
+}
+
+//Returns the decompressed chunk and how many bytes it took on the wire
+func (s *FileShareSession) readCompressedChunk(peerID peer.ID, remaining int64) ([]byte, int, error) {
+    lengthStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, 0, err
+    }
+    length, err := strconv.ParseInt(lengthStr[:len(lengthStr) - 1], 10, 64)
+    if err != nil {
+        return nil, 0, err
+    }
+    wireLengthStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, 0, err
+    }
+    wireLength, err := strconv.ParseInt(wireLengthStr[:len(wireLengthStr) - 1], 10, 64)
+    if err != nil {
+        return nil, 0, err
+    }
+    //Don't let a provider make us allocate more than what is left of the data
+    if length <= 0 || length > remaining || length > fileShareMaxFrameSize || wireLength <= 0 || wireLength > length {
+        return nil, 0, unexpectedResponse
+    }
+    wireData, err := s.read(peerID, int(wireLength), fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, 0, err
+    }
+    //Chunks that didn't compress are sent as they are
+    if wireLength == length {
+        return wireData, len(wireData), nil
+    }
+    data, err := zstdDecoder.DecodeAll(wireData, make([]byte, 0, length))
+    if err != nil || int64(len(data)) != length {
+        log.Printf("Failed to decompress chunk from %v. %v\n", peerID, err)
+        return nil, 0, unexpectedResponse
+    }
+    return data, len(wireData), nil
+}
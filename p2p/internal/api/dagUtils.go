@@ -0,0 +1,163 @@
+package api
+
+import (
+    "os"
+    "io"
+    "log"
+    "crypto/sha256"
+    "encoding/json"
+    "path/filepath"
+    "github.com/multiformats/go-multihash"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Type of a DAG node describing the blocks of a single file
+const fileShareDagFile = "file"
+//Number of times a block that failed verification is re-requested before giving up
+const fileShareMaxBlockRetries = 3
+//Most links in the DAG node of a file. Larger files are split into larger blocks, doubling the block size
+//until the links fit, so the node stays a few MB at most.
+const fileShareMaxDagLinks = 65536
+//Largest DAG node or manifest we accept from a peer
+const fileShareMaxDagNodeSize = 16 * 1024 * 1024
+
+var rawBlockPrefix = cid.Prefix{ Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1 }
+var dagNodePrefix = cid.Prefix{ Version: 1, Codec: cid.DagJSON, MhType: multihash.SHA2_256, MhLength: -1 }
+
+//Root node of a file's Merkle DAG, encoded as DAG-JSON.
+//Every link is the CID of one block of the file. All blocks are ChunkSize bytes except the last.
+//Fields are kept in lexical order so the encoding is canonical.
+type FileShareDag struct {
+    ChunkSize int64         `json:"chunk_size"`
+    Links []cid.Cid         `json:"links"`
+    Size int64              `json:"size"`
+    Type string             `json:"type"`
+}
+
+func (d *FileShareDag) Marshal() ([]byte, error) {
+    return json.Marshal(d)
+}
+
+func (d *FileShareDag) Unmarshal(bytes []byte) error {
+    err := json.Unmarshal(bytes, d)
+    if err != nil || d.Type != fileShareDagFile || d.ChunkSize <= 0 {
+        return invalidParams
+    }
+    if int64(len(d.Links)) != (d.Size + d.ChunkSize - 1) / d.ChunkSize {
+        return invalidParams
+    }
+    return nil
+}
+
+//Returns the offset and length of a block within the file
+func (d *FileShareDag) BlockRange(index int) (int64, int64) {
+    offset := int64(index) * d.ChunkSize
+    return offset, min(d.ChunkSize, d.Size - offset)
+}
+
+//Returns the index of the block containing the byte at offset
+func (d *FileShareDag) BlockIndex(offset int64) int {
+    return int(offset / d.ChunkSize)
+}
+
+func (d *FileShareDag) VerifyBlock(index int, data []byte) bool {
+    if index < 0 || index >= len(d.Links) {
+        return false
+    }
+    _, length := d.BlockRange(index)
+    if int64(len(data)) != length {
+        return false
+    }
+    blockCid, err := rawBlockPrefix.Sum(data)
+    if err != nil {
+        return false
+    }
+    return blockCid == d.Links[index]
+}
+
+//Size of the blocks a file of the given size is split into
+func dagChunkSize(size int64) int64 {
+    blockSize := int64(chunkSize)
+    for (size + blockSize - 1) / blockSize > fileShareMaxDagLinks {
+        blockSize *= 2
+    }
+    return blockSize
+}
+
+//Legacy CIDs are a single SHA-256 hash over the entire file
+func isLegacyCid(c cid.Cid) bool {
+    return c.Type() == cid.Raw
+}
+
+//Splits a file into blocks and builds the DAG node for it
+//Returns the DAG node, its encoding, the root CID which identifies the file and the
+//single-hash CID of the whole file which identifies its data in the content store
+func buildFileDag(filePath string) (*FileShareDag, []byte, cid.Cid, cid.Cid, error) {
+    absFilePath, err := filepath.Abs(filePath)
+    if err != nil {
+        log.Printf("Failed to resolve file path. %v\n", err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, failedToOpenFile
+    }
+    file, err := os.Open(absFilePath)
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", filePath, err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, failedToOpenFile
+    }
+    defer file.Close()
+    stat, err := file.Stat()
+    if err != nil {
+        log.Printf("Error reading file: %v. %v\n", filePath, err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, failedToOpenFile
+    }
+
+    dag := &FileShareDag{
+        ChunkSize: dagChunkSize(stat.Size()),
+        Links: []cid.Cid{},
+        Size: 0,
+        Type: fileShareDagFile,
+    }
+    hash := sha256.New()
+    block := make([]byte, dag.ChunkSize)
+    for {
+        n, err := io.ReadFull(file, block)
+        if n > 0 {
+            blockCid, err := rawBlockPrefix.Sum(block[:n])
+            if err != nil {
+                log.Printf("Failed to hash block. %v\n", err)
+                return nil, nil, cid.Cid{}, cid.Cid{}, internalError
+            }
+            dag.Links = append(dag.Links, blockCid)
+            hash.Write(block[:n])
+            dag.Size += int64(n)
+        }
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        } else if err != nil {
+            log.Printf("Error reading file: %v. %v\n", filePath, err)
+            return nil, nil, cid.Cid{}, cid.Cid{}, internalError
+        }
+    }
+
+    rootBytes, err := dag.Marshal()
+    if err != nil {
+        log.Printf("Failed to marshal DAG node. %v\n", err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, internalError
+    }
+    rootCid, err := dagNodePrefix.Sum(rootBytes)
+    if err != nil {
+        log.Printf("Failed to hash DAG node. %v\n", err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, internalError
+    }
+    mh, err := multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
+    if err != nil {
+        log.Printf("Failed to create multihash. %v\n", err)
+        return nil, nil, cid.Cid{}, cid.Cid{}, internalError
+    }
+    return dag, rootBytes, rootCid, cid.NewCidV1(cid.Raw, mh), nil
+}
+
+//Checks that a DAG node received from a peer matches the CID it was requested by
+func verifyDagNode(c cid.Cid, bytes []byte) bool {
+    nodeCid, err := c.Prefix().Sum(bytes)
+    return err == nil && nodeCid == c
+}
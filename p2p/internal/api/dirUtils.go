@@ -0,0 +1,344 @@
+package api
+
+import (
+    "os"
+    "io/fs"
+    "log"
+    "time"
+    "context"
+    "encoding/json"
+    "path/filepath"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Type of a DAG node listing the files of a directory
+const fileShareDagDirectory = "directory"
+
+//File within a shared directory. Path is relative to the directory and uses forward slashes.
+type FileShareManifestEntry struct {
+    Cid cid.Cid             `json:"cid"`
+    Path string             `json:"path"`
+    Size int64              `json:"size"`
+}
+
+//Manifest of a shared directory, encoded as DAG-JSON like the DAG node of a file.
+//Every entry is shared as a file of its own and is verified against its CID when downloaded.
+type FileShareManifest struct {
+    Entries []FileShareManifestEntry    `json:"entries"`
+    Name string                         `json:"name"`
+    Size int64                          `json:"size"`
+    Type string                         `json:"type"`
+}
+
+func (m *FileShareManifest) Marshal() ([]byte, error) {
+    return json.Marshal(m)
+}
+
+//Rejects manifests with paths that would escape the output directory
+func (m *FileShareManifest) Unmarshal(bytes []byte) error {
+    err := json.Unmarshal(bytes, m)
+    if err != nil || m.Type != fileShareDagDirectory || m.Name == "" {
+        return invalidParams
+    }
+    size := int64(0)
+    paths := make(map[string]bool)
+    for _, entry := range m.Entries {
+        if entry.Size < 0 || !filepath.IsLocal(filepath.FromSlash(entry.Path)) || paths[entry.Path] {
+            return invalidParams
+        }
+        paths[entry.Path] = true
+        size += entry.Size
+    }
+    if size != m.Size {
+        return invalidParams
+    }
+    return nil
+}
+
+//Shares every regular file within a directory and publishes a manifest listing them
+//The price is for the whole directory and is split between the entries by size
+func (f *FileShareNode) PutDirectory(ctx context.Context, inputDir string, price float64) (cid.Cid, error) {
+    absInputDir, err := filepath.Abs(inputDir)
+    if err != nil {
+        log.Printf("Failed to resolve directory path. %v\n", err)
+        return cid.Cid{}, invalidParams
+    }
+    stat, err := os.Stat(absInputDir)
+    if err != nil || !stat.IsDir() {
+        log.Printf("Error opening directory: %v. %v\n", inputDir, err)
+        return cid.Cid{}, failedToOpenFile
+    }
+    dirName := filepath.Base(absInputDir)
+
+    //Collect files first so the price can be split between them
+    paths := []string{}
+    sizes := []int64{}
+    totalSize := int64(0)
+    err = filepath.WalkDir(absInputDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if !d.Type().IsRegular() {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        paths = append(paths, path)
+        sizes = append(sizes, info.Size())
+        totalSize += info.Size()
+        return nil
+    })
+    if err != nil {
+        log.Printf("Error reading directory: %v. %v\n", inputDir, err)
+        return cid.Cid{}, failedToOpenFile
+    }
+    if len(paths) == 0 {
+        log.Printf("Directory %v has no files to share\n", inputDir)
+        return cid.Cid{}, invalidParams
+    }
+
+    //Entries already shared on their own keep being shared when the directory is deleted
+    sharedIDs, err := dbGetContentRefIDs(nil, f.host.ID().String(), fileShareRefUpload)
+    if err != nil {
+        return cid.Cid{}, err
+    }
+    shared := make(map[string]bool)
+    for _, refID := range sharedIDs {
+        shared[refID] = true
+    }
+
+    manifest := &FileShareManifest{
+        Entries: make([]FileShareManifestEntry, 0, len(paths)),
+        Name: dirName,
+        Size: 0,
+        Type: fileShareDagDirectory,
+    }
+    for i, path := range paths {
+        relPath, err := filepath.Rel(absInputDir, path)
+        if err != nil {
+            return cid.Cid{}, internalError
+        }
+        relPath = filepath.ToSlash(relPath)
+        entryPrice := price / float64(len(paths))
+        if totalSize > 0 {
+            entryPrice = price * float64(sizes[i]) / float64(totalSize)
+        }
+        entryCid, err := f.putFile(ctx, path, dirName + "/" + relPath, entryPrice, cid.Undef, FileShareMetaDetails{}, false)
+        if err != nil {
+            return cid.Cid{}, err
+        }
+        f.mstoreLock.Lock()
+        entryMeta := f.mstore[entryCid]
+        f.mstoreLock.Unlock()
+        manifest.Entries = append(manifest.Entries, FileShareManifestEntry{ Cid: entryCid, Path: relPath, Size: entryMeta.Size })
+        manifest.Size += entryMeta.Size
+    }
+
+    manifestBytes, err := manifest.Marshal()
+    if err != nil {
+        log.Printf("Failed to marshal manifest. %v\n", err)
+        return cid.Cid{}, internalError
+    }
+    manifestCid, err := dagNodePrefix.Sum(manifestBytes)
+    if err != nil {
+        log.Printf("Failed to hash manifest. %v\n", err)
+        return cid.Cid{}, internalError
+    }
+
+    for _, entry := range manifest.Entries {
+        err = f.refEntry(manifestCid, entry.Cid, shared[entry.Cid.String()])
+        if err != nil {
+            return cid.Cid{}, err
+        }
+    }
+    err = dbAddManifest(nil, f.host.ID().String(), manifestCid.String(), string(manifestBytes))
+    if err != nil {
+        return cid.Cid{}, err
+    }
+    err = dbAddUpload(nil, f.host.ID().String(), manifestCid.String(), dirName, price, manifest.Size, time.Now().UTC().Format(time.RFC3339))
+    if err != nil {
+        log.Printf("Failed to record directory into database. %v\n", err)
+        return cid.Cid{}, internalError
+    }
+    err = f.loadManifest(ctx, manifestCid, manifestBytes, price)
+    if err != nil {
+        return cid.Cid{}, err
+    }
+    return manifestCid, nil
+}
+
+//Makes a manifest available to peers and announces it
+func (f *FileShareNode) loadManifest(ctx context.Context, manifestCid cid.Cid, manifestBytes []byte, price float64) error {
+    manifest := &FileShareManifest{}
+    err := manifest.Unmarshal(manifestBytes)
+    if err != nil || !verifyDagNode(manifestCid, manifestBytes) {
+        log.Printf("Manifest of %v is corrupted\n", manifestCid)
+        return internalError
+    }
+
+    f.bstoreLock.Lock()
+    f.bstore[manifestCid] = manifestBytes
+    f.bstoreLock.Unlock()
+
+    fileMeta := FileShareMeta{ Size: manifest.Size, Price: price, Name: manifest.Name }
+    f.mstoreLock.Lock()
+    f.mstore[manifestCid] = fileMeta
+    f.mstoreLock.Unlock()
+    f.indexShared(manifestCid, fileMeta)
+
+    err = f.provide(ctx, manifestCid)
+    if err != nil {
+        return internalError
+    }
+    return nil
+}
+
+//Returns nil if the CID is not a directory we share
+func (f *FileShareNode) getManifest(c cid.Cid) *FileShareManifest {
+    f.bstoreLock.Lock()
+    bytes, ok := f.bstore[c]
+    f.bstoreLock.Unlock()
+    if !ok {
+        return nil
+    }
+    manifest := &FileShareManifest{}
+    if manifest.Unmarshal(bytes) != nil {
+        return nil
+    }
+    return manifest
+}
+
+//Stops sharing a directory and every entry in it that isn't also shared on its own or by another directory
+func (f *FileShareNode) deleteDirectory(manifestCid cid.Cid) error {
+    manifest := f.getManifest(manifestCid)
+    if manifest == nil {
+        return contentNotFound
+    }
+    err := dbRemoveUpload(nil, f.host.ID().String(), manifestCid.String())
+    if err != nil {
+        return internalError
+    }
+    dbRemoveManifest(nil, f.host.ID().String(), manifestCid.String())
+
+    f.mstoreLock.Lock()
+    delete(f.mstore, manifestCid)
+    f.mstoreLock.Unlock()
+    f.searchIndex.remove(manifestCid, f.host.ID())
+    f.bstoreLock.Lock()
+    delete(f.bstore, manifestCid)
+    f.bstoreLock.Unlock()
+
+    for _, entry := range manifest.Entries {
+        if f.releaseEntry(manifestCid, entry.Cid) {
+            continue
+        }
+        err = f.DeleteFile(entry.Cid.String())
+        if err != nil && err != contentNotFound {
+            log.Printf("Failed to delete %v of directory %v\n", entry.Path, manifestCid)
+        }
+    }
+    return nil
+}
+
+//Rebuilds the directory tree of a manifest under outputDir, downloading one entry at a time
+//Takes over the session, which tracks the progress of the whole directory
+func (f *FileShareNode) getDirectory(session *FileShareSession, providerID peer.ID, manifestCid cid.Cid, manifest *FileShareManifest,
+                                     fileMeta FileShareMeta, outputDir string) (int, error) {
+    err := os.MkdirAll(outputDir, 0751)
+    if err != nil {
+        log.Printf("Failed to create directory %v. %v\n", outputDir, err)
+        f.SessionCleanup(session, 1)
+        return -1, failedToOpenFile
+    }
+
+    session.statsLock.Lock()
+    session.RxBytes = 0
+    session.TotalBytes = manifest.Size
+    session.statsLock.Unlock()
+
+    go func() {
+        sessionStatusCode := 0
+        //The directory takes a single place in the queue for all of its entries
+        if f.queue.wait(session) {
+            for _, entry := range manifest.Entries {
+                err := f.getEntry(session, providerID, entry, filepath.Join(outputDir, filepath.FromSlash(entry.Path)))
+                if err == integrityError {
+                    sessionStatusCode = -1
+                    break
+                } else if err != nil {
+                    sessionStatusCode = 1
+                    break
+                }
+            }
+            f.queue.done()
+        } else {
+            sessionStatusCode = fileShareResultCancelled
+        }
+        if sessionStatusCode == 0 {
+            dbAddDownload(nil, f.host.ID().String(), providerID.String(), manifestCid.String(), manifest.Name, fileMeta.Price,
+                          manifest.Size, time.Now().UTC().Format(time.RFC3339))
+        } else {
+            log.Printf("Failed to download directory %v\n", manifestCid)
+        }
+        f.SessionCleanup(session, sessionStatusCode)
+    }()
+    return session.SessionID, nil
+}
+
+//Downloads a single entry of a directory and verifies it against its CID
+func (f *FileShareNode) getEntry(session *FileShareSession, providerID peer.ID, entry FileShareManifestEntry, outputFile string) error {
+    err := os.MkdirAll(filepath.Dir(outputFile), 0751)
+    if err != nil {
+        return failedToOpenFile
+    }
+    dag, err := session.GetDag(providerID, entry.Cid)
+    if err != nil {
+        return err
+    }
+    if dag != nil && dag.Size != entry.Size {
+        log.Printf("Entry %v does not match its DAG\n", entry.Path)
+        return integrityError
+    }
+
+    //Read our own copy if we have it
+    var dataChannel chan DataBuffer
+    f.fstoreLock.Lock()
+    contentKey, local := f.fstore[entry.Cid]
+    f.fstoreLock.Unlock()
+    local = local && f.checkSource(entry.Cid)
+    if local {
+        dataChannel, _, err = readFileRange(contentPath(contentKey), 0, entry.Size, session.sessionContext.Done())
+        if err != nil {
+            return err
+        }
+    } else {
+        dataChannel = session.SendWantRange(providerID, entry.Cid, 0, entry.Size)
+        if dataChannel == nil {
+            return contentNotFound
+        }
+    }
+
+    file, err := os.Create(outputFile + ".tmp")
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", outputFile + ".tmp", err)
+        for range dataChannel {
+        }
+        return failedToOpenFile
+    }
+    err = streamContent(file, session, providerID, entry.Cid, dag, dataChannel, 0, 0, entry.Size, entry.Size)
+    file.Close()
+    if err != nil {
+        log.Printf("Failed to download %v. %v\n", entry.Path, err)
+        os.Remove(outputFile + ".tmp")
+        return err
+    }
+    if local {
+        session.statsLock.Lock()
+        session.RxBytes += entry.Size
+        session.statsLock.Unlock()
+    }
+    return os.Rename(outputFile + ".tmp", outputFile)
+}
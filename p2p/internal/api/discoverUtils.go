@@ -0,0 +1,333 @@
+package api
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "context"
+    "strings"
+    "strconv"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Discovery gives up on whatever is left after this long
+const fileShareDiscoverTimeout = time.Minute
+//Peers whose catalogs are paged through at once
+const fileShareDiscoverPeerWorkers = 8
+//CIDs whose providers are looked up at once
+const fileShareDiscoverCidWorkers = 16
+//Most CIDs in a page of a catalog, we ask for this many and serve at most this many
+const fileShareDiscoverPageSize = 1000
+//Finished discoveries are kept this long for their results to be read
+const fileShareDiscoveryRetention = time.Minute * 10
+const fileShareDefaultDiscoveryLimit = 100
+
+//Sent on the discovery topic for every file found, and once more with done set when the discovery is over
+type FileShareDiscoveryEvent struct {
+    DiscoveryID int                         `json:"discovery_id"`
+    File *FileShareFileDiscoveryInfo        `json:"file"`
+    Done bool                               `json:"done"`
+}
+
+type FileShareDiscoveryPage struct {
+    DiscoveryID int                         `json:"discovery_id"`
+    Done bool                               `json:"done"`
+    //Files found so far
+    Total int                               `json:"total"`
+    Results []FileShareFileDiscoveryInfo    `json:"results"`
+}
+
+type fileShareDiscovery struct {
+    lock sync.Mutex
+    results []FileShareFileDiscoveryInfo
+    done bool
+    finished time.Time
+}
+
+//Request:  "DISCOVER PAGE\n<cursor>\n<max_count>\n"
+//Response: "KNOW\n<next_cursor>\n<count>\n<cid1>\n<cid2>\n..."
+//Pages are in order of CID, the cursor is the last CID of the previous page and is empty for the first page
+//The next cursor is empty once there are no more pages
+func (f *FileShareNode) handleDiscoverPage(stream *P2PStream) error {
+    cursorStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    cursor := cursorStr[:len(cursorStr) - 1]
+    maxCountStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    maxCount, err := strconv.Atoi(maxCountStr[:len(maxCountStr) - 1])
+    if err != nil || maxCount <= 0 {
+        return invalidParams
+    }
+    maxCount = min(maxCount, fileShareDiscoverPageSize)
+
+    knownCids := []string{}
+    f.mstoreLock.Lock()
+    for dataCid := range f.mstore {
+        dataCidStr := dataCid.String()
+        if dataCidStr > cursor {
+            knownCids = append(knownCids, dataCidStr)
+        }
+    }
+    f.mstoreLock.Unlock()
+    sort.Strings(knownCids)
+
+    nextCursor := ""
+    if len(knownCids) > maxCount {
+        knownCids = knownCids[:maxCount]
+        nextCursor = knownCids[maxCount - 1]
+    }
+    var builder strings.Builder
+    builder.WriteString(fmt.Sprintf("KNOW\n%s\n%d\n", nextCursor, len(knownCids)))
+    for _, dataCidStr := range knownCids {
+        builder.WriteString(dataCidStr + "\n")
+    }
+    return stream.SendString(builder.String())
+}
+
+//Gets a page of the CIDs a peer knows about, and the cursor of the next page
+//Providers that don't know about pages close the stream
+func (s *FileShareSession) SendDiscoverPage(peerID peer.ID, cursor string, maxCount int) ([]cid.Cid, string, error) {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+
+    err := s.sendString(peerID, fmt.Sprintf("DISCOVER PAGE\n%s\n%d\n", cursor, maxCount))
+    if err != nil {
+        s.DeleteStream(peerID)
+        return nil, "", err
+    }
+    resp, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        s.DeleteStream(peerID)
+        return nil, "", err
+    }
+    if resp != "KNOW\n" {
+        return nil, "", unexpectedResponse
+    }
+    nextCursor, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, "", err
+    }
+    countStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, "", err
+    }
+    count, err := strconv.Atoi(countStr[:len(countStr) - 1])
+    if err != nil || count < 0 || count > maxCount {
+        return nil, "", unexpectedResponse
+    }
+    knownCids := make([]cid.Cid, 0, count)
+    for i := 0; i < count; i ++ {
+        cidStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err != nil {
+            return nil, "", err
+        }
+        dataCid, err := cid.Decode(cidStr[:len(cidStr) - 1])
+        if err != nil {
+            return nil, "", unexpectedResponse
+        }
+        knownCids = append(knownCids, dataCid)
+    }
+    return knownCids, nextCursor[:len(nextCursor) - 1], nil
+}
+
+//Pages through everything a peer knows about, handing each CID to queue until it returns false
+func (s *FileShareSession) discoverPeer(ctx context.Context, peerID peer.ID, queue func(cid.Cid) bool) {
+    cursor := ""
+    for ctx.Err() == nil {
+        knownCids, nextCursor, err := s.SendDiscoverPage(peerID, cursor, fileShareDiscoverPageSize)
+        if err != nil {
+            //Peers that don't know about pages only give us their first page
+            if cursor == "" && err != unexpectedResponse {
+                knownCids = s.SendDiscover(peerID, fileShareDiscoverPageSize)
+                for _, dataCid := range knownCids {
+                    if !queue(dataCid) {
+                        return
+                    }
+                }
+            }
+            return
+        }
+        for _, dataCid := range knownCids {
+            if !queue(dataCid) {
+                return
+            }
+        }
+        //A cursor that doesn't move on would have us ask for the same page forever
+        if nextCursor == "" || nextCursor <= cursor {
+            return
+        }
+        cursor = nextCursor
+    }
+}
+
+//Finds the files known to us and our peers, and the providers of each, handing files to found as they come in
+//Peer catalogs and provider lookups each go through a fixed number of workers, and everything stops at the deadline
+func (f *FileShareNode) discover(ctx context.Context, found func(FileShareFileDiscoveryInfo)) {
+    ctx, cancel := context.WithTimeout(ctx, fileShareDiscoverTimeout)
+    defer cancel()
+    session := f.SessionCreate(ctx, "", fileShareSessionDiscovery)
+    defer f.SessionCleanup(session, 0)
+
+    seen := make(map[cid.Cid]bool)
+    seenLock := sync.Mutex{}
+    cids := make(chan cid.Cid, fileShareDiscoverPageSize)
+    queue := func(dataCid cid.Cid) bool {
+        seenLock.Lock()
+        ok := seen[dataCid]
+        seen[dataCid] = true
+        seenLock.Unlock()
+        if ok {
+            return true
+        }
+        select {
+            case cids <- dataCid:
+                return true
+            case <- ctx.Done():
+                return false
+        }
+    }
+
+    cidWg := sync.WaitGroup{}
+    cidWg.Add(fileShareDiscoverCidWorkers)
+    for i := 0; i < fileShareDiscoverCidWorkers; i ++ {
+        go func() {
+            defer cidWg.Done()
+            for dataCid := range cids {
+                if ctx.Err() != nil {
+                    continue
+                }
+                fileDiscovery := session.DiscoverFile(ctx, dataCid, 1000)
+                //If nil, no providers were found for this file
+                if fileDiscovery != nil && ctx.Err() == nil {
+                    found(*fileDiscovery)
+                }
+            }
+        }()
+    }
+
+    peerIDs := make(chan peer.ID)
+    peerWg := sync.WaitGroup{}
+    peerWg.Add(fileShareDiscoverPeerWorkers)
+    for i := 0; i < fileShareDiscoverPeerWorkers; i ++ {
+        go func() {
+            defer peerWg.Done()
+            for peerID := range peerIDs {
+                session.discoverPeer(ctx, peerID, queue)
+            }
+        }()
+    }
+
+    //Start with what we know ourselves
+    ownCids := []cid.Cid{}
+    f.mstoreLock.Lock()
+    for dataCid := range f.mstore {
+        ownCids = append(ownCids, dataCid)
+    }
+    f.mstoreLock.Unlock()
+    for _, dataCid := range ownCids {
+        if !queue(dataCid) {
+            break
+        }
+    }
+    for _, peerID := range f.host.Peerstore().Peers() {
+        if peerID == f.host.ID() {
+            continue
+        }
+        select {
+            case peerIDs <- peerID:
+            case <- ctx.Done():
+        }
+        if ctx.Err() != nil {
+            break
+        }
+    }
+    close(peerIDs)
+    peerWg.Wait()
+    close(cids)
+    cidWg.Wait()
+}
+
+func (f *FileShareNode) Discover(ctx context.Context) []FileShareFileDiscoveryInfo {
+    fileDiscoveries := []FileShareFileDiscoveryInfo{}
+    lock := sync.Mutex{}
+    f.discover(ctx, func(fileDiscovery FileShareFileDiscoveryInfo) {
+        lock.Lock()
+        fileDiscoveries = append(fileDiscoveries, fileDiscovery)
+        lock.Unlock()
+    })
+    return fileDiscoveries
+}
+
+//Starts discovering in the background. Files are published on the discovery topic as they are found,
+//and can be read with GetDiscovery until a while after the discovery is over.
+func (f *FileShareNode) StartDiscovery() int {
+    discovery := &fileShareDiscovery{ lock: sync.Mutex{}, results: []FileShareFileDiscoveryInfo{} }
+    f.discoveriesLock.Lock()
+    f.pruneDiscoveries()
+    discoveryID := f.nextDiscoveryID
+    f.nextDiscoveryID ++
+    f.discoveries[discoveryID] = discovery
+    f.discoveriesLock.Unlock()
+
+    go func() {
+        f.discover(f.ctx, func(fileDiscovery FileShareFileDiscoveryInfo) {
+            discovery.lock.Lock()
+            discovery.results = append(discovery.results, fileDiscovery)
+            discovery.lock.Unlock()
+            events.publish(eventDiscovery, FileShareDiscoveryEvent{ DiscoveryID: discoveryID, File: &fileDiscovery })
+        })
+        discovery.lock.Lock()
+        discovery.done = true
+        discovery.finished = time.Now()
+        discovery.lock.Unlock()
+        events.publish(eventDiscovery, FileShareDiscoveryEvent{ DiscoveryID: discoveryID, Done: true })
+    }()
+    return discoveryID
+}
+
+//Forgets discoveries that finished more than fileShareDiscoveryRetention ago
+//Caller must hold discoveriesLock
+func (f *FileShareNode) pruneDiscoveries() {
+    for discoveryID, discovery := range f.discoveries {
+        discovery.lock.Lock()
+        expired := discovery.done && time.Since(discovery.finished) > fileShareDiscoveryRetention
+        discovery.lock.Unlock()
+        if expired {
+            delete(f.discoveries, discoveryID)
+        }
+    }
+}
+
+//Gets the files a discovery found so far, starting from offset in the order they were found
+func (f *FileShareNode) GetDiscovery(discoveryID int, offset int, limit int) (FileShareDiscoveryPage, error) {
+    if offset < 0 || limit <= 0 || limit > fileShareDiscoverPageSize {
+        return FileShareDiscoveryPage{}, invalidParams
+    }
+    f.discoveriesLock.Lock()
+    f.pruneDiscoveries()
+    discovery, ok := f.discoveries[discoveryID]
+    f.discoveriesLock.Unlock()
+    if !ok {
+        return FileShareDiscoveryPage{}, discoveryNotFound
+    }
+
+    discovery.lock.Lock()
+    defer discovery.lock.Unlock()
+    page := FileShareDiscoveryPage{
+        DiscoveryID: discoveryID,
+        Done: discovery.done,
+        Total: len(discovery.results),
+        Results: []FileShareFileDiscoveryInfo{},
+    }
+    if offset < len(discovery.results) {
+        page.Results = append(page.Results, discovery.results[offset:min(offset + limit, len(discovery.results))]...)
+    }
+    return page, nil
+}
@@ -0,0 +1,549 @@
+package api
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "log"
+    "time"
+    "hash"
+    "context"
+    "strconv"
+    "crypto/aes"
+    "crypto/rand"
+    "crypto/cipher"
+    "crypto/sha256"
+    "encoding/hex"
+    "path/filepath"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Files bought with encrypted delivery are kept here until the key is released
+const fileShareLockedSuffix = ".locked"
+const fileShareDeliveryKeySize = 32
+const fileShareDeliveryKeyIDSize = 16
+
+//Download received encrypted, waiting for the provider to release the key once we have paid
+//The ciphertext is kept in <output_file>.locked
+type FileShareLockedDownload struct {
+    DownloadID int          `json:"download_id"`
+    Timestamp string        `json:"timestamp"`
+    FileShareFile
+    OutputFile string       `json:"output_file"`
+    WalletAddress string    `json:"wallet_address"`
+    keyID string
+    keyHash string
+}
+
+//A key is only ever used for one file, which always encrypts to the same ciphertext under it,
+//so the counter of the CTR stream can always start at 0
+func newDeliveryCipher(key []byte) (cipher.Stream, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
+
+func hashDeliveryKey(key []byte) string {
+    keyHash := sha256.Sum256(key)
+    return hex.EncodeToString(keyHash[:])
+}
+
+//Encrypts data as it is read, adding the ciphertext to hash
+func encryptData(dataChannel chan DataBuffer, stream cipher.Stream, hash hash.Hash, stop <-chan struct{}) chan DataBuffer {
+    encryptedChannel := make(chan DataBuffer, 2)
+    go func() {
+        defer close(encryptedChannel)
+        for buf := range dataChannel {
+            if buf.err == nil {
+                ciphertext := make([]byte, len(buf.data))
+                stream.XORKeyStream(ciphertext, buf.data)
+                hash.Write(ciphertext)
+                buf.data = ciphertext
+            }
+            if !sendBuffer(encryptedChannel, buf, stop) {
+                return
+            }
+        }
+    }()
+    return encryptedChannel
+}
+
+//Request:  "WANT ENCRYPTED\n<remote_session_id>\n<cid>\n"
+//Response: "HERE\n<size>\n<key_id>\n<key_hash>\n<byte1><byte2>...<ciphertext_hash>\n"
+//          "BUSY\n<retry_after_seconds>\n" if we are already serving as many sessions as allowed
+//The file is encrypted under a key of its own, which is only released with WANT KEY once the requester
+//has paid. The hashes are hex encoded SHA-256 hashes.
+func (f *FileShareNode) handleWantEncrypted(stream *P2PStream, encoding string) error {
+    remoteSessionIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    remoteSessionID, err := strconv.Atoi(remoteSessionIDStr[:len(remoteSessionIDStr) - 1])
+    if err != nil {
+        return err
+    }
+    cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    c, err := cid.Decode(cidStr[:len(cidStr) - 1])
+    if err != nil {
+        return err
+    }
+
+    f.fstoreLock.Lock()
+    contentKey, ok := f.fstore[c]
+    f.fstoreLock.Unlock()
+    ok = ok && f.checkSource(c)
+    if !ok {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    rSession, err := f.RemoteSessionCreate(stream.RemotePeerID, remoteSessionID)
+    if err != nil {
+        return sendBusy(stream)
+    }
+    defer f.RemoteSessionCleanup(rSession)
+
+    keyID, key, err := f.deliveryKey(stream.RemotePeerID, c)
+    if err != nil {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    cipherStream, err := newDeliveryCipher(key)
+    if err != nil {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    dataChannel, size, err := readFile(contentPath(contentKey), rSession.stop)
+    if err != nil {
+        return stream.SendString("DON'T HAVE\n")
+    }
+
+    err = stream.SendString(fmt.Sprintf("HERE\n%d\n%s\n%s\n", size, keyID, hashDeliveryKey(key)))
+    if err != nil {
+        return err
+    }
+    ciphertextHash := sha256.New()
+    //The transfer is only complete once the key is released
+    err = f.serveData(stream, rSession, c, 0, false, encryptData(dataChannel, cipherStream, ciphertextHash, rSession.stop), encoding)
+    if err != nil {
+        return err
+    }
+    return stream.SendString(hex.EncodeToString(ciphertextHash.Sum(nil)) + "\n")
+}
+
+//Gets the key a file is encrypted under for a requester, which is made the first time they ask for the file
+//Asking again gets the same key, so requesters can't grow the keys we keep by repeating their requests
+func (f *FileShareNode) deliveryKey(requesterID peer.ID, c cid.Cid) (string, []byte, error) {
+    peerID := f.host.ID().String()
+    keyID, keyStr, err := dbGetRequesterDeliveryKey(nil, peerID, requesterID.String(), c.String())
+    if err == nil {
+        key, err := hex.DecodeString(keyStr)
+        if err != nil {
+            return "", nil, internalError
+        }
+        return keyID, key, nil
+    } else if err != keyNotFound {
+        return "", nil, err
+    }
+
+    key := make([]byte, fileShareDeliveryKeySize)
+    keyIDBytes := make([]byte, fileShareDeliveryKeyIDSize)
+    _, err = rand.Read(key)
+    if err == nil {
+        _, err = rand.Read(keyIDBytes)
+    }
+    if err != nil {
+        log.Printf("Failed to generate delivery key. %v\n", err)
+        return "", nil, internalError
+    }
+    keyID = hex.EncodeToString(keyIDBytes)
+    //Keep the key before sending anything, the requester may pay long after the transfer
+    err = dbAddDeliveryKey(nil, peerID, keyID, requesterID.String(), c.String(), hex.EncodeToString(key),
+                           time.Now().UTC().Format(time.RFC3339))
+    if err != nil {
+        return "", nil, err
+    }
+    return keyID, key, nil
+}
+
+//Request:  "WANT KEY\n<key_id>\n<tx_id>\n"
+//Response: "HERE\n<key>\n"
+//          "PAYMENT REQUIRED\n<price>\n<wallet_address>\n" if no transaction was given and the file isn't paid for
+//          "PAYMENT REJECTED\n<reason>\n" if the transaction doesn't pay for the file
+//          "DON'T HAVE\n" if the key doesn't exist or was made for another peer
+//The transaction ID may be empty for free files or files the requester already paid for
+func (f *FileShareNode) handleWantKey(stream *P2PStream) error {
+    keyIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    txIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    txID := txIDStr[:len(txIDStr) - 1]
+
+    requesterID, cidStr, key, err := dbGetDeliveryKey(nil, f.host.ID().String(), keyIDStr[:len(keyIDStr) - 1])
+    if err != nil || requesterID != stream.RemotePeerID.String() {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    c, err := cid.Decode(cidStr)
+    if err != nil {
+        return stream.SendString("DON'T HAVE\n")
+    }
+
+    if !f.hasPaid(stream.RemotePeerID, c) {
+        if txID == "" {
+            return f.sendPaymentRequired(stream, c)
+        }
+        err = f.redeemPayment(stream.RemotePeerID, c, txID)
+        if err == contentNotFound {
+            return stream.SendString("DON'T HAVE\n")
+        }
+        if err != nil {
+            log.Printf("Rejected payment from %v for %v. %v\n", stream.RemotePeerID, c, err)
+            return stream.SendString("PAYMENT REJECTED\n" + err.Error() + "\n")
+        }
+    }
+    log.Printf("Releasing key of %v to %v\n", c, stream.RemotePeerID)
+    return stream.SendString("HERE\n" + key + "\n")
+}
+
+//Returns the ciphertext of the file along with the ID and hash of the key it is encrypted under
+func (s *FileShareSession) SendWantEncrypted(peerID peer.ID, c cid.Cid) (chan DataBuffer, string, string) {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+    encoding := s.negotiateEncoding(peerID)
+    s.trackProvider(peerID)
+    requested := time.Now()
+    //Send WANT ENCRYPTED request
+    err := s.sendString(peerID, fmt.Sprintf("WANT ENCRYPTED\n%d\n%s\n", s.SessionID, c.String()))
+    if err != nil {
+        return nil, "", ""
+    }
+
+    //Wait for response
+    resp, err := s.readString(peerID, '\n', fileShareWantTimeout)
+    if err != nil {
+        return nil, "", ""
+    }
+    s.recordLatency(peerID, requested)
+
+    //Provider is serving too many sessions, response of the form BUSY\n<retry_after_seconds>\n
+    if resp == "BUSY\n" {
+        retryAfterStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err != nil {
+            return nil, "", ""
+        }
+        retryAfter, err := strconv.Atoi(retryAfterStr[:len(retryAfterStr) - 1])
+        if err != nil {
+            return nil, "", ""
+        }
+        s.setRetryAfter(peerID, time.Duration(retryAfter) * time.Second)
+        return nil, "", ""
+    }
+    //Response of the form HERE\n<size>\n<key_id>\n<key_hash>\n<byte><byte>...
+    if resp == "HERE\n" {
+        header := make([]string, 3)
+        for i := range header {
+            header[i], err = s.readString(peerID, '\n', fileShareWantHaveTimeout)
+            if err != nil {
+                return nil, "", ""
+            }
+            header[i] = header[i][:len(header[i]) - 1]
+        }
+        size, err := strconv.ParseInt(header[0], 10, 64)
+        if err != nil {
+            return nil, "", ""
+        }
+        s.statsLock.Lock()
+        s.TotalBytes = size
+        delete(s.retryAfter, peerID)
+        s.providerSample(peerID).startTransfer()
+        s.statsLock.Unlock()
+        return s.receiveData(peerID, size, encoding), header[1], header[2]
+    }
+    return nil, "", ""
+}
+
+//Reads the hash of the ciphertext sent after the data of WANT ENCRYPTED
+func (s *FileShareSession) readCiphertextHash(peerID peer.ID) (string, error) {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+    ciphertextHash, err := s.readString(peerID, '\n', fileShareWantTimeout)
+    if err != nil {
+        return "", err
+    }
+    return ciphertextHash[:len(ciphertextHash) - 1], nil
+}
+
+//Downloads a file encrypted, so it can be checked to have arrived in full before paying for it
+//The download is listed in the locked downloads once complete, and is decrypted by UnlockDownload
+func (f *FileShareNode) GetFileEncrypted(ctx context.Context, providerIDStr string, reqCidStr string, outputFile string, priority int) (int, error) {
+    reqCid, err := cid.Decode(reqCidStr)
+    if err != nil {
+        log.Printf("Failed to decode cid %v. %v", reqCidStr, err)
+        return -1, invalidParams
+    }
+    providerID, err := peer.Decode(providerIDStr)
+    if err != nil {
+        log.Printf("Failed to decode provider ID string '%v'. %v\n", providerIDStr, err)
+        return -1, invalidParams
+    }
+    //Nothing to buy from ourselves
+    if f.HasFile(reqCid) || providerID == f.host.ID() {
+        return -1, invalidParams
+    }
+    outputFile, err = filepath.Abs(outputFile)
+    if err != nil {
+        log.Printf("Failed to resolve filepath. %v\n", outputFile)
+        return -1, invalidParams
+    }
+    lockedFile := outputFile + fileShareLockedSuffix
+
+    session := f.SessionCreate(ctx, reqCidStr, fileShareSessionDownload)
+    //The session can already be seen by others once it is created
+    session.statsLock.Lock()
+    session.Priority = priority
+    session.statsLock.Unlock()
+    fileMeta := FileShareMeta{}
+    bytes := session.SendWantMeta(providerID, reqCid)
+    if bytes == nil || fileMeta.Unmarshal(bytes) != nil {
+        log.Printf("Failed to get file metadata.\n")
+        f.SessionCleanup(session, 1)
+        return -1, internalError
+    }
+    walletAddress := session.SendWantWallet(providerID)
+
+    os.MkdirAll(filepath.Dir(lockedFile), 0751)
+    file, err := os.Create(lockedFile)
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", lockedFile, err)
+        f.SessionCleanup(session, 1)
+        return -1, failedToOpenFile
+    }
+    session.statsLock.Lock()
+    session.TotalBytes = fileMeta.Size
+    session.statsLock.Unlock()
+
+    go func() {
+        sessionStatusCode := 0
+        var dataChannel chan DataBuffer
+        var keyID string
+        var keyHash string
+        var ciphertextHash string
+        var err error
+        hash := sha256.New()
+
+        //Wait for our turn before asking for any data
+        if !f.queue.wait(session) {
+            file.Close()
+            sessionStatusCode = fileShareResultCancelled
+            goto Failed
+        }
+        defer f.queue.done()
+        dataChannel, keyID, keyHash = session.SendWantEncrypted(providerID, reqCid)
+        if dataChannel == nil {
+            log.Printf("Failed to get encrypted file.\n")
+            file.Close()
+            sessionStatusCode = 1
+            goto Failed
+        }
+        for buf := range dataChannel {
+            //Drain the rest of the channel once the transfer has failed
+            if sessionStatusCode != 0 {
+                continue
+            }
+            if buf.err != nil {
+                sessionStatusCode = 1
+                continue
+            }
+            hash.Write(buf.data)
+            _, err = file.Write(buf.data)
+            if err != nil {
+                log.Printf("Failed to write to file. %v", err)
+                sessionStatusCode = 1
+            }
+        }
+        file.Sync()
+        file.Close()
+        if sessionStatusCode != 0 {
+            goto Failed
+        }
+        ciphertextHash, err = session.readCiphertextHash(providerID)
+        if err != nil {
+            sessionStatusCode = 1
+            goto Failed
+        }
+        if ciphertextHash != hex.EncodeToString(hash.Sum(nil)) {
+            log.Printf("Encrypted file does not match the provider's hash!\n")
+            sessionStatusCode = -1
+            goto Failed
+        }
+
+        _, err = dbAddLockedDownload(nil, f.host.ID().String(), &FileShareLockedDownload{
+            Timestamp: time.Now().UTC().Format(time.RFC3339),
+            FileShareFile: FileShareFile{
+                FileShareMeta: fileMeta,
+                DataCid: reqCidStr,
+                ProviderID: providerIDStr,
+            },
+            OutputFile: outputFile,
+            WalletAddress: walletAddress,
+            keyID: keyID,
+            keyHash: keyHash,
+        })
+        if err != nil {
+            sessionStatusCode = 1
+            goto Failed
+        }
+        f.SessionCleanup(session, 0)
+        return
+Failed:
+        os.Remove(lockedFile)
+        f.SessionCleanup(session, sessionStatusCode)
+    }()
+    return session.SessionID, nil
+}
+
+func (f *FileShareNode) GetLockedDownloads() ([]FileShareLockedDownload, error) {
+    return dbGetLockedDownloads(nil, f.host.ID().String())
+}
+
+//Asks the provider for the key of a locked download, paying with the given transaction if needed
+//The file is decrypted and checked against its CID before it is moved to the output file
+func (f *FileShareNode) UnlockDownload(ctx context.Context, downloadID int, txID string) error {
+    lockedDownloads, err := dbGetLockedDownloads(nil, f.host.ID().String())
+    if err != nil {
+        return err
+    }
+    var locked *FileShareLockedDownload
+    for i := range lockedDownloads {
+        if lockedDownloads[i].DownloadID == downloadID {
+            locked = &lockedDownloads[i]
+        }
+    }
+    if locked == nil {
+        return downloadNotFound
+    }
+    reqCid, err := cid.Decode(locked.DataCid)
+    if err != nil {
+        return internalError
+    }
+
+    key, err := f.requestDeliveryKey(ctx, locked, txID)
+    if err != nil {
+        return err
+    }
+    if hashDeliveryKey(key) != locked.keyHash {
+        log.Printf("Provider %v released a key that doesn't match the download\n", locked.ProviderID)
+        return integrityError
+    }
+
+    tmpOutputFile := locked.OutputFile + ".tmp"
+    err = decryptFile(locked.OutputFile + fileShareLockedSuffix, tmpOutputFile, key)
+    if err != nil {
+        os.Remove(tmpOutputFile)
+        return err
+    }
+    var dataCid cid.Cid
+    if isLegacyCid(reqCid) {
+        dataCid, _, err = computeFileCid(tmpOutputFile)
+    } else {
+        _, _, dataCid, _, err = buildFileDag(tmpOutputFile)
+    }
+    if err != nil || dataCid != reqCid {
+        //The key matched, so the provider sent the wrong file
+        log.Printf("Decrypted file does not match cid %v!\n", reqCid)
+        os.Remove(tmpOutputFile)
+        os.Remove(locked.OutputFile + fileShareLockedSuffix)
+        dbRemoveLockedDownload(nil, f.host.ID().String(), downloadID)
+        return integrityError
+    }
+
+    err = os.Rename(tmpOutputFile, locked.OutputFile)
+    if err != nil {
+        log.Printf("Failed to move temporary file to output file. %v\n", err)
+        os.Remove(tmpOutputFile)
+        return internalError
+    }
+    os.Remove(locked.OutputFile + fileShareLockedSuffix)
+    dbRemoveLockedDownload(nil, f.host.ID().String(), downloadID)
+    dbAddDownload(nil, f.host.ID().String(), locked.ProviderID, locked.DataCid, locked.Name, locked.Price,
+                  locked.Size, time.Now().UTC().Format(time.RFC3339))
+    return nil
+}
+
+func (f *FileShareNode) requestDeliveryKey(ctx context.Context, locked *FileShareLockedDownload, txID string) ([]byte, error) {
+    timeoutCtx, cancel := context.WithTimeout(ctx, fileShareOpenStreamTimeout)
+    stream, err := p2pOpenStream(timeoutCtx, fileShareProtocol, f.host, f.kadDHT, locked.ProviderID)
+    cancel()
+    if err != nil {
+        return nil, err
+    }
+    defer stream.Close()
+
+    err = stream.SendString(fmt.Sprintf("WANT KEY\n%s\n%s\n", locked.keyID, txID))
+    if err != nil {
+        return nil, err
+    }
+    //Checking the payment may take as long as a call to the provider's wallet
+    resp, err := stream.ReadString('\n', fileShareWalletRPCTimeout + fileShareWantTimeout)
+    if err != nil {
+        return nil, err
+    }
+    switch resp {
+        case "HERE\n":
+            keyStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+            if err != nil {
+                return nil, err
+            }
+            stream.SendString("CLOSE\n")
+            key, err := hex.DecodeString(keyStr[:len(keyStr) - 1])
+            if err != nil {
+                return nil, unexpectedResponse
+            }
+            return key, nil
+        case "PAYMENT REQUIRED\n":
+            return nil, paymentRequired
+        case "PAYMENT REJECTED\n":
+            reason, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+            if err != nil {
+                return nil, err
+            }
+            log.Printf("Provider %v rejected transaction %v. %v", locked.ProviderID, txID, reason)
+            return nil, paymentRejected
+        case "DON'T HAVE\n":
+            return nil, contentNotFound
+    }
+    return nil, unexpectedResponse
+}
+
+func decryptFile(srcPath string, dstPath string, key []byte) error {
+    cipherStream, err := newDeliveryCipher(key)
+    if err != nil {
+        return integrityError
+    }
+    src, err := os.Open(srcPath)
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", srcPath, err)
+        return failedToOpenFile
+    }
+    defer src.Close()
+    dst, err := os.Create(dstPath)
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", dstPath, err)
+        return failedToOpenFile
+    }
+    defer dst.Close()
+    _, err = io.Copy(dst, cipher.StreamReader{ S: cipherStream, R: src })
+    if err != nil {
+        log.Printf("Failed to decrypt %v. %v\n", srcPath, err)
+        return internalError
+    }
+    return dst.Sync()
+}
@@ -14,6 +14,7 @@ var invalidParams = errors.New("Error: Invalid parameter(s)")
 var keyNotFound = errors.New("Error: Failed to find key")
 var peerNotFound = errors.New("Error: Failed to find peer")
 var timeoutError = errors.New("Error: Timed out")
+var streamClosed = errors.New("Error: Stream closed by peer")
 
 var unexpectedResponse = errors.New("Error: Unexpected response")
 
@@ -22,6 +23,25 @@ var failedToOpenFile = errors.New("Error: Failed to open file")
 var sessionNotFound = errors.New("Error: Session not found")
 var remoteSessionNotFound = errors.New("Error: Remote session not found")
 var contentNotFound = errors.New("Error: Content not found")
+var integrityError = errors.New("Error: Content failed integrity check")
+var downloadNotFound = errors.New("Error: Download not found")
+var downloadInProgress = errors.New("Error: Download already in progress")
+var storageQuotaExceeded = errors.New("Error: Storage quota exceeded")
+var providerBusy = errors.New("Error: Provider is busy, try again later")
+var sessionNotQueued = errors.New("Error: Session is not queued")
+var sessionAlreadyComplete = errors.New("Error: Session already complete")
+var remoteSessionCancelled = errors.New("Error: Remote session cancelled")
+var walletUnavailable = errors.New("Error: Wallet unavailable")
+var paymentNotFound = errors.New("Error: Payment not found")
+var paymentTooLow = errors.New("Error: Payment is less than the price")
+var paymentUnconfirmed = errors.New("Error: Payment does not have enough confirmations")
+var paymentAlreadyUsed = errors.New("Error: Payment was already used")
+var paymentRejected = errors.New("Error: Payment rejected by provider")
+var paymentRequired = errors.New("Error: Payment required")
+var signatureInvalid = errors.New("Error: Invalid signature")
+var discoveryNotFound = errors.New("Error: Discovery not found")
+var sourceChanged = errors.New("Error: File changed while it was being shared")
+var cidMismatch = errors.New("Error: File does not match its CID")
 
 //Chat
 var chatNotFound = errors.New("Error: Chat not found")
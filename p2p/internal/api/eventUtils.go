@@ -0,0 +1,109 @@
+package api
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+//Topics that can be subscribed to over WebSocket
+const eventSessionProgress = "session_progress"
+const eventSessionComplete = "session_complete"
+const eventChatRequest = "chat_request"
+const eventChatMessage = "chat_message"
+const eventProxy = "proxy"
+const eventDiscovery = "discovery"
+//How often the progress of active downloads is pushed
+const eventProgressInterval = time.Second
+//Events queued for a subscriber that is not keeping up are dropped past this
+const eventBufferSize = 256
+
+type P2PEvent struct {
+    Topic string            `json:"topic"`
+    Data interface{}        `json:"data"`
+}
+
+type ChatMessageEvent struct {
+    PeerID string           `json:"peer_id"`
+    ChatID int              `json:"chat_id"`
+    Message Message         `json:"message"`
+}
+
+type ProxyEvent struct {
+    PeerID string           `json:"peer_id"`
+    //"proxy" when we connect to or disconnect from a proxy, "client" when a client does so with us
+    Role string             `json:"role"`
+    Connected bool          `json:"connected"`
+}
+
+type eventSubscriber struct {
+    topics map[string]bool
+    events chan P2PEvent
+}
+
+//Fans events out to subscribers. Events are published from wherever they happen, so nodes don't need
+//to know about the RPC layer.
+type eventBus struct {
+    lock sync.Mutex
+    nextID int
+    subscribers map[int]*eventSubscriber
+}
+
+var events = &eventBus{
+    lock: sync.Mutex{},
+    nextID: 0,
+    subscribers: make(map[int]*eventSubscriber),
+}
+
+func validEventTopic(topic string) bool {
+    switch topic {
+        case eventSessionProgress, eventSessionComplete, eventChatRequest, eventChatMessage, eventProxy, eventDiscovery:
+            return true
+    }
+    return false
+}
+
+//Subscribes to the given topics, or to every topic if there are none
+func (b *eventBus) subscribe(topics []string) (int, *eventSubscriber) {
+    subscriber := &eventSubscriber{
+        topics: make(map[string]bool),
+        events: make(chan P2PEvent, eventBufferSize),
+    }
+    for _, topic := range topics {
+        subscriber.topics[topic] = true
+    }
+
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    subscriberID := b.nextID
+    b.nextID ++
+    b.subscribers[subscriberID] = subscriber
+    return subscriberID, subscriber
+}
+
+func (b *eventBus) unsubscribe(subscriberID int) {
+    b.lock.Lock()
+    delete(b.subscribers, subscriberID)
+    b.lock.Unlock()
+}
+
+func (s *eventSubscriber) wants(topic string) bool {
+    return len(s.topics) == 0 || s.topics[topic]
+}
+
+//Never blocks, a subscriber that falls too far behind misses events
+func (b *eventBus) publish(topic string, data interface{}) {
+    event := P2PEvent{ Topic: topic, Data: data }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    for subscriberID, subscriber := range b.subscribers {
+        if !subscriber.wants(topic) {
+            continue
+        }
+        select {
+            case subscriber.events <- event:
+            default:
+                log.Printf("Dropping %v event for subscriber %d\n", topic, subscriberID)
+        }
+    }
+}
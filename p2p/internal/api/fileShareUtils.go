@@ -10,6 +10,7 @@ import (
     "sync"
     "strconv"
     "strings"
+    "unicode/utf8"
     "encoding/binary"
     "path/filepath"
     "crypto/sha256"
@@ -29,6 +30,9 @@ const fileShareFindProvidersTimeout = time.Second * 1
 const fileShareOpenStreamTimeout = time.Second * 1
 const fileShareIdleTimeout = time.Second * 60
 const fileShareDirectory = "fileshare"
+//Session result of a cancelled download. Otherwise 0 is success, 1 is failure and -1 is data that failed verification
+const fileShareResultCancelled = 2
+//Uploaded files used to be copied here by name, they are moved into the content store on startup
 const fileShareUploadsDirectory = "fileshare/uploads"
 
 var nextSessionIDLock sync.Mutex
@@ -39,15 +43,46 @@ type FileShareNode struct {
     host host.Host
     kadDHT *dht.IpfsDHT
     fstore map[cid.Cid]string
+    //Files shared without a copy, guarded by fstoreLock
+    sources map[cid.Cid]fileShareSource
     mstore map[cid.Cid]FileShareMeta
+    bstore map[cid.Cid][]byte
     sessionStore map[int]*FileShareSession
     rSessionStore map[peer.ID]map[int]*FileShareRemoteSession
+    activeDownloads map[int]bool
     walletAddress string
+    storageQuota int64
+    uploadLimits FileShareUploadLimits
+    uploadLimiter *rateLimiter
+    peerLimiters map[peer.ID]*rateLimiter
+    queue *fileShareQueue
+    paymentSettings FileSharePaymentSettings
+    seedSettings FileShareSeedSettings
+    provideStatus map[cid.Cid]*FileShareProvideStatus
+    searchIndex *fileShareSearchIndex
+    discoveries map[int]*fileShareDiscovery
+    nextDiscoveryID int
+    reputations map[peer.ID]*FileShareReputation
+    //What each remote session was served of each CID, so transfers split over several requests count as complete
+    served map[fileShareServedKey]*fileShareServed
+    //Cancelled when the node is closed, which stops its background work
+    ctx context.Context
+    stop context.CancelFunc
     fstoreLock sync.Mutex
     mstoreLock sync.Mutex
+    bstoreLock sync.Mutex
     sessionStoreLock sync.Mutex
     rSessionStoreLock sync.Mutex
+    activeDownloadsLock sync.Mutex
     walletLock sync.Mutex
+    storeLock sync.Mutex
+    limitsLock sync.Mutex
+    paymentLock sync.Mutex
+    provideLock sync.Mutex
+    discoveriesLock sync.Mutex
+    reputationLock sync.Mutex
+    seedLock sync.Mutex
+    servedLock sync.Mutex
 }
 
 type Pausable struct {
@@ -60,9 +95,15 @@ type FileShareSession struct {
     SessionID int                   `json:"session_id"`
     ReqCid string                   `json:"req_cid"`
     RxBytes int64                   `json:"rx_bytes"`
+    WireBytes int64                 `json:"wire_bytes"`
     TotalBytes int64                `json:"total_bytes"`
     Complete bool                   `json:"is_complete"`
     Result int                      `json:"result"`
+    Queued bool                     `json:"is_queued"`
+    Priority int                    `json:"priority"`
+    Type string                     `json:"type"`
+    StartTime string                `json:"start_time"`
+    EndTime string                  `json:"end_time"`
     Pausable
     node *FileShareNode
     streamMap map[peer.ID]*P2PStream
@@ -70,7 +111,25 @@ type FileShareSession struct {
     reqLocks map[peer.ID]*sync.Mutex
     reqLocksLock sync.Mutex
     statsLock sync.Mutex
+    retryAfter map[peer.ID]time.Duration
+    //What was observed of each provider asked for data, guarded by statsLock
+    providerSamples map[peer.ID]*fileShareProviderSample
+    //Encoding agreed on for each stream, guarded by streamLock
+    encodings map[*P2PStream]string
+    legacyPeers map[peer.ID]bool
+    //Providers that only send metadata in the legacy layout, guarded by streamLock
+    legacyMetaPeers map[peer.ID]bool
+    //Providers that don't sign their metadata, guarded by streamLock
+    unsignedMetaPeers map[peer.ID]bool
+    //Transaction paying for the requested file, and the providers that accepted it
+    txID string
+    paidPeers map[peer.ID]bool
+    cancelled bool
+    startTime time.Time
+    transferStart time.Time
+    resumedBytes int64
     sessionContext context.Context
+    cancelContext context.CancelFunc
 }
 
 type FileShareRemoteSession struct {
@@ -78,6 +137,12 @@ type FileShareRemoteSession struct {
     remotePeerID peer.ID
     txBytesLock sync.Mutex
     txBytes int64
+    //Closed when the requester cancels the session
+    stop chan struct{}
+    stopOnce sync.Once
+    //Requests currently served under the session, guarded by rSessionStoreLock
+    //Requesters may send several at once, such as a block repair while the data is still streaming
+    refs int
     Pausable
 }
 
@@ -92,12 +157,18 @@ type FileShareProvider struct {
     Price float64           `json:"price"`
     Name string             `json:"file_name"`
     WalletAddress string    `json:"wallet_address"`
+    //Set if the metadata and wallet address were signed by the provider
+    Verified bool           `json:"verified"`
+    //Reputation of the provider from our past downloads, between 0 and 100
+    Score float64           `json:"score"`
+    FileShareMetaDetails
 }
 
 type FileShareMeta struct {
     Size int64              `json:"size"`
     Price float64           `json:"price"`
     Name string             `json:"file_name"`
+    FileShareMetaDetails
 }
 
 type FileShareFile struct {
@@ -109,11 +180,17 @@ type FileShareFile struct {
 type FileShareUpload struct {
     Timestamp string        `json:"timestamp"`
     FileShareFile
+    //Path of the file if it is shared without a copy
+    SourcePath string       `json:"source_path"`
+    sourceSize int64
+    sourceModTime string
 }
 
 type FileShareDownload struct {
     Timestamp string        `json:"timestamp"`
     FileShareFile
+    //CID of the upload the download was seeded as, empty if it isn't shared
+    UploadCid string        `json:"upload_cid"`
 }
 
 type DataBuffer struct {
@@ -121,22 +198,31 @@ type DataBuffer struct {
     err error
 }
 
-func (r *FileShareMeta) Marshal() ([]byte, error) {
-    var nameByteLen uint8
-    if len(r.Name) > 255 {
-        return nil, invalidParams
-    } else {
-        nameByteLen = uint8(len(r.Name))
+//Fixed layout understood by every peer: size, price, name length and at most 255 bytes of name
+//Longer names are cut at the last whole character that fits, so legacy peers still get the file
+func (r *FileShareMeta) MarshalLegacy() ([]byte, error) {
+    name := r.Name
+    if len(name) > 255 {
+        cut := 255
+        for cut > 0 && !utf8.RuneStart(name[cut]) {
+            cut --
+        }
+        //Not UTF-8, cut at the byte limit
+        if cut == 0 {
+            cut = 255
+        }
+        name = name[:cut]
     }
-    bytes := make([]byte, 0, 8 + 8 + 1 + len(r.Name))
+    nameByteLen := uint8(len(name))
+    bytes := make([]byte, 0, 8 + 8 + 1 + len(name))
     bytes, _ = binary.Append(bytes, binary.BigEndian, r.Size)
     bytes, _ = binary.Append(bytes, binary.BigEndian, r.Price)
     bytes, _ = binary.Append(bytes, binary.BigEndian, nameByteLen)
-    bytes, _ = binary.Append(bytes, binary.BigEndian, []byte(r.Name))
+    bytes, _ = binary.Append(bytes, binary.BigEndian, []byte(name))
     return bytes, nil
 }
 
-func (r *FileShareMeta) Unmarshal(bytes []byte) error {
+func (r *FileShareMeta) unmarshalLegacy(bytes []byte) error {
     var nameByteLen uint8
 
     buf := libbytes.NewReader(bytes)
@@ -204,32 +290,96 @@ func FileShareNodeCreate(node host.Host, kadDHT *dht.IpfsDHT, walletAddress stri
         host: node,
         kadDHT: kadDHT,
         fstore: make(map[cid.Cid]string),
+        sources: make(map[cid.Cid]fileShareSource),
         mstore: make(map[cid.Cid]FileShareMeta),
+        bstore: make(map[cid.Cid][]byte),
         sessionStore: make(map[int]*FileShareSession),
         rSessionStore: make(map[peer.ID]map[int]*FileShareRemoteSession),
+        activeDownloads: make(map[int]bool),
         walletAddress: walletAddress,
         mstoreLock: sync.Mutex{},
         fstoreLock: sync.Mutex{},
+        bstoreLock: sync.Mutex{},
         sessionStoreLock: sync.Mutex{},
         rSessionStoreLock: sync.Mutex{},
+        activeDownloadsLock: sync.Mutex{},
         walletLock: sync.Mutex{},
+        storeLock: sync.Mutex{},
+        uploadLimiter: &rateLimiter{},
+        peerLimiters: make(map[peer.ID]*rateLimiter),
+        limitsLock: sync.Mutex{},
+        queue: newFileShareQueue(),
+        paymentLock: sync.Mutex{},
+        provideStatus: make(map[cid.Cid]*FileShareProvideStatus),
+        searchIndex: newFileShareSearchIndex(),
+        discoveries: make(map[int]*fileShareDiscovery),
+        served: make(map[fileShareServedKey]*fileShareServed),
+        reputations: make(map[peer.ID]*FileShareReputation),
+        discoveriesLock: sync.Mutex{},
+        provideLock: sync.Mutex{},
     }
 
     node.SetStreamHandler(fileShareProtocol, fsNode.fileShareStreamHandler)
+    fsNode.loadStorageQuota()
+    fsNode.loadUploadLimits()
+    fsNode.loadMaxActiveDownloads()
+    fsNode.loadPaymentSettings()
+    fsNode.loadReputations()
+    fsNode.loadSeedSettings()
 
     // Read files database for existing uploaded files
     files, err := dbGetUploads(nil, node.ID().String())
     if err == nil {
+        migratedFiles := []string{}
         for _, file := range files {
-            _, err := cid.Decode(file.DataCid)
+            dataCid, err := cid.Decode(file.DataCid)
             if err != nil {
                 // Remove corrupted entry with invalid cid
                 dbRemoveUpload(nil, node.ID().String(), file.DataCid)
                 continue
             }
 
+            // Directories only have their manifest, the entries are uploads of their own
+            manifestStr, err := dbGetManifest(nil, node.ID().String(), file.DataCid)
+            if err == nil {
+                fsNode.loadManifest(context.Background(), dataCid, []byte(manifestStr), file.Price)
+                continue
+            }
+
+            // Files shared without a copy are withdrawn if they changed while we were offline
+            noCopy := file.SourcePath != ""
+            if noCopy {
+                source := fileShareSource{ Path: file.SourcePath, Size: file.sourceSize, ModTime: file.sourceModTime }
+                if !source.unchanged() {
+                    log.Printf("Source file %v of %v changed or is missing, withdrawing it\n", file.SourcePath, file.DataCid)
+                    fsNode.withdrawUpload(dataCid)
+                    continue
+                }
+                details := loadFileDetails(node.ID().String(), file)
+                _, err = fsNode.putFile(context.Background(), file.SourcePath, file.Name, file.Price, dataCid, details, true)
+                if err == cidMismatch {
+                    log.Printf("Source file %v no longer matches %v, withdrawing it\n", file.SourcePath, file.DataCid)
+                    fsNode.withdrawUpload(dataCid)
+                } else if err != nil {
+                    log.Printf("Failed to share %v again. %v\n", file.SourcePath, err)
+                }
+                continue
+            }
+
+            // Files shared before the content store was introduced are moved into it
+            filePath := fileShareUploadsDirectory + "/" + file.Name
+            contentKey, err := dbGetContentRef(nil, node.ID().String(), fileShareRefUpload, file.DataCid)
+            // Entries of directories may only be referenced by their directories
+            ownRef := err == nil
+            if !ownRef {
+                contentKey, err = dbGetEntryContentRef(nil, node.ID().String(), file.DataCid)
+            }
+            if err == nil {
+                filePath = contentPath(contentKey)
+            }
+
             // Check whether file exists
-            absPath, err := filepath.Abs(fileShareUploadsDirectory + "/" + file.Name)
+            absPath, err := filepath.Abs(filePath)
             if err != nil {
                 continue // This case shouldn't happen
             }
@@ -237,13 +387,34 @@ func FileShareNodeCreate(node host.Host, kadDHT *dht.IpfsDHT, walletAddress stri
             if err != nil {
                 // Can't open file, remove from database
                 dbRemoveUpload(nil, node.ID().String(), file.DataCid)
+                dbRemoveContentRef(nil, node.ID().String(), fileShareRefUpload, file.DataCid)
                 continue
             }
             f.Close()
 
-            fsNode.PutFile(context.Background(), fileShareUploadsDirectory + "/" + file.Name, file.Price)
+            // Keep serving files under the CID scheme they were originally shared with
+            details := loadFileDetails(node.ID().String(), file)
+            _, err = fsNode.putFile(context.Background(), filePath, file.Name, file.Price, dataCid, details, false)
+            if err == cidMismatch {
+                log.Printf("File %v no longer matches %v, withdrawing it\n", file.Name, file.DataCid)
+                fsNode.withdrawUpload(dataCid)
+                continue
+            }
+            if err == nil && contentKey == "" {
+                migratedFiles = append(migratedFiles, filePath)
+            }
+            if err == nil && contentKey != "" && !ownRef {
+                dbRemoveContentRef(nil, node.ID().String(), fileShareRefUpload, file.DataCid)
+            }
+        }
+        for _, filePath := range migratedFiles {
+            os.Remove(filePath)
         }
     }
+    fsNode.loadPartialDownloads()
+
+    fsNode.ctx, fsNode.stop = context.WithCancel(context.Background())
+    go fsNode.runReprovider(fsNode.ctx)
 
     return fsNode
 }
@@ -251,6 +422,8 @@ func FileShareNodeCreate(node host.Host, kadDHT *dht.IpfsDHT, walletAddress stri
 func (f *FileShareNode) fileShareStreamHandler(s network.Stream) {
     stream := p2pWrapStream(&s)
     defer stream.Close()
+    //Data is sent uncompressed unless the requester asks otherwise
+    encoding := fileShareEncodingIdentity
     for {
         req, err := stream.ReadString('\n', fileShareIdleTimeout)
         if err != nil {
@@ -264,12 +437,62 @@ func (f *FileShareNode) fileShareStreamHandler(s network.Stream) {
                     return
                 }
             case "WANT META\n":
-                err = f.handleWantMeta(context.Background(), stream)
+                err = f.handleWantMeta(stream, false)
+                if err != nil {
+                    return
+                }
+            case "WANT META VERSIONED\n":
+                err = f.handleWantMeta(stream, true)
+                if err != nil {
+                    return
+                }
+            case "WANT SIGNED META\n":
+                err = f.handleWantSignedMeta(stream)
+                if err != nil {
+                    return
+                }
+            case "DISCOVER PAGE\n":
+                err = f.handleDiscoverPage(stream)
+                if err != nil {
+                    return
+                }
+            case "CATALOG\n":
+                err = f.handleCatalog(stream)
+                if err != nil {
+                    return
+                }
+            case "SEARCH\n":
+                err = f.handleSearch(stream)
+                if err != nil {
+                    return
+                }
+            case "ACCEPT ENCODING\n":
+                encoding, err = f.handleAcceptEncoding(stream)
                 if err != nil {
                     return
                 }
             case "WANT DATA\n":
-                err = f.handleWantData(context.Background(), stream)
+                err = f.handleWantData(context.Background(), stream, encoding)
+                if err != nil {
+                    return
+                }
+            case "WANT RANGE\n":
+                err = f.handleWantRange(context.Background(), stream, encoding)
+                if err != nil {
+                    return
+                }
+            case "WANT ENCRYPTED\n":
+                err = f.handleWantEncrypted(stream, encoding)
+                if err != nil {
+                    return
+                }
+            case "WANT KEY\n":
+                err = f.handleWantKey(stream)
+                if err != nil {
+                    return
+                }
+            case "WANT BLOCK\n":
+                err = f.handleWantBlock(stream)
                 if err != nil {
                     return
                 }
@@ -283,11 +506,21 @@ func (f *FileShareNode) fileShareStreamHandler(s network.Stream) {
                 if err != nil {
                     return
                 }
+            case "CANCEL\n":
+                err = f.handleCancel(stream)
+                if err != nil {
+                    return
+                }
             case "DISCOVER\n":
                 err = f.handleDiscover(stream)
                 if err != nil {
                     return
                 }
+            case "PAY\n":
+                err = f.handlePay(stream)
+                if err != nil {
+                    return
+                }
             case "WANT WALLET\n":
                 err = f.handleWantWallet(stream)
                 if err != nil {
@@ -322,10 +555,16 @@ func (f *FileShareNode) handleWantHave(ctx context.Context, stream *P2PStream) e
         if err != nil {
             return err
         }
-        //Query local fstore for cid
+        //Query local fstore for cid, directories only have their manifest in the block store
         f.fstoreLock.Lock()
         _, ok := f.fstore[cid]
         f.fstoreLock.Unlock()
+        ok = ok && f.checkSource(cid)
+        if !ok {
+            f.bstoreLock.Lock()
+            _, ok = f.bstore[cid]
+            f.bstoreLock.Unlock()
+        }
         if ok {
             haveCids = append(haveCids, cid)
         }
@@ -342,9 +581,22 @@ func (f *FileShareNode) handleWantHave(ctx context.Context, stream *P2PStream) e
     return err
 }
 
-//Request:  "WANT META\n<cid>\n"
+//Request:  "WANT DATA\n<remote_session_id>\n<cid>\n"
 //Response: "HERE\n<size>\n<byte1><byte2>..."
-func (f *FileShareNode) handleWantMeta(ctx context.Context, stream *P2PStream) error {
+//          "BUSY\n<retry_after_seconds>\n" if we are already serving as many sessions as allowed
+//          "PAYMENT REQUIRED\n<price>\n<wallet_address>\n" if the requester hasn't paid for the file
+func (f *FileShareNode) handleWantData(ctx context.Context, stream *P2PStream, encoding string) error {
+    remoteSessionIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+
+    //Get remote session ID
+    remoteSessionID, err := strconv.Atoi(remoteSessionIDStr[:len(remoteSessionIDStr) - 1])
+    if err != nil {
+        return err
+    }
+
     //Get requested CID
     cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
     if err != nil {
@@ -355,40 +607,53 @@ func (f *FileShareNode) handleWantMeta(ctx context.Context, stream *P2PStream) e
         return err
     }
 
-    //Look for metadata in meta data store
-    f.mstoreLock.Lock()
-    fileMetadata, ok := f.mstore[cid]
-    f.mstoreLock.Unlock()
-    //This is request for metadata given data cid
+    //Query local fstore for CID
+    f.fstoreLock.Lock()
+    contentKey, ok := f.fstore[cid]
+    f.fstoreLock.Unlock()
+    ok = ok && f.checkSource(cid)
     if ok {
-        rawData, err := fileMetadata.Marshal()
+        if !f.hasPaid(stream.RemotePeerID, cid) {
+            return f.sendPaymentRequired(stream, cid)
+        }
+        rSession, err := f.RemoteSessionCreate(stream.RemotePeerID, remoteSessionID)
         if err != nil {
-            log.Printf("Failed to marshal file metadata. %v \n", err)
-            return err
+            return sendBusy(stream)
+        }
+        defer f.RemoteSessionCleanup(rSession)
+        dataChannel, size, err := readFile(contentPath(contentKey), rSession.stop)
+        if err != nil {
+            goto Failed
         }
-        err = stream.SendString(fmt.Sprintf("HERE\n%d\n", len(rawData)))
+
+        err = stream.SendString(fmt.Sprintf("HERE\n%d\n", size))
         if err != nil {
             return err
         }
-        err = stream.Send(rawData)
+        return f.serveData(stream, rSession, cid, 0, true, dataChannel, encoding)
+    } else {
         if err != nil {
             return err
+        } else {
+            goto Failed
         }
-        return nil
     }
+
+Failed:
     stream.SendString("DON'T HAVE\n")
     return nil
 }
 
-//Request:  "WANT DATA\n<remote_session_id>\n<cid>\n"
-//Response: "HERE\n<size>\n<byte1><byte2>..."
-func (f *FileShareNode) handleWantData(ctx context.Context, stream *P2PStream) error {
+//Request:  "WANT RANGE\n<remote_session_id>\n<cid>\n<offset>\n<length>\n"
+//Response: "HERE\n<length>\n<byte1><byte2>..."
+//          "BUSY\n<retry_after_seconds>\n" if we are already serving as many sessions as allowed
+//          "PAYMENT REQUIRED\n<price>\n<wallet_address>\n" if the requester hasn't paid for the file
+//The returned length is clamped to the end of the file
+func (f *FileShareNode) handleWantRange(ctx context.Context, stream *P2PStream, encoding string) error {
     remoteSessionIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
     if err != nil {
         return err
     }
-
-    //Get remote session ID
     remoteSessionID, err := strconv.Atoi(remoteSessionIDStr[:len(remoteSessionIDStr) - 1])
     if err != nil {
         return err
@@ -404,52 +669,118 @@ func (f *FileShareNode) handleWantData(ctx context.Context, stream *P2PStream) e
         return err
     }
 
+    //Get requested range
+    offsetStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    offset, err := strconv.ParseInt(offsetStr[:len(offsetStr) - 1], 10, 64)
+    if err != nil {
+        return err
+    }
+    lengthStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    length, err := strconv.ParseInt(lengthStr[:len(lengthStr) - 1], 10, 64)
+    if err != nil {
+        return err
+    }
+
     //Query local fstore for CID
     f.fstoreLock.Lock()
-    fileName, ok := f.fstore[cid]
+    contentKey, ok := f.fstore[cid]
     f.fstoreLock.Unlock()
-    if ok {
-        dataChannel, size, err := readFile(fileShareUploadsDirectory + "/" + fileName)
-        if err != nil {
-            goto Failed
-        }
-        rSession := f.RemoteSessionCreate(stream.RemotePeerID, remoteSessionID)
-        defer f.RemoteSessionCleanup(rSession)
+    ok = ok && f.checkSource(cid)
+    if !ok {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    if !f.hasPaid(stream.RemotePeerID, cid) {
+        return f.sendPaymentRequired(stream, cid)
+    }
+    rSession, err := f.RemoteSessionCreate(stream.RemotePeerID, remoteSessionID)
+    if err != nil {
+        return sendBusy(stream)
+    }
+    defer f.RemoteSessionCleanup(rSession)
+    dataChannel, length, err := readFileRange(contentPath(contentKey), offset, length, rSession.stop)
+    if err != nil {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    err = stream.SendString(fmt.Sprintf("HERE\n%d\n", length))
+    if err != nil {
+        return err
+    }
+    return f.serveData(stream, rSession, cid, offset, true, dataChannel, encoding)
+}
 
-        err = stream.SendString(fmt.Sprintf("HERE\n%d\n", size))
-        if err != nil {
-            return err
-        }
-        //Send the data chunk by chunk
-        for buf := range dataChannel {
-            if buf.err != nil {
-                return buf.err
-            }
-            //If paused, wait till resumed
-            rSession.Wait()
+//Tells the requester to try again later or go to another provider
+func sendBusy(stream *P2PStream) error {
+    return stream.SendString(fmt.Sprintf("BUSY\n%d\n", int(fileShareBusyRetryAfter.Seconds())))
+}
 
-            err = stream.Send(buf.data)
-            if err != nil {
-                return err
-            }
-            rSession.txBytesLock.Lock()
-            rSession.txBytes += int64(len(buf.data))
-            rSession.txBytesLock.Unlock()
+//Sends the data chunk by chunk to the requester of a remote session, within the upload limits
+//Stops as soon as the requester cancels the session
+//The data starts at offset in the file. What was sent is recorded in the upload stats of the CID, and if
+//countable is set, as a complete transfer once the session was sent the whole file over all its requests
+func (f *FileShareNode) serveData(stream *P2PStream, rSession *FileShareRemoteSession, c cid.Cid, offset int64, countable bool,
+                                  dataChannel chan DataBuffer, encoding string) (err error) {
+    sentBytes := int64(0)
+    defer func() {
+        complete := countable && f.markServed(rSession, c, offset, sentBytes, err == nil)
+        f.recordUpload(stream.RemotePeerID, c, sentBytes, complete)
+    }()
+    for buf := range dataChannel {
+        if buf.err != nil {
+            return buf.err
         }
-    } else {
+        //If paused, wait till resumed
+        rSession.Wait()
+        if rSession.IsCancelled() {
+            log.Printf("Session %d of %v was cancelled\n", rSession.remoteSessionID, rSession.remotePeerID)
+            return remoteSessionCancelled
+        }
+        //Limits apply to what is sent on the wire, so compressed data is throttled less
+        wireData := encodeChunk(encoding, buf.data)
+        f.throttleUpload(stream.RemotePeerID, len(wireData))
+        err = stream.Send(wireData)
         if err != nil {
             return err
-        } else {
-            goto Failed
         }
+        rSession.txBytesLock.Lock()
+        rSession.txBytes += int64(len(buf.data))
+        rSession.txBytesLock.Unlock()
+        sentBytes += int64(len(buf.data))
     }
-
-    return nil
-Failed:
-    stream.SendString("DON'T HAVE\n")
     return nil
 }
 
+//Request:  "WANT BLOCK\n<cid>\n"
+//Response: "HERE\n<size>\n<byte1><byte2>..."
+func (f *FileShareNode) handleWantBlock(stream *P2PStream) error {
+    cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    cid, err := cid.Decode(cidStr[:len(cidStr) - 1])
+    if err != nil {
+        return err
+    }
+
+    //Look for DAG node in block store
+    f.bstoreLock.Lock()
+    block, ok := f.bstore[cid]
+    f.bstoreLock.Unlock()
+    if !ok {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    err = stream.SendString(fmt.Sprintf("HERE\n%d\n", len(block)))
+    if err != nil {
+        return err
+    }
+    return stream.Send(block)
+}
+
 //Request: "RESUME\n<remote_session_id>\n"
 func (f *FileShareNode) handleResume(stream *P2PStream) error {
     remoteSessionIDStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
@@ -464,15 +795,11 @@ func (f *FileShareNode) handleResume(stream *P2PStream) error {
 
     //Query for remote session
     f.rSessionStoreLock.Lock()
-    _, ok := f.rSessionStore[stream.RemotePeerID]
-    if !ok {
-        return remoteSessionNotFound
-    }
     rSession, ok := f.rSessionStore[stream.RemotePeerID][remoteSessionID]
+    f.rSessionStoreLock.Unlock()
     if !ok {
         return remoteSessionNotFound
     }
-    f.rSessionStoreLock.Unlock()
 
     rSession.Resume()
     return nil
@@ -492,17 +819,37 @@ func (f *FileShareNode) handlePause(stream *P2PStream) error {
 
     //Query for remote session
     f.rSessionStoreLock.Lock()
-    _, ok := f.rSessionStore[stream.RemotePeerID]
+    rSession, ok := f.rSessionStore[stream.RemotePeerID][remoteSessionID]
+    f.rSessionStoreLock.Unlock()
     if !ok {
         return remoteSessionNotFound
     }
+
+    rSession.Pause()
+    return nil
+}
+
+//Request: "CANCEL\n<remote_session_id>\n"
+func (f *FileShareNode) handleCancel(stream *P2PStream) error {
+    remoteSessionIDStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    //Get remote session ID
+    remoteSessionID, err := strconv.Atoi(remoteSessionIDStr[:len(remoteSessionIDStr) - 1])
+    if err != nil {
+        return err
+    }
+
+    //Query for remote session
+    f.rSessionStoreLock.Lock()
     rSession, ok := f.rSessionStore[stream.RemotePeerID][remoteSessionID]
+    f.rSessionStoreLock.Unlock()
     if !ok {
         return remoteSessionNotFound
     }
-    f.rSessionStoreLock.Unlock()
 
-    rSession.Pause()
+    rSession.Cancel()
     return nil
 }
 
@@ -562,27 +909,40 @@ func (f *FileShareNode) handleWantWallet(stream *P2PStream) error {
 
 
 
-func (f *FileShareNode) SessionCreate(ctx context.Context, reqCidStr string) *FileShareSession {
+func (f *FileShareNode) SessionCreate(ctx context.Context, reqCidStr string, sessionType string) *FileShareSession {
     nextSessionIDLock.Lock()
     sessionID := nextSessionID
     nextSessionID++
     nextSessionIDLock.Unlock()
 
+    //Cancelling the session aborts anything still waiting on its context
+    sessionContext, cancelContext := context.WithCancel(ctx)
     fileShareSession := &FileShareSession {
         SessionID: sessionID,
         node: f,
         streamMap: make(map[peer.ID]*P2PStream),
         streamLock: sync.Mutex{},
-        sessionContext: ctx,
+        sessionContext: sessionContext,
+        cancelContext: cancelContext,
         Pausable: *NewPausable(),
         statsLock: sync.Mutex{},
+        retryAfter: make(map[peer.ID]time.Duration),
+        providerSamples: make(map[peer.ID]*fileShareProviderSample),
+        encodings: make(map[*P2PStream]string),
+        legacyPeers: make(map[peer.ID]bool),
+        legacyMetaPeers: make(map[peer.ID]bool),
+        unsignedMetaPeers: make(map[peer.ID]bool),
+        paidPeers: make(map[peer.ID]bool),
         reqLocks: make(map[peer.ID]*sync.Mutex),
         reqLocksLock: sync.Mutex{},
         ReqCid: reqCidStr,
         RxBytes: int64(0),
         Complete: false,
         Result: 0,
+        Type: sessionType,
+        startTime: time.Now(),
     }
+    fileShareSession.StartTime = fileShareSession.startTime.UTC().Format(time.RFC3339)
 
     f.sessionStoreLock.Lock()
     f.sessionStore[sessionID] = fileShareSession
@@ -593,10 +953,22 @@ func (f *FileShareNode) SessionCreate(ctx context.Context, reqCidStr string) *Fi
 
 func (f *FileShareNode) SessionCleanup(session *FileShareSession, result int) {
     session.statsLock.Lock()
+    alreadyComplete := session.Complete
     session.Complete = true
+    //A cancelled session fails because its streams were closed under it
+    if session.cancelled && result != 0 {
+        result = fileShareResultCancelled
+    }
     session.Result = result
+    if !alreadyComplete {
+        session.EndTime = time.Now().UTC().Format(time.RFC3339)
+    }
     session.statsLock.Unlock()
 
+    if !alreadyComplete {
+        f.finishSession(session)
+    }
+
     session.streamLock.Lock()
     for peerID, stream := range session.streamMap {
         reqLock := session.GetRequestLock(peerID)
@@ -609,32 +981,74 @@ func (f *FileShareNode) SessionCleanup(session *FileShareSession, result int) {
     session.streamLock.Unlock()
 }
 
-func (f *FileShareNode) RemoteSessionCreate(remotePeerID peer.ID, remoteSessionID int) *FileShareRemoteSession {
+//Returns providerBusy if the session is new and we are already serving as many sessions as allowed
+//Every call must be paired with a call to RemoteSessionCleanup
+func (f *FileShareNode) RemoteSessionCreate(remotePeerID peer.ID, remoteSessionID int) (*FileShareRemoteSession, error) {
     //If a remote session already exists, use it
     f.rSessionStoreLock.Lock()
-    _, ok := f.rSessionStore[remotePeerID]
-    if !ok {
-        f.rSessionStore[remotePeerID] = make(map[int]*FileShareRemoteSession)
-    }
     rSession, ok := f.rSessionStore[remotePeerID][remoteSessionID]
     if !ok {
+        f.limitsLock.Lock()
+        maxSessions := f.uploadLimits.MaxSessions
+        f.limitsLock.Unlock()
+        if maxSessions > 0 && f.remoteSessionCount() >= maxSessions {
+            f.rSessionStoreLock.Unlock()
+            log.Printf("Turning away %v, already serving %d sessions\n", remotePeerID, maxSessions)
+            return nil, providerBusy
+        }
+        _, ok = f.rSessionStore[remotePeerID]
+        if !ok {
+            f.rSessionStore[remotePeerID] = make(map[int]*FileShareRemoteSession)
+        }
         rSession = &FileShareRemoteSession{
             remoteSessionID: remoteSessionID,
             remotePeerID: remotePeerID,
             Pausable: *NewPausable(),
             txBytesLock: sync.Mutex{},
             txBytes: int64(0),
+            stop: make(chan struct{}),
+            stopOnce: sync.Once{},
         }
         f.rSessionStore[remotePeerID][remoteSessionID] = rSession
     }
+    rSession.refs ++
     f.rSessionStoreLock.Unlock()
-    return rSession
+    return rSession, nil
+}
+
+func (r *FileShareRemoteSession) Cancel() {
+    r.stopOnce.Do(func() {
+        close(r.stop)
+    })
+    //Don't leave the sender waiting on a pause
+    r.Resume()
+}
+
+func (r *FileShareRemoteSession) IsCancelled() bool {
+    select {
+        case <- r.stop:
+            return true
+        default:
+            return false
+    }
 }
 
+//The session is only removed once the last request using it is done
 func (f *FileShareNode) RemoteSessionCleanup(remoteSession *FileShareRemoteSession) {
     f.rSessionStoreLock.Lock()
     defer f.rSessionStoreLock.Unlock()
+    remoteSession.refs --
+    if remoteSession.refs > 0 {
+        return
+    }
     delete(f.rSessionStore[remoteSession.remotePeerID], remoteSession.remoteSessionID)
+    //Forget about peers we are no longer serving
+    if len(f.rSessionStore[remoteSession.remotePeerID]) == 0 {
+        delete(f.rSessionStore, remoteSession.remotePeerID)
+        f.limitsLock.Lock()
+        delete(f.peerLimiters, remoteSession.remotePeerID)
+        f.limitsLock.Unlock()
+    }
 }
 
 func (f *FileShareNode) GetSession(sessionID int) (*FileShareSession, error) {
@@ -676,6 +1090,28 @@ func (f *FileShareNode) ResumeSession(sessionID int) error {
     return nil
 }
 
+//Stops a download for good. The provider stops sending and what was downloaded so far is deleted.
+func (f *FileShareNode) CancelSession(sessionID int) error {
+    f.sessionStoreLock.Lock()
+    session, ok := f.sessionStore[sessionID]
+    f.sessionStoreLock.Unlock()
+    if !ok {
+        return sessionNotFound
+    }
+
+    session.statsLock.Lock()
+    if session.Complete {
+        session.statsLock.Unlock()
+        return sessionAlreadyComplete
+    }
+    session.cancelled = true
+    session.statsLock.Unlock()
+
+    f.queue.cancel(session)
+    session.CancelSession()
+    return nil
+}
+
 func (f *FileShareNode) HasFile(fileCid cid.Cid) bool {
     f.fstoreLock.Lock()
     _, ok := f.fstore[fileCid]
@@ -830,13 +1266,13 @@ func (s *FileShareSession) SendWantHave(peerID peer.ID, cids []cid.Cid) []cid.Ci
     return nil
 }
 
-func (s *FileShareSession) SendWantMeta(peerID peer.ID, c cid.Cid) []byte {
+func (s *FileShareSession) SendWantBlock(peerID peer.ID, c cid.Cid) []byte {
     reqLock := s.GetRequestLock(peerID)
     reqLock.Lock()
     defer reqLock.Unlock()
 
-    //Send WANT request
-    err := s.sendString(peerID, fmt.Sprintf("WANT META\n%s\n", c.String()))
+    //Send WANT BLOCK request
+    err := s.sendString(peerID, fmt.Sprintf("WANT BLOCK\n%s\n", c.String()))
     if err != nil {
         return nil
     }
@@ -854,7 +1290,7 @@ func (s *FileShareSession) SendWantMeta(peerID peer.ID, c cid.Cid) []byte {
             return nil
         }
         size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
-        if err != nil {
+        if err != nil || size <= 0 || size > fileShareMaxDagNodeSize {
             return nil
         }
         data, err := s.read(peerID, size, fileShareWantHaveTimeout)
@@ -867,10 +1303,94 @@ func (s *FileShareSession) SendWantMeta(peerID peer.ID, c cid.Cid) []byte {
     return nil
 }
 
+//Gets the encoded DAG node of a CID from our own block store or from the provider
+//Returns nil for legacy CIDs which have no DAG
+func (s *FileShareSession) GetNode(peerID peer.ID, c cid.Cid) ([]byte, error) {
+    if isLegacyCid(c) {
+        return nil, nil
+    }
+    s.node.bstoreLock.Lock()
+    bytes, ok := s.node.bstore[c]
+    s.node.bstoreLock.Unlock()
+    if !ok {
+        bytes = s.SendWantBlock(peerID, c)
+        if bytes == nil {
+            return nil, contentNotFound
+        }
+        if !verifyDagNode(c, bytes) {
+            log.Printf("DAG node from %v does not match cid %v\n", peerID, c)
+            return nil, integrityError
+        }
+    }
+    return bytes, nil
+}
+
+//Gets the DAG node of a file from our own block store or from the provider
+//Returns nil for legacy CIDs which have no DAG
+func (s *FileShareSession) GetDag(peerID peer.ID, c cid.Cid) (*FileShareDag, error) {
+    bytes, err := s.GetNode(peerID, c)
+    if bytes == nil {
+        return nil, err
+    }
+    dag := &FileShareDag{}
+    err = dag.Unmarshal(bytes)
+    if err != nil {
+        log.Printf("Failed to unmarshal DAG node. %v\n", err)
+        return nil, err
+    }
+    return dag, nil
+}
+
+//Re-requests a single block of a file that failed verification
+//A separate stream is used since the session's stream is busy with the rest of the transfer
+func (s *FileShareSession) RepairBlock(peerID peer.ID, c cid.Cid, dag *FileShareDag, index int) ([]byte, error) {
+    offset, length := dag.BlockRange(index)
+    for attempt := 0; attempt < fileShareMaxBlockRetries; attempt ++ {
+        log.Printf("Re-requesting block %d of %v from %v\n", index, c, peerID)
+        timeoutCtx, cancel := context.WithTimeout(s.sessionContext, fileShareOpenStreamTimeout)
+        stream, err := p2pOpenStream(timeoutCtx, fileShareProtocol, s.node.host, s.node.kadDHT, peerID.String())
+        cancel()
+        if err != nil {
+            continue
+        }
+        var data []byte
+        var resp string
+        var sizeStr string
+        err = stream.SendString(fmt.Sprintf("WANT RANGE\n%d\n%s\n%d\n%d\n", s.SessionID, c.String(), offset, length))
+        if err != nil {
+            goto next
+        }
+        resp, err = stream.ReadString('\n', fileShareWantTimeout)
+        if err != nil || resp != "HERE\n" {
+            goto next
+        }
+        sizeStr, err = stream.ReadString('\n', fileShareWantHaveTimeout)
+        if err != nil || sizeStr != fmt.Sprintf("%d\n", length) {
+            goto next
+        }
+        data, err = stream.Read(int(length), fileShareWantHaveTimeout)
+        if err == nil && dag.VerifyBlock(index, data) {
+            stream.SendString("CLOSE\n")
+            stream.Close()
+            return data, nil
+        }
+next:
+        stream.Close()
+    }
+    return nil, integrityError
+}
+
 func (s *FileShareSession) SendWantData(peerID peer.ID, c cid.Cid) chan DataBuffer {
     reqLock := s.GetRequestLock(peerID)
     reqLock.Lock()
     defer reqLock.Unlock()
+    encoding := s.negotiateEncoding(peerID)
+    if s.SendPay(peerID) != nil {
+        return nil
+    }
+    //Providers that never answer count against their reputation too
+    s.trackProvider(peerID)
+    requested := time.Now()
     //Send WANT DATA request
     err := s.sendString(peerID, fmt.Sprintf("WANT DATA\n%d\n%s\n", s.SessionID, c.String()))
     if err != nil {
@@ -882,7 +1402,25 @@ func (s *FileShareSession) SendWantData(peerID peer.ID, c cid.Cid) chan DataBuff
     if err != nil {
         return nil
     }
+    s.recordLatency(peerID, requested)
 
+    //Provider is serving too many sessions, response of the form BUSY\n<retry_after_seconds>\n
+    if resp == "BUSY\n" {
+        retryAfterStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err != nil {
+            return nil
+        }
+        retryAfter, err := strconv.Atoi(retryAfterStr[:len(retryAfterStr) - 1])
+        if err != nil {
+            return nil
+        }
+        s.setRetryAfter(peerID, time.Duration(retryAfter) * time.Second)
+        return nil
+    }
+    if resp == "PAYMENT REQUIRED\n" {
+        s.readPaymentRequired(peerID)
+        return nil
+    }
     //Response of the form HERE\n<size>\n<byte><byte>...
     if resp == "HERE\n" {
         sizeStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
@@ -895,32 +1433,69 @@ func (s *FileShareSession) SendWantData(peerID peer.ID, c cid.Cid) chan DataBuff
         }
         s.statsLock.Lock()
         s.TotalBytes = int64(size)
+        delete(s.retryAfter, peerID)
+        s.providerSample(peerID).startTransfer()
         s.statsLock.Unlock()
-        dataChannel := make(chan DataBuffer)
-        var chunkData []byte
-        go func() {
-            for byteOffset := 0; byteOffset < size; byteOffset += chunkSize {
-                //If paused wait till resumed
-                s.Wait()
-
-                if (size - byteOffset) < chunkSize {
-                    chunkData, err = s.read(peerID, size - byteOffset, fileShareWantHaveTimeout)
-                } else {
-                    chunkData, err = s.read(peerID, chunkSize, fileShareWantHaveTimeout)
-                }
-                if err != nil {
-                    dataChannel <- DataBuffer{ nil, err }
-                    close(dataChannel)
-                    return
-                }
-                dataChannel <- DataBuffer{ chunkData, nil }
-                s.statsLock.Lock()
-                s.RxBytes+= int64(len(chunkData))
-                s.statsLock.Unlock()
-            }
-            close(dataChannel)
-        }()
-        return dataChannel
+        return s.receiveData(peerID, int64(size), encoding)
+    }
+    return nil
+}
+
+func (s *FileShareSession) SendWantRange(peerID peer.ID, c cid.Cid, offset int64, length int64) chan DataBuffer {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+    encoding := s.negotiateEncoding(peerID)
+    if s.SendPay(peerID) != nil {
+        return nil
+    }
+    s.trackProvider(peerID)
+    requested := time.Now()
+    //Send WANT RANGE request
+    err := s.sendString(peerID, fmt.Sprintf("WANT RANGE\n%d\n%s\n%d\n%d\n", s.SessionID, c.String(), offset, length))
+    if err != nil {
+        return nil
+    }
+
+    //Wait for response
+    resp, err := s.readString(peerID, '\n', fileShareWantTimeout)
+    if err != nil {
+        return nil
+    }
+    s.recordLatency(peerID, requested)
+
+    //Provider is serving too many sessions, response of the form BUSY\n<retry_after_seconds>\n
+    if resp == "BUSY\n" {
+        retryAfterStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err != nil {
+            return nil
+        }
+        retryAfter, err := strconv.Atoi(retryAfterStr[:len(retryAfterStr) - 1])
+        if err != nil {
+            return nil
+        }
+        s.setRetryAfter(peerID, time.Duration(retryAfter) * time.Second)
+        return nil
+    }
+    if resp == "PAYMENT REQUIRED\n" {
+        s.readPaymentRequired(peerID)
+        return nil
+    }
+    //Response of the form HERE\n<length>\n<byte><byte>...
+    if resp == "HERE\n" {
+        sizeStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+        if err != nil {
+            return nil
+        }
+        size, err := strconv.ParseInt(sizeStr[:len(sizeStr) - 1], 10, 64)
+        if err != nil {
+            return nil
+        }
+        s.statsLock.Lock()
+        delete(s.retryAfter, peerID)
+        s.providerSample(peerID).startTransfer()
+        s.statsLock.Unlock()
+        return s.receiveData(peerID, size, encoding)
     }
     return nil
 }
@@ -965,6 +1540,36 @@ func (s *FileShareSession) ResumeSession() error {
     return nil
 }
 
+//Tells providers to stop sending and closes our streams so nothing more is read
+//Streams are closed without taking their request locks since requests may be blocked on them
+func (s *FileShareSession) CancelSession() {
+    s.cancelContext()
+    s.streamLock.Lock()
+    streams := s.streamMap
+    s.streamMap = make(map[peer.ID]*P2PStream)
+    s.streamLock.Unlock()
+
+    for peerID, dataStream := range streams {
+        timeoutCtx, cancel := context.WithTimeout(context.Background(), fileShareOpenStreamTimeout)
+        stream, err := p2pOpenStream(timeoutCtx, fileShareProtocol, s.node.host, s.node.kadDHT, peerID.String())
+        cancel()
+        if err == nil {
+            stream.SendString(fmt.Sprintf("CANCEL\n%d\n", s.SessionID))
+            stream.SendString("CLOSE\n")
+            stream.Close()
+        }
+        dataStream.Close()
+    }
+    //Let anything waiting for the session to be resumed see that it is gone
+    s.Resume()
+}
+
+func (s *FileShareSession) isCancelled() bool {
+    s.statsLock.Lock()
+    defer s.statsLock.Unlock()
+    return s.cancelled
+}
+
 func (s *FileShareSession) SendDiscover(peerID peer.ID, maxCount int) []cid.Cid {
     reqLock := s.GetRequestLock(peerID)
     reqLock.Lock()
@@ -1036,18 +1641,59 @@ func (s *FileShareSession) SendWantWallet(peerID peer.ID) string {
     return ""
 }
 
-func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCidStr string, outputFile string) (int, error) {
+//If providerIDStr is "auto" the provider is picked by policy, see getFile
+func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCidStr string, outputFile string, priority int,
+                                txID string, policy string, seed FileShareSeedSettings) (int, error) {
+    return f.getFile(ctx, providerIDStr, reqCidStr, outputFile, nil, priority, txID, policy, seed)
+}
+
+//Downloads a file from a single provider. If partial is set, continues the download from where it stopped.
+//The transfer is queued behind other downloads and starts once fewer than the maximum number are active.
+//Paid files need the ID of a transaction paying the provider, unless the provider already accepted one from us.
+//If providerIDStr is "auto", the providers that confirm they have the file for free are ordered by policy and
+//the download falls back to the next one whenever a provider fails before the transfer completes.
+//If seed is enabled, the file is shared at the seed price once it is downloaded and verified.
+func (f *FileShareNode) getFile(ctx context.Context, providerIDStr string, reqCidStr string, outputFile string, partial *FileSharePartialDownload,
+                                priority int, txID string, policy string, seed FileShareSeedSettings) (int, error) {
+    resuming := partial != nil
+    //Release a resumed download if we fail before the transfer starts
+    deferRelease := resuming
+    defer func() {
+        if deferRelease {
+            f.releasePartialDownload(partial, true)
+        }
+    }()
+
     reqCid, err := cid.Decode(reqCidStr)
     if err != nil {
         log.Printf("Failed to decode cid %v. %v", reqCidStr, err)
         return -1, invalidParams
     }
 
-    providerID, err := peer.Decode(providerIDStr)
-    if err != nil {
-        log.Printf("Failed to decode provider ID string '%v'. %v\n", providerIDStr, err)
+    if seed.Price < 0 {
         return -1, invalidParams
     }
+    auto := providerIDStr == fileShareAutoProvider
+    var providerID peer.ID
+    if auto {
+        if policy == "" {
+            policy = fileShareSelectReputation
+        }
+        if !validSelectPolicy(policy) || resuming {
+            return -1, invalidParams
+        }
+        //A transaction only pays the provider it was made out to, which we haven't picked yet
+        if txID != "" {
+            log.Printf("Transactions can't be given when the provider is picked automatically\n")
+            return -1, invalidParams
+        }
+    } else {
+        providerID, err = peer.Decode(providerIDStr)
+        if err != nil {
+            log.Printf("Failed to decode provider ID string '%v'. %v\n", providerIDStr, err)
+            return -1, invalidParams
+        }
+    }
 
     tmpOutputFile, err := filepath.Abs(outputFile + ".tmp")
     if err != nil {
@@ -1059,22 +1705,33 @@ func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCi
         log.Printf("Failed to resolve filepath. %v\n", outputFile)
         return -1, invalidParams
     }
-    // Ensure download directory exists
-    dir := filepath.Dir(tmpOutputFile)
-    os.MkdirAll(dir, 0751)
 
-    //Open temporary file
-    file, err := os.Create(tmpOutputFile)
-    if err != nil {
-        log.Printf("Error opening file: %v. %v\n", tmpOutputFile, err)
-        return -1, failedToOpenFile
-    }
+    var file *os.File
     deferCleanup := true
     //Create a fileshare session
-    session := f.SessionCreate(ctx, reqCidStr)
+    session := f.SessionCreate(ctx, reqCidStr, fileShareSessionDownload)
+    //The session can already be seen by others once it is created
+    session.statsLock.Lock()
+    session.Priority = priority
+    session.txID = txID
+    session.statsLock.Unlock()
     defer func() {
         if deferCleanup {
-            file.Close()
+            //A cancelled resumed download is dropped rather than kept for later
+            if resuming && session.isCancelled() {
+                resuming = false
+                deferRelease = false
+                os.Remove(tmpOutputFile)
+            }
+            if file != nil {
+                file.Close()
+                if !resuming {
+                    os.Remove(tmpOutputFile)
+                }
+            }
+            if !resuming && partial != nil {
+                f.releasePartialDownload(partial, false)
+            }
             f.SessionCleanup(session, 1)
         }
     }()
@@ -1083,11 +1740,34 @@ func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCi
     var dataChannel chan DataBuffer
     var ok bool
     var size int64
+    var offset int64
+    var dag *FileShareDag
+    //Providers to fall back on in auto mode
+    var candidates []peer.ID
+    hash := sha256.New()
     fileMeta := FileShareMeta{}
     //Check local file store before asking peers
     f.fstoreLock.Lock()
-    _, local := f.fstore[reqCid]
+    contentKey, local := f.fstore[reqCid]
     f.fstoreLock.Unlock()
+    local = local && f.checkSource(reqCid)
+    if local && auto {
+        providerID = f.host.ID()
+        providerIDStr = providerID.String()
+    } else if auto {
+        candidates = session.selectProviders(ctx, reqCid, policy)
+        //Providers that fail before the transfer starts are skipped
+        for len(candidates) > 0 && !ok {
+            providerID = candidates[0]
+            candidates = candidates[1:]
+            fileMeta, ok = session.candidateMeta(providerID, reqCid)
+        }
+        if !ok {
+            log.Printf("No provider of %v is available\n", reqCid)
+            return -1, contentNotFound
+        }
+        providerIDStr = providerID.String()
+    }
     if local {
         f.mstoreLock.Lock()
         fileMeta, ok = f.mstore[reqCid]
@@ -1096,15 +1776,7 @@ func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCi
             log.Printf("Failed to find metadata for our own uploaded file")
             return -1, internalError
         }
-        dataChannel, size, err = readFile(fileShareUploadsDirectory + "/" + fileMeta.Name)
-        if err != nil {
-            log.Printf("Failed to get file.\n")
-            return -1, internalError
-        }
-        session.statsLock.Lock()
-        session.TotalBytes = size
-        session.statsLock.Unlock()
-    } else {
+    } else if !auto {
         bytes = session.SendWantMeta(providerID, reqCid)
         if bytes == nil {
             log.Printf("Failed to get file metadata.\n")
@@ -1115,59 +1787,256 @@ func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCi
             log.Printf("Failed to unmarshal file metadata.\n")
             return -1, internalError
         }
-        dataChannel = session.SendWantData(providerID, reqCid)
-        if dataChannel == nil {
-            log.Printf("Failed to get file.\n")
-            return -1, contentNotFound
+    }
+    //Get DAG node so blocks can be verified as they arrive
+    bytes, err = session.GetNode(providerID, reqCid)
+    if err != nil {
+        log.Printf("Failed to get DAG node.\n")
+        return -1, err
+    }
+    if bytes != nil {
+        //A manifest is downloaded as the directory tree it describes
+        manifest := &FileShareManifest{}
+        if manifest.Unmarshal(bytes) == nil {
+            if resuming {
+                return -1, invalidParams
+            }
+            deferCleanup = false
+            return f.getDirectory(session, providerID, reqCid, manifest, fileMeta, outputFile)
+        }
+        dag = &FileShareDag{}
+        err = dag.Unmarshal(bytes)
+        if err != nil {
+            log.Printf("Failed to unmarshal DAG node. %v\n", err)
+            return -1, err
+        }
+    }
+
+    // Ensure download directory exists
+    dir := filepath.Dir(tmpOutputFile)
+    os.MkdirAll(dir, 0751)
+
+    //Open temporary file, keeping what was already downloaded if resuming
+    if resuming {
+        file, err = os.OpenFile(tmpOutputFile, os.O_RDWR, 0644)
+    } else {
+        file, err = os.Create(tmpOutputFile)
+    }
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", tmpOutputFile, err)
+        return -1, failedToOpenFile
+    }
+
+    if resuming {
+        if partial.Size != fileMeta.Size || partial.rangeSize != fileShareRangeSize(dag) {
+            log.Printf("Provider's file no longer matches the partial download.\n")
+            return -1, unexpectedResponse
+        }
+        offset = partial.resumeOffset()
+        //Legacy CIDs hash the entire file, so the part we already have needs to be hashed again
+        if dag == nil {
+            _, err = io.CopyN(hash, file, offset)
+        } else {
+            _, err = file.Seek(offset, io.SeekStart)
+        }
+        if err != nil {
+            log.Printf("Failed to read partial download. %v\n", err)
+            return -1, internalError
+        }
+    } else {
+        partial = newPartialDownload(providerIDStr, reqCidStr, outputFile, fileMeta, fileShareRangeSize(dag))
+        err = f.addPartialDownload(partial)
+        if err != nil {
+            return -1, err
         }
     }
 
+    session.statsLock.Lock()
+    session.RxBytes = offset
+    session.resumedBytes = offset
+    session.TotalBytes = fileMeta.Size
+    session.statsLock.Unlock()
+
     deferCleanup = false
+    deferRelease = false
     go func() {
         sessionStatusCode := 0
-        bytesWritten := int64(0)
-        hash := sha256.New()
+        bytesWritten := offset
+        lastPersisted := offset
+        var block []byte
+        blockIndex := 0
+        if dag != nil {
+            blockIndex = dag.BlockIndex(offset)
+        }
         var dataCid cid.Cid
         var err error
         var mh multihash.Multihash
+        var downloadID int
+        //In auto mode a provider that fails is replaced by the next candidate, which continues from the last
+        //byte we verified
+        fallBack := func() bool {
+            if len(candidates) == 0 || session.isCancelled() {
+                return false
+            }
+            _, busy := session.RetryAfter(providerID)
+            if !busy {
+                session.setProviderResult(providerID, sessionStatusCode)
+            }
+            session.DeleteStream(providerID)
+            //The next candidate must still serve the same file for free
+            var nextMeta FileShareMeta
+            nextOk := false
+            for len(candidates) > 0 && !nextOk {
+                nextID := candidates[0]
+                candidates = candidates[1:]
+                nextMeta, nextOk = session.candidateMeta(nextID, reqCid)
+                nextOk = nextOk && nextMeta.Size == fileMeta.Size
+                if nextOk {
+                    log.Printf("Provider %v failed, falling back to %v\n", providerID, nextID)
+                    providerID = nextID
+                }
+            }
+            if !nextOk {
+                return false
+            }
+            providerIDStr = providerID.String()
+            fileMeta.Price = nextMeta.Price
+            //An interrupted download resumes from the provider it was last using
+            partial.ProviderID = providerIDStr
+            partial.Price = nextMeta.Price
+            f.savePartialDownloadProvider(partial)
+            sessionStatusCode = 0
+            block = nil
+            session.statsLock.Lock()
+            session.RxBytes = bytesWritten
+            session.statsLock.Unlock()
+            return true
+        }
+
+        //Wait for our turn before asking for any data
+        if !f.queue.wait(session) {
+            file.Close()
+            sessionStatusCode = fileShareResultCancelled
+            goto Failed
+        }
+        defer f.queue.done()
+Request:
+        if local {
+            dataChannel, size, err = readFileRange(contentPath(contentKey), offset, fileMeta.Size - offset, session.sessionContext.Done())
+            if err == nil {
+                session.statsLock.Lock()
+                session.TotalBytes = offset + size
+                session.statsLock.Unlock()
+            }
+        } else if bytesWritten == 0 {
+            dataChannel = session.SendWantData(providerID, reqCid)
+        } else {
+            dataChannel = session.SendWantRange(providerID, reqCid, bytesWritten, fileMeta.Size - bytesWritten)
+        }
+        if dataChannel == nil {
+            retryAfter, busy := session.RetryAfter(providerID)
+            if busy {
+                log.Printf("Provider %v is busy, retry after %v\n", providerID, retryAfter)
+            } else {
+                log.Printf("Failed to get file.\n")
+            }
+            sessionStatusCode = 1
+            if fallBack() {
+                goto Request
+            }
+            file.Close()
+            goto Failed
+        }
+
         for buf := range dataChannel {
-            if buf.err != nil {
-                file.Close()
-                sessionStatusCode = 1
-                goto Failed
+            //Drain the rest of the channel once the transfer has failed
+            if sessionStatusCode != 0 {
+                continue
             }
-            _, hashErr := hash.Write(buf.data)
-            if hashErr != nil {
-                log.Printf("Failed to write to hash. %v", hashErr)
+            if buf.err != nil {
                 sessionStatusCode = 1
-                file.Close()
-                goto Failed
+                continue
             }
-            _, fileErr := file.Write(buf.data)
-            if hashErr != nil {
-                log.Printf("Failed to write to file. %v", fileErr)
-                sessionStatusCode = 1
-                file.Close()
-                goto Failed
+            if dag == nil {
+                _, err = hash.Write(buf.data)
+                if err != nil {
+                    log.Printf("Failed to write to hash. %v", err)
+                    sessionStatusCode = 1
+                    continue
+                }
+                _, err = file.Write(buf.data)
+                if err != nil {
+                    log.Printf("Failed to write to file. %v", err)
+                    sessionStatusCode = 1
+                    continue
+                }
+                bytesWritten += int64(len(buf.data))
+            } else {
+                //Verify each block as soon as it is complete
+                block = append(block, buf.data...)
+                for blockIndex < len(dag.Links) {
+                    _, length := dag.BlockRange(blockIndex)
+                    if int64(len(block)) < length {
+                        break
+                    }
+                    data := block[:length]
+                    if !dag.VerifyBlock(blockIndex, data) {
+                        data, err = session.RepairBlock(providerID, reqCid, dag, blockIndex)
+                        if err != nil {
+                            log.Printf("Block %d failed verification.\n", blockIndex)
+                            sessionStatusCode = -1
+                            break
+                        }
+                    }
+                    _, err = file.Write(data)
+                    if err != nil {
+                        log.Printf("Failed to write to file. %v", err)
+                        sessionStatusCode = 1
+                        break
+                    }
+                    bytesWritten += length
+                    block = block[length:]
+                    blockIndex ++
+                }
             }
-            bytesWritten += int64(len(buf.data))
             if local {
                 session.statsLock.Lock()
                 session.RxBytes = bytesWritten
                 session.statsLock.Unlock()
             }
+            //Periodically record how far we got in case the daemon stops
+            partial.markUpTo(bytesWritten)
+            if bytesWritten - lastPersisted >= fileSharePersistInterval {
+                file.Sync()
+                f.savePartialDownload(partial, partial.encodeRanges())
+                lastPersisted = bytesWritten
+            }
         }
+        if sessionStatusCode != 0 && fallBack() {
+            goto Request
+        }
+        file.Sync()
         file.Close()
-        //Compute hash to verify integrity of file
-        mh, err = multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
-        if err != nil {
-            log.Printf("Failed to create multihash. %v\n", err)
+        if sessionStatusCode != 0 {
             goto Failed
         }
-        dataCid = cid.NewCidV1(cid.Raw, mh)
+        if dag == nil {
+            //Compute hash to verify integrity of file
+            mh, err = multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
+            if err != nil {
+                log.Printf("Failed to create multihash. %v\n", err)
+                sessionStatusCode = 1
+                goto Failed
+            }
+            dataCid = cid.NewCidV1(cid.Raw, mh)
 
-        if dataCid != reqCid {
-            log.Printf("Cid mismatch!\n")
+            if dataCid != reqCid {
+                log.Printf("Cid mismatch!\n")
+                sessionStatusCode = -1
+                goto Failed
+            }
+        } else if blockIndex != len(dag.Links) || len(block) != 0 {
+            log.Printf("Received data does not match DAG!\n")
             sessionStatusCode = -1
             goto Failed
         }
@@ -1179,166 +2048,155 @@ func (f *FileShareNode) GetFile(ctx context.Context, providerIDStr string, reqCi
             goto Failed
         }
 
-        dbAddDownload(nil, f.host.ID().String(), providerIDStr, reqCidStr, fileMeta.Name, fileMeta.Price,
-                      fileMeta.Size, time.Now().UTC().Format(time.RFC3339))
+        f.releasePartialDownload(partial, false)
+        downloadID, err = dbAddDownload(nil, f.host.ID().String(), providerIDStr, reqCidStr, fileMeta.Name, fileMeta.Price,
+                                        fileMeta.Size, time.Now().UTC().Format(time.RFC3339))
 
         f.SessionCleanup(session, 0)
+        //Files we have ourselves are already shared
+        if err == nil && seed.Enabled && !local {
+            go f.seedDownload(reqCid, outputFile, fileMeta, seed.Price, downloadID)
+        }
+        return
 Failed:
-        os.Remove(tmpOutputFile)
+        //Keep what was downloaded so far unless the data is bad or the download was cancelled
+        if sessionStatusCode == -1 || session.isCancelled() {
+            os.Remove(tmpOutputFile)
+            f.releasePartialDownload(partial, false)
+        } else {
+            f.releasePartialDownload(partial, true)
+        }
         f.SessionCleanup(session, sessionStatusCode)
     }()
     return session.SessionID, nil
 }
 
-func (f *FileShareNode) PutFile(ctx context.Context, inputFile string, price float64) (cid.Cid, error) {
-    //Open input file for reading
-    dataChannel, bytesRead, err := readFile(inputFile)
+//The MIME type is guessed from the file if it isn't given
+//If noCopy is set the file is served from where it is instead of from a copy in the content store
+func (f *FileShareNode) PutFile(ctx context.Context, inputFile string, price float64, details FileShareMetaDetails,
+                                noCopy bool) (cid.Cid, error) {
+    details.Tags = normalizeTags(details.Tags)
+    details.Created = ""
+    err := details.validate()
     if err != nil {
         return cid.Cid{}, err
     }
+    return f.putFile(ctx, inputFile, filepath.Base(inputFile), price, cid.Undef, details, noCopy)
+}
 
-    // Compute running hash for cid
-    hash := sha256.New()
-    for buf := range dataChannel {
-        if buf.err != nil {
-            return cid.Cid{}, buf.err
+//Shares a file under the root CID of its DAG
+//If wantCid is defined the file must hash to it, under the same CID scheme, or nothing is shared
+//The data is kept in the content store, or in the file itself if noCopy is set, and the file is listed
+//as uploadName in the uploads
+func (f *FileShareNode) putFile(ctx context.Context, inputFile string, uploadName string, price float64, wantCid cid.Cid,
+                                details FileShareMetaDetails, noCopy bool) (cid.Cid, error) {
+    var dataCid cid.Cid
+    var contentCid cid.Cid
+    var dag *FileShareDag
+    var rootBytes []byte
+    var bytesRead int64
+    var source fileShareSource
+    var err error
+    if noCopy {
+        source, err = statSource(inputFile)
+        if err != nil {
+            log.Printf("Failed to stat file: %v. %v\n", inputFile, err)
+            return cid.Cid{}, failedToOpenFile
         }
-        _, err = hash.Write(buf.data)
+    }
+    if wantCid.Defined() && isLegacyCid(wantCid) {
+        dataCid, bytesRead, err = computeFileCid(inputFile)
         if err != nil {
-            log.Printf("Failed to write to running hash. %v\n", err)
-            return cid.Cid{}, internalError
+            return cid.Cid{}, err
         }
+        contentCid = dataCid
+    } else {
+        dag, rootBytes, dataCid, contentCid, err = buildFileDag(inputFile)
+        if err != nil {
+            return cid.Cid{}, err
+        }
+        bytesRead = dag.Size
     }
-    mh, err := multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
-    if err != nil {
-        log.Printf("Failed to create multihash. %v\n", err)
-        return cid.Cid{}, internalError
+    if wantCid.Defined() && dataCid != wantCid {
+        return cid.Cid{}, cidMismatch
+    }
+
+    //Keep a copy in the content store, unless the same data is already stored
+    contentKey := contentCid.String()
+    if noCopy {
+        //What we hashed must still be what is in the file
+        if !source.unchanged() {
+            log.Printf("File %v changed while it was being shared\n", inputFile)
+            return cid.Cid{}, sourceChanged
+        }
+        contentKey = source.Path
+        //A copy kept from sharing the file before is no longer needed
+        f.releaseContent(fileShareRefUpload, dataCid.String())
+    } else {
+        err = f.storeContent(inputFile, contentKey, bytesRead, fileShareRefUpload, dataCid.String())
+        if err != nil {
+            return cid.Cid{}, err
+        }
     }
-    dataCid := cid.NewCidV1(cid.Raw, mh)
 
     //Create metadata node
-    filename := filepath.Base(inputFile)
-    fileMeta := FileShareMeta{ Size: bytesRead, Price: price, Name: filename }
+    if details.MimeType == "" {
+        details.MimeType = detectMimeType(inputFile)
+    }
+    if details.Created == "" {
+        details.Created = time.Now().UTC().Format(time.RFC3339)
+    }
+    fileMeta := FileShareMeta{ Size: bytesRead, Price: price, Name: filepath.Base(uploadName), FileShareMetaDetails: details }
+
+    if dag != nil {
+        f.bstoreLock.Lock()
+        f.bstore[dataCid] = rootBytes
+        f.bstoreLock.Unlock()
+    }
 
     f.fstoreLock.Lock()
-    f.fstore[dataCid] = filename
+    f.fstore[dataCid] = contentKey
+    if noCopy {
+        f.sources[dataCid] = source
+    } else {
+        delete(f.sources, dataCid)
+    }
     f.fstoreLock.Unlock()
 
     f.mstoreLock.Lock()
     f.mstore[dataCid] = fileMeta
     f.mstoreLock.Unlock()
+    f.indexShared(dataCid, fileMeta)
 
-    err = f.kadDHT.Provide(ctx, dataCid, true)
+    err = f.provide(ctx, dataCid)
     if err != nil {
-        log.Printf("Failed to provide cid. %v\n", err)
         return cid.Cid{}, internalError
     }
     // Record file into database
-    err = dbAddUpload(nil, f.host.ID().String(), dataCid.String(), filename, price, bytesRead, time.Now().UTC().Format(time.RFC3339))
+    err = dbAddUpload(nil, f.host.ID().String(), dataCid.String(), uploadName, price, bytesRead, time.Now().UTC().Format(time.RFC3339))
     if err != nil {
         log.Printf("Failed to record file into database. %v\n", err)
         return cid.Cid{}, internalError
     }
-
-    inputFilepath, err := filepath.Abs(inputFile)
+    err = dbSetUploadSource(nil, f.host.ID().String(), dataCid.String(), source.Path, source.Size, source.ModTime)
     if err != nil {
-        log.Printf("Failed to resolve absolute path for input file path. %v\n", err)
-        return cid.Cid{}, internalError
+        return cid.Cid{}, err
     }
-    dstFilePath, err := filepath.Abs(fileShareUploadsDirectory + "/" + filename)
+    err = saveFileDetails(f.host.ID().String(), dataCid, details)
     if err != nil {
-        log.Printf("Failed to resolve absolute path for upload directory path. %v\n", err)
-        return cid.Cid{}, internalError
-    }
-
-    // No need to copy to uploaded files directory if input file is already there
-    if inputFilepath != dstFilePath {
-        // Copy file to files directory
-        err = os.MkdirAll(fileShareUploadsDirectory, 0750)
-        if err != nil && !os.IsExist(err) {
-            log.Printf("Failed to create uploads directory. %v\n", err)
-            return cid.Cid{}, internalError
-        }
-        err = copyFile(inputFile, fileShareUploadsDirectory + "/" + filename)
-        if err != nil {
-            log.Printf("Failed to copy file to upload directory. %v\n", err)
-            return cid.Cid{}, internalError
-        }
+        return cid.Cid{}, err
     }
 
     return dataCid, nil
 }
 
-func (f *FileShareNode) Discover(ctx context.Context) []FileShareFileDiscoveryInfo {
-    session := f.SessionCreate(ctx, "")
-    defer f.SessionCleanup(session, 0)
-
-    mapLock := sync.Mutex{}
-    fileDiscoveryMap := make(map[cid.Cid]*FileShareFileDiscoveryInfo)
-
-    p2pHost := f.host
-    peerIDs := p2pHost.Peerstore().Peers()
-    wg := sync.WaitGroup{}
-    wg.Add(len(peerIDs))
-
-    //Dump own mstore into set of data cids
-    mapLock.Lock()
-    f.mstoreLock.Lock()
-    for dataCid, _ := range f.mstore {
-        fileDiscoveryMap[dataCid] = nil
-    }
-    f.mstoreLock.Unlock()
-    mapLock.Unlock()
-
-    //Iterate through node's known peers and send discover requests
-    for _, peerID := range peerIDs {
-        go func(peerID peer.ID) {
-            cids := session.SendDiscover(peerID, 1000)
-            if cids != nil {
-                mapLock.Lock()
-                for _, dataCid := range cids {
-                    fileDiscoveryMap[dataCid] = nil
-                }
-                mapLock.Unlock()
-            }
-            wg.Done()
-        }(peerID)
-    }
-    wg.Wait()
-
-    wg.Add(len(fileDiscoveryMap))
-    //Iterate through all unique data cids and get discovery entry for each
-    for dataCid, _ := range fileDiscoveryMap {
-        go func() {
-            fileDiscovery := session.DiscoverFile(ctx, dataCid, 1000)
-            //Add unique files into map and accumulate providers for each file
-            mapLock.Lock()
-            fileDiscoveryMap[dataCid] = fileDiscovery
-            mapLock.Unlock()
-            wg.Done()
-       }()
-    }
-    wg.Wait()
-
-    fileDiscoveries := make([]FileShareFileDiscoveryInfo, 0, len(fileDiscoveryMap))
-    for _, fileDiscovery := range fileDiscoveryMap {
-        //If nil, no providers were found for this file
-        if fileDiscovery == nil {
-            continue
-        }
-        fileDiscoveries = append(fileDiscoveries, *fileDiscovery)
-    }
-
-    return fileDiscoveries
-}
-
 func (f *FileShareNode) GetFileDiscoveryInfo(ctx context.Context, reqCidStr string) (*FileShareFileDiscoveryInfo, error) {
     reqCid, err := cid.Decode(reqCidStr)
     if err != nil {
         return nil, invalidParams
     }
 
-    session := f.SessionCreate(ctx, "")
+    session := f.SessionCreate(ctx, "", fileShareSessionDiscovery)
     defer f.SessionCleanup(session, 0)
 
     fileDiscovery := session.DiscoverFile(ctx, reqCid, 1000)
@@ -1371,6 +2229,7 @@ func (s *FileShareSession) DiscoverFile(ctx context.Context, reqCid cid.Cid, pro
             }
             fileMeta := FileShareMeta{}
             var walletAddress string
+            var verified bool
             var ok bool
             //Get metadata
             if provider.ID == s.node.host.ID() {
@@ -1383,17 +2242,14 @@ func (s *FileShareSession) DiscoverFile(ctx context.Context, reqCid cid.Cid, pro
                 s.node.walletLock.Lock()
                 walletAddress = s.node.walletAddress
                 s.node.walletLock.Unlock()
+                verified = true
             } else {
-                bytes := s.SendWantMeta(provider.ID, reqCid)
-                if bytes == nil {
-                    return
-                }
-                err = fileMeta.Unmarshal(bytes)
+                //Providers whose signature doesn't check out are dropped, those that don't sign are flagged
+                var err error
+                fileMeta, walletAddress, verified, err = s.getProviderMeta(provider.ID, reqCid)
                 if err != nil {
-                    log.Printf("Error unmarshalling file metadata\n")
                     return
                 }
-                walletAddress = s.SendWantWallet(provider.ID)
             }
 
             provider := FileShareProvider{
@@ -1401,8 +2257,17 @@ func (s *FileShareSession) DiscoverFile(ctx context.Context, reqCid cid.Cid, pro
                 Price: fileMeta.Price,
                 Name: fileMeta.Name,
                 WalletAddress: walletAddress,
+                Verified: verified,
+                FileShareMetaDetails: fileMeta.FileShareMetaDetails,
             }
 
+            //Peers can search for what we discover, our opinion of the provider stays with us
+            //Unsigned metadata isn't tied to the provider, so it is kept out of what we answer for
+            if verified {
+                s.node.searchIndex.add(reqCid, fileMeta.Size, provider)
+            }
+            provider.Score = s.node.providerScore(provider.PeerID)
+
             lock.Lock()
             fileDiscovery.DataCid = reqCid.String()
             fileDiscovery.Size = fileMeta.Size
@@ -1422,6 +2287,7 @@ func (s *FileShareSession) DiscoverFile(ctx context.Context, reqCid cid.Cid, pro
     if len(fileDiscovery.Providers) == 0 {
         return nil
     }
+    sortProvidersByScore(fileDiscovery.Providers)
     return &fileDiscovery
 }
 
@@ -1456,6 +2322,12 @@ func (f *FileShareNode) GetUploads() ([]FileShareUpload, error) {
             continue
         }
         _, ok := f.fstore[dataCid]
+        if !ok {
+            //Directories are listed by their manifest
+            f.bstoreLock.Lock()
+            _, ok = f.bstore[dataCid]
+            f.bstoreLock.Unlock()
+        }
         if ok {
             files = append(files, upload)
         }
@@ -1474,6 +2346,10 @@ func (f *FileShareNode) DeleteFile(dataCidStr string) error {
         log.Printf("Failed to decode cid %v. %v", dataCidStr, err)
         return invalidParams
     }
+    // Directories are removed together with their entries
+    if f.getManifest(dataCid) != nil {
+        return f.deleteDirectory(dataCid)
+    }
     // Search for metadata in mstore and file entry in fstore
     f.mstoreLock.Lock()
     defer f.mstoreLock.Unlock()
@@ -1481,7 +2357,7 @@ func (f *FileShareNode) DeleteFile(dataCidStr string) error {
 
     f.fstoreLock.Lock()
     defer f.fstoreLock.Unlock()
-    fileName, fileOk := f.fstore[dataCid]
+    _, fileOk := f.fstore[dataCid]
 
     if !fileOk || !metaOk {
         return contentNotFound
@@ -1492,20 +2368,32 @@ func (f *FileShareNode) DeleteFile(dataCidStr string) error {
     if err != nil {
         return internalError
     }
+    dbRemoveFileDetails(nil, f.host.ID().String(), dataCid.String())
+    dbRemoveDownloadSeeds(nil, f.host.ID().String(), dataCid.String())
 
     delete(f.fstore, dataCid)
+    delete(f.sources, dataCid)
     delete(f.mstore, dataCid)
+    f.searchIndex.remove(dataCid, f.host.ID())
+    f.bstoreLock.Lock()
+    delete(f.bstore, dataCid)
+    f.bstoreLock.Unlock()
 
-    filePath, err := filepath.Abs(fileShareUploadsDirectory + "/" + fileName)
-    if err != nil {
-        log.Printf("Failed to resolve absolute path for upload file path. %v\n", err)
-        return nil // Not the end of the world if we can't find the file to delete
-    }
-    os.Remove(filePath)
+    // Stored data is only removed once no other CID uses it
+    f.releaseContent(fileShareRefUpload, dataCid.String())
 
     return nil
 }
 
+//Forgets an upload that can't be shared under its CID anymore while loading the uploads
+func (f *FileShareNode) withdrawUpload(dataCid cid.Cid) {
+    peerID := f.host.ID().String()
+    dbRemoveUpload(nil, peerID, dataCid.String())
+    dbRemoveFileDetails(nil, peerID, dataCid.String())
+    dbRemoveDownloadSeeds(nil, peerID, dataCid.String())
+    f.releaseContent(fileShareRefUpload, dataCid.String())
+}
+
 func (f *FileShareNode) SetWalletAddress(walletAddress string) {
     f.walletLock.Lock()
     f.walletAddress = walletAddress
@@ -1513,7 +2401,36 @@ func (f *FileShareNode) SetWalletAddress(walletAddress string) {
 }
 
 
-func readFile(filePath string) (chan DataBuffer, int64, error) {
+//Computes the CID of a file from the SHA-256 hash of its contents
+func computeFileCid(filePath string) (cid.Cid, int64, error) {
+    //Open input file for reading
+    dataChannel, bytesRead, err := readFile(filePath, nil)
+    if err != nil {
+        return cid.Cid{}, 0, err
+    }
+
+    // Compute running hash for cid
+    hash := sha256.New()
+    for buf := range dataChannel {
+        if buf.err != nil {
+            return cid.Cid{}, 0, buf.err
+        }
+        _, err = hash.Write(buf.data)
+        if err != nil {
+            log.Printf("Failed to write to running hash. %v\n", err)
+            return cid.Cid{}, 0, internalError
+        }
+    }
+    mh, err := multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
+    if err != nil {
+        log.Printf("Failed to create multihash. %v\n", err)
+        return cid.Cid{}, 0, internalError
+    }
+    return cid.NewCidV1(cid.Raw, mh), bytesRead, nil
+}
+
+//Reading stops early once stop is closed, a nil stop reads to the end
+func readFile(filePath string, stop <-chan struct{}) (chan DataBuffer, int64, error) {
     absFilePath, err := filepath.Abs(filePath)
     if err != nil {
         log.Printf("Failed to resolve file path to upload directory")
@@ -1546,7 +2463,9 @@ func readFile(filePath string) (chan DataBuffer, int64, error) {
                     break
                 }
             }
-            dataChannel <- DataBuffer{ tempBuffer[:n], nil }
+            if !sendBuffer(dataChannel, DataBuffer{ tempBuffer[:n], nil }, stop) {
+                break
+            }
         }
         file.Close()
         close(dataChannel)
@@ -1554,6 +2473,66 @@ func readFile(filePath string) (chan DataBuffer, int64, error) {
     return dataChannel, stat.Size(), nil
 }
 
+//Same as readFile but only reads length bytes starting at offset
+//Returns the number of bytes that will be read, which is clamped to the end of the file
+func readFileRange(filePath string, offset int64, length int64, stop <-chan struct{}) (chan DataBuffer, int64, error) {
+    absFilePath, err := filepath.Abs(filePath)
+    if err != nil {
+        log.Printf("Failed to resolve file path to upload directory")
+        return nil, int64(0), failedToOpenFile
+    }
+    file, err := os.OpenFile(absFilePath, os.O_RDONLY, 0644)
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", filePath, err)
+        return nil, int64(0), failedToOpenFile
+    }
+    stat, err := file.Stat()
+    if err != nil {
+        log.Printf("Error stat file: %v. %v\n", filePath, err)
+        file.Close()
+        return nil, int64(0), failedToOpenFile
+    }
+    if offset < 0 || length < 0 || offset > stat.Size() {
+        file.Close()
+        return nil, int64(0), invalidParams
+    }
+    if offset + length > stat.Size() {
+        length = stat.Size() - offset
+    }
+    dataChannel := make(chan DataBuffer, 2)
+
+    go func() {
+        reader := io.NewSectionReader(file, offset, length)
+        for {
+            tempBuffer := make([]byte, chunkSize)
+            n, err := io.ReadFull(reader, tempBuffer)
+            if n > 0 && !sendBuffer(dataChannel, DataBuffer{ tempBuffer[:n], nil }, stop) {
+                break
+            }
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                break
+            } else if err != nil {
+                log.Printf("Error reading file: %v. %v\n", filePath, err)
+                dataChannel <- DataBuffer{ nil, internalError }
+                break
+            }
+        }
+        file.Close()
+        close(dataChannel)
+    }()
+    return dataChannel, length, nil
+}
+
+//Returns false if stop was closed before the buffer could be sent
+func sendBuffer(dataChannel chan DataBuffer, buf DataBuffer, stop <-chan struct{}) bool {
+    select {
+        case dataChannel <- buf:
+            return true
+        case <- stop:
+            return false
+    }
+}
+
 func copyFile(srcFilePath string, dstFilePath string) error {
     srcAbsFilePath, err := filepath.Abs(srcFilePath)
     if err != nil {
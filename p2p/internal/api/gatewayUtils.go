@@ -0,0 +1,289 @@
+package api
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "log"
+    "time"
+    "mime"
+    "strings"
+    "strconv"
+    "net/http"
+    "crypto/sha256"
+    "path/filepath"
+    "github.com/multiformats/go-multihash"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+const gatewayContentPath = "/content/"
+
+//Serves GET /content/<cid> on the API listener
+func (a *API) handleContent(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    fsNode := a.service.fsNode
+    if a.service.username == nil || fsNode == nil {
+        http.Error(w, notLoggedIn.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    fsNode.ServeContent(w, r, strings.TrimPrefix(r.URL.Path, gatewayContentPath))
+}
+
+//Parses a single byte range of the form "bytes=<start>-<end>", "bytes=<start>-" or "bytes=-<suffix>"
+//Returns ok as false if the header should be ignored and the whole file served instead
+func parseByteRange(header string, size int64) (start int64, length int64, ok bool, err error) {
+    if !strings.HasPrefix(header, "bytes=") {
+        return 0, 0, false, nil
+    }
+    spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+    //Multiple ranges are not supported, serve the whole file
+    if strings.Contains(spec, ",") {
+        return 0, 0, false, nil
+    }
+    startStr, endStr, found := strings.Cut(spec, "-")
+    if !found {
+        return 0, 0, false, invalidParams
+    }
+    startStr = strings.TrimSpace(startStr)
+    endStr = strings.TrimSpace(endStr)
+    if startStr == "" {
+        //Suffix range: last <end> bytes of the file
+        suffix, err := strconv.ParseInt(endStr, 10, 64)
+        if err != nil || suffix <= 0 || size == 0 {
+            return 0, 0, false, invalidParams
+        }
+        suffix = min(suffix, size)
+        return size - suffix, suffix, true, nil
+    }
+    start, err = strconv.ParseInt(startStr, 10, 64)
+    if err != nil || start < 0 || start >= size {
+        return 0, 0, false, invalidParams
+    }
+    end := size - 1
+    if endStr != "" {
+        end, err = strconv.ParseInt(endStr, 10, 64)
+        if err != nil || end < start {
+            return 0, 0, false, invalidParams
+        }
+        end = min(end, size - 1)
+    }
+    return start, end - start + 1, true, nil
+}
+
+func setContentHeaders(w http.ResponseWriter, fileMeta FileShareMeta) {
+    contentType := fileMeta.MimeType
+    if contentType == "" {
+        contentType = mime.TypeByExtension(filepath.Ext(fileMeta.Name))
+    }
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{ "filename": fileMeta.Name }))
+    w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Content-Disposition, Accept-Ranges")
+}
+
+//Streams the content of a CID over HTTP, fetching it over the FileShare protocol if we don't have it
+func (f *FileShareNode) ServeContent(w http.ResponseWriter, r *http.Request, reqCidStr string) {
+    reqCid, err := cid.Decode(reqCidStr)
+    if err != nil {
+        http.Error(w, invalidParams.Error(), http.StatusBadRequest)
+        return
+    }
+
+    //Serve straight from disk if it's our own file
+    f.fstoreLock.Lock()
+    contentKey, local := f.fstore[reqCid]
+    f.fstoreLock.Unlock()
+    local = local && f.checkSource(reqCid)
+    f.mstoreLock.Lock()
+    fileMeta, ok := f.mstore[reqCid]
+    f.mstoreLock.Unlock()
+    if local && ok {
+        file, err := os.Open(contentPath(contentKey))
+        if err == nil {
+            defer file.Close()
+            stat, err := file.Stat()
+            if err == nil {
+                setContentHeaders(w, fileMeta)
+                http.ServeContent(w, r, fileMeta.Name, stat.ModTime(), file)
+                return
+            }
+        }
+    }
+
+    session := f.SessionCreate(r.Context(), reqCidStr, fileShareSessionGateway)
+    sessionStatusCode := 1
+    defer func() {
+        f.SessionCleanup(session, sessionStatusCode)
+    }()
+
+    fileDiscovery := session.DiscoverFile(r.Context(), reqCid, 1000)
+    if fileDiscovery == nil {
+        http.Error(w, contentNotFound.Error(), http.StatusNotFound)
+        return
+    }
+
+    //Pick the first provider that gives us the metadata and accepts the request, skipping busy ones
+    var providerID peer.ID
+    var dag *FileShareDag
+    var dataChannel chan DataBuffer
+    var start, length, fetchStart, fetchEnd int64
+    var partialContent bool
+    retryAfter := time.Duration(0)
+    for _, provider := range fileDiscovery.Providers {
+        if provider.PeerID == f.host.ID() {
+            continue
+        }
+        bytes := session.SendWantMeta(provider.PeerID, reqCid)
+        if bytes == nil || fileMeta.Unmarshal(bytes) != nil {
+            continue
+        }
+        dag, err = session.GetDag(provider.PeerID, reqCid)
+        if err != nil {
+            continue
+        }
+        if dag != nil {
+            fileMeta.Size = dag.Size
+        }
+
+        start, length, partialContent, err = parseByteRange(r.Header.Get("Range"), fileMeta.Size)
+        if err != nil {
+            w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileMeta.Size))
+            http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+            return
+        }
+        if !partialContent {
+            start, length = 0, fileMeta.Size
+        }
+        if r.Method == http.MethodHead || length == 0 {
+            providerID = provider.PeerID
+            break
+        }
+
+        //Blocks can only be verified whole, so request the blocks covering the range and trim them
+        fetchStart, fetchEnd = start, start + length
+        if dag != nil {
+            fetchStart = int64(dag.BlockIndex(start)) * dag.ChunkSize
+            fetchEnd = min(dag.Size, int64(dag.BlockIndex(start + length - 1) + 1) * dag.ChunkSize)
+        }
+        if fetchStart == 0 && fetchEnd == fileMeta.Size {
+            dataChannel = session.SendWantData(provider.PeerID, reqCid)
+        } else {
+            dataChannel = session.SendWantRange(provider.PeerID, reqCid, fetchStart, fetchEnd - fetchStart)
+        }
+        if dataChannel == nil {
+            busyRetryAfter, busy := session.RetryAfter(provider.PeerID)
+            if busy {
+                retryAfter = busyRetryAfter
+            }
+            log.Printf("Gateway failed to get %v from %v\n", reqCid, provider.PeerID)
+            continue
+        }
+        providerID = provider.PeerID
+        break
+    }
+    if providerID == "" {
+        if retryAfter > 0 {
+            w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+            http.Error(w, providerBusy.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        http.Error(w, contentNotFound.Error(), http.StatusBadGateway)
+        return
+    }
+
+    setContentHeaders(w, fileMeta)
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+    if partialContent {
+        w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start + length - 1, fileMeta.Size))
+        w.WriteHeader(http.StatusPartialContent)
+    } else {
+        w.WriteHeader(http.StatusOK)
+    }
+    if dataChannel == nil {
+        sessionStatusCode = 0
+        return
+    }
+
+    err = streamContent(w, session, providerID, reqCid, dag, dataChannel, fetchStart, start, length, fileMeta.Size)
+    if err != nil {
+        log.Printf("Gateway stopped streaming %v. %v\n", reqCid, err)
+        return
+    }
+    sessionStatusCode = 0
+}
+
+//Writes the part of the received data between start and start + length to w
+//Blocks of a DAG are verified before they are written. Legacy CIDs can only be checked when the whole file is sent.
+func streamContent(w io.Writer, session *FileShareSession, providerID peer.ID, reqCid cid.Cid, dag *FileShareDag,
+                   dataChannel chan DataBuffer, fetchStart int64, start int64, length int64, size int64) error {
+    var err error
+    var block []byte
+    offset := fetchStart
+    hash := sha256.New()
+    flusher, canFlush := w.(http.Flusher)
+    //Always drain the channel so the reader goroutine can exit
+    for buf := range dataChannel {
+        if err != nil {
+            continue
+        }
+        if buf.err != nil {
+            err = buf.err
+            continue
+        }
+        if dag == nil {
+            hash.Write(buf.data)
+            _, err = w.Write(buf.data)
+            offset += int64(len(buf.data))
+        } else {
+            block = append(block, buf.data...)
+            for err == nil {
+                index := dag.BlockIndex(offset)
+                if index >= len(dag.Links) {
+                    break
+                }
+                _, blockLength := dag.BlockRange(index)
+                if int64(len(block)) < blockLength {
+                    break
+                }
+                data := block[:blockLength]
+                if !dag.VerifyBlock(index, data) {
+                    data, err = session.RepairBlock(providerID, reqCid, dag, index)
+                    if err != nil {
+                        break
+                    }
+                }
+                //Trim the block to the requested range
+                lo := max(start - offset, 0)
+                hi := min(start + length - offset, blockLength)
+                _, err = w.Write(data[lo:hi])
+                offset += blockLength
+                block = block[blockLength:]
+            }
+        }
+        if err == nil && canFlush {
+            flusher.Flush()
+        }
+    }
+    if err != nil {
+        return err
+    }
+    if offset - fetchStart < length {
+        return io.ErrUnexpectedEOF
+    }
+    //Whole legacy file was sent, at least report if it didn't match
+    if dag == nil && start == 0 && length == size {
+        mh, _ := multihash.Encode(hash.Sum([]byte{}), multihash.SHA2_256)
+        if cid.NewCidV1(cid.Raw, mh) != reqCid {
+            return integrityError
+        }
+    }
+    return nil
+}
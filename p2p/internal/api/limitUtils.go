@@ -0,0 +1,147 @@
+package api
+
+import (
+    "log"
+    "time"
+    "sync"
+    "strconv"
+    "github.com/libp2p/go-libp2p/core/peer"
+)
+
+//Settings holding the upload limits, rates are in bytes per second and 0 means unlimited
+const fileShareUploadRateSetting = "upload_rate"
+const fileSharePeerUploadRateSetting = "peer_upload_rate"
+const fileShareMaxRemoteSessionsSetting = "max_remote_sessions"
+//How long a requester is told to wait when we are serving too many sessions
+const fileShareBusyRetryAfter = time.Second * 10
+
+type FileShareUploadLimits struct {
+    UploadRate int64        `json:"upload_rate"`
+    PeerUploadRate int64    `json:"peer_upload_rate"`
+    MaxSessions int         `json:"max_sessions"`
+}
+
+//Spaces out sends so that they don't exceed rate bytes per second on average
+//Every send reserves the time it takes at the current rate, so concurrent senders share the rate fairly
+type rateLimiter struct {
+    lock sync.Mutex
+    rate int64
+    next time.Time
+}
+
+func (l *rateLimiter) setRate(rate int64) {
+    l.lock.Lock()
+    l.rate = rate
+    l.lock.Unlock()
+}
+
+//Blocks until n more bytes may be sent
+func (l *rateLimiter) wait(n int) {
+    l.lock.Lock()
+    if l.rate <= 0 {
+        l.lock.Unlock()
+        return
+    }
+    now := time.Now()
+    if l.next.Before(now) {
+        l.next = now
+    }
+    delay := l.next.Sub(now)
+    l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+    l.lock.Unlock()
+    time.Sleep(delay)
+}
+
+func (f *FileShareNode) loadUploadLimits() {
+    limits := FileShareUploadLimits{ UploadRate: 0, PeerUploadRate: 0, MaxSessions: 0 }
+    peerID := f.host.ID().String()
+    for key, value := range map[string]*int64{ fileShareUploadRateSetting: &limits.UploadRate,
+                                               fileSharePeerUploadRateSetting: &limits.PeerUploadRate } {
+        valueStr, err := dbGetSetting(nil, peerID, key)
+        if err == nil {
+            *value, _ = strconv.ParseInt(valueStr, 10, 64)
+        }
+    }
+    maxSessionsStr, err := dbGetSetting(nil, peerID, fileShareMaxRemoteSessionsSetting)
+    if err == nil {
+        limits.MaxSessions, _ = strconv.Atoi(maxSessionsStr)
+    }
+    f.applyUploadLimits(limits)
+}
+
+func (f *FileShareNode) applyUploadLimits(limits FileShareUploadLimits) {
+    f.limitsLock.Lock()
+    defer f.limitsLock.Unlock()
+    f.uploadLimits = limits
+    f.uploadLimiter.setRate(limits.UploadRate)
+    for _, limiter := range f.peerLimiters {
+        limiter.setRate(limits.PeerUploadRate)
+    }
+}
+
+func (f *FileShareNode) GetUploadLimits() FileShareUploadLimits {
+    f.limitsLock.Lock()
+    defer f.limitsLock.Unlock()
+    return f.uploadLimits
+}
+
+//Changes the upload limits of sessions that are already being served as well as new ones
+func (f *FileShareNode) SetUploadLimits(limits FileShareUploadLimits) error {
+    if limits.UploadRate < 0 || limits.PeerUploadRate < 0 || limits.MaxSessions < 0 {
+        return invalidParams
+    }
+    peerID := f.host.ID().String()
+    err := dbSetSetting(nil, peerID, fileShareUploadRateSetting, strconv.FormatInt(limits.UploadRate, 10))
+    if err != nil {
+        return err
+    }
+    err = dbSetSetting(nil, peerID, fileSharePeerUploadRateSetting, strconv.FormatInt(limits.PeerUploadRate, 10))
+    if err != nil {
+        return err
+    }
+    err = dbSetSetting(nil, peerID, fileShareMaxRemoteSessionsSetting, strconv.Itoa(limits.MaxSessions))
+    if err != nil {
+        return err
+    }
+    f.applyUploadLimits(limits)
+    log.Printf("Upload limits set to %d B/s overall, %d B/s per peer and %d sessions\n",
+               limits.UploadRate, limits.PeerUploadRate, limits.MaxSessions)
+    return nil
+}
+
+//Blocks until n more bytes may be sent to a peer without exceeding the upload limits
+func (f *FileShareNode) throttleUpload(peerID peer.ID, n int) {
+    f.limitsLock.Lock()
+    limiter, ok := f.peerLimiters[peerID]
+    if !ok {
+        limiter = &rateLimiter{ rate: f.uploadLimits.PeerUploadRate }
+        f.peerLimiters[peerID] = limiter
+    }
+    f.limitsLock.Unlock()
+    limiter.wait(n)
+    f.uploadLimiter.wait(n)
+}
+
+//Caller must hold rSessionStoreLock
+func (f *FileShareNode) remoteSessionCount() int {
+    count := 0
+    for _, rSessions := range f.rSessionStore {
+        count += len(rSessions)
+    }
+    return count
+}
+
+//Records that a provider replied BUSY and how long it asked us to wait
+func (s *FileShareSession) setRetryAfter(peerID peer.ID, retryAfter time.Duration) {
+    s.statsLock.Lock()
+    s.retryAfter[peerID] = retryAfter
+    s.statsLock.Unlock()
+}
+
+//Returns how long a provider asked us to wait if it was busy on our last data request
+func (s *FileShareSession) RetryAfter(peerID peer.ID) (time.Duration, bool) {
+    s.statsLock.Lock()
+    defer s.statsLock.Unlock()
+    retryAfter, ok := s.retryAfter[peerID]
+    return retryAfter, ok
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "log"
+    "mime"
+    "time"
+    "strings"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "path/filepath"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Version of the metadata encoding sent in reply to WANT META VERSIONED. The legacy layout is version 1.
+//New fields can be added without changing the version since readers ignore fields they don't know,
+//the version only changes if existing fields change meaning.
+const fileShareMetaVersion = 2
+//Limits on the metadata we accept, from peers and from the user
+const fileShareMaxMetaSize = 64 * 1024
+const fileShareMaxNameLen = 1024
+const fileShareMaxDescriptionLen = 4096
+const fileShareMaxMimeTypeLen = 255
+const fileShareMaxTags = 32
+const fileShareMaxTagLen = 64
+
+//Fields of the metadata that only the versioned encoding carries
+type FileShareMetaDetails struct {
+    Description string      `json:"description,omitempty"`
+    MimeType string         `json:"mime_type,omitempty"`
+    Tags []string           `json:"tags,omitempty"`
+    //ISO-8601 string of when the file was first shared
+    Created string          `json:"created,omitempty"`
+}
+
+type fileShareVersionedMeta struct {
+    Version int             `json:"version"`
+    FileShareMeta
+}
+
+//Self-describing encoding, a JSON object with the version of the encoding
+func (r *FileShareMeta) Marshal() ([]byte, error) {
+    err := r.validate()
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(fileShareVersionedMeta{ Version: fileShareMetaVersion, FileShareMeta: *r })
+}
+
+//Reads both the versioned encoding and the legacy layout
+func (r *FileShareMeta) Unmarshal(bytes []byte) error {
+    //The legacy layout starts with the size, whose first byte can't be '{' for any real file
+    if len(bytes) == 0 || bytes[0] != '{' {
+        return r.unmarshalLegacy(bytes)
+    }
+    versionedMeta := fileShareVersionedMeta{}
+    err := json.Unmarshal(bytes, &versionedMeta)
+    if err != nil || versionedMeta.Version < 2 || versionedMeta.Version > fileShareMetaVersion {
+        return invalidParams
+    }
+    err = versionedMeta.FileShareMeta.validate()
+    if err != nil {
+        return err
+    }
+    *r = versionedMeta.FileShareMeta
+    return nil
+}
+
+func (r *FileShareMeta) validate() error {
+    if r.Name == "" || len(r.Name) > fileShareMaxNameLen || r.Size < 0 || r.Price < 0 {
+        return invalidParams
+    }
+    return r.FileShareMetaDetails.validate()
+}
+
+func (d *FileShareMetaDetails) validate() error {
+    if len(d.Description) > fileShareMaxDescriptionLen || len(d.MimeType) > fileShareMaxMimeTypeLen || len(d.Tags) > fileShareMaxTags {
+        return invalidParams
+    }
+    for _, tag := range d.Tags {
+        if tag == "" || len(tag) > fileShareMaxTagLen {
+            return invalidParams
+        }
+    }
+    if d.Created != "" {
+        _, err := time.Parse(time.RFC3339, d.Created)
+        if err != nil {
+            return invalidParams
+        }
+    }
+    return nil
+}
+
+//Tags are matched without regard to case or surrounding spaces, and each is kept once
+func normalizeTags(tags []string) []string {
+    normalized := []string{}
+    seen := make(map[string]bool)
+    for _, tag := range tags {
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if tag == "" || seen[tag] {
+            continue
+        }
+        seen[tag] = true
+        normalized = append(normalized, tag)
+    }
+    return normalized
+}
+
+//Guesses the MIME type of a file from its extension, or from its first bytes if the extension is unknown
+func detectMimeType(filePath string) string {
+    mimeType := mime.TypeByExtension(filepath.Ext(filePath))
+    if mimeType != "" {
+        return mimeType
+    }
+    file, err := os.Open(filePath)
+    if err != nil {
+        return "application/octet-stream"
+    }
+    defer file.Close()
+    header := make([]byte, 512)
+    n, err := io.ReadFull(file, header)
+    if err != nil && err != io.ErrUnexpectedEOF {
+        return "application/octet-stream"
+    }
+    return http.DetectContentType(header[:n])
+}
+
+//Details of an upload kept in the database, or only the time it was shared for files shared before details were kept
+func loadFileDetails(peerID string, upload FileShareUpload) FileShareMetaDetails {
+    details := FileShareMetaDetails{}
+    detailsStr, err := dbGetFileDetails(nil, peerID, upload.DataCid)
+    if err != nil || json.Unmarshal([]byte(detailsStr), &details) != nil {
+        return FileShareMetaDetails{ Created: upload.Timestamp }
+    }
+    return details
+}
+
+func saveFileDetails(peerID string, c cid.Cid, details FileShareMetaDetails) error {
+    detailsBytes, err := json.Marshal(details)
+    if err != nil {
+        return internalError
+    }
+    return dbSetFileDetails(nil, peerID, c.String(), string(detailsBytes))
+}
+
+//Request:  "WANT META\n<cid>\n" for the legacy layout, or "WANT META VERSIONED\n<cid>\n"
+//Response: "HERE\n<size>\n<byte1><byte2>..."
+//          "DON'T HAVE\n"
+func (f *FileShareNode) handleWantMeta(stream *P2PStream, versioned bool) error {
+    //Get requested CID
+    cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    cid, err := cid.Decode(cidStr[:len(cidStr) - 1])
+    if err != nil {
+        return err
+    }
+
+    //Look for metadata in meta data store
+    f.mstoreLock.Lock()
+    fileMetadata, ok := f.mstore[cid]
+    f.mstoreLock.Unlock()
+    if !ok {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    var rawData []byte
+    if versioned {
+        rawData, err = fileMetadata.Marshal()
+    } else {
+        rawData, err = fileMetadata.MarshalLegacy()
+    }
+    if err != nil {
+        log.Printf("Failed to marshal file metadata. %v \n", err)
+        return err
+    }
+    err = stream.SendString(fmt.Sprintf("HERE\n%d\n", len(rawData)))
+    if err != nil {
+        return err
+    }
+    return stream.Send(rawData)
+}
+
+//Gets the metadata of a CID from a provider, in the versioned encoding unless the provider only knows the legacy layout
+//Providers that don't know about versioned metadata close the stream, after which we don't ask them again
+//Returns nil if the provider doesn't have it or the request failed
+func (s *FileShareSession) SendWantMeta(peerID peer.ID, c cid.Cid) []byte {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+
+    s.streamLock.Lock()
+    legacy := s.legacyMetaPeers[peerID]
+    s.streamLock.Unlock()
+    if !legacy {
+        data, err := s.wantMeta(peerID, "WANT META VERSIONED\n", c)
+        if err == nil {
+            return data
+        }
+        //Only a provider closing the stream on the request means it doesn't know it, other errors can be transient
+        s.DeleteStream(peerID)
+        if err != streamClosed {
+            return nil
+        }
+        log.Printf("Provider %v does not support versioned metadata, asking for the legacy layout\n", peerID)
+        s.streamLock.Lock()
+        s.legacyMetaPeers[peerID] = true
+        s.streamLock.Unlock()
+    }
+    data, err := s.wantMeta(peerID, "WANT META\n", c)
+    if err != nil {
+        return nil
+    }
+    return data
+}
+
+//Caller must hold the request lock of the peer
+func (s *FileShareSession) wantMeta(peerID peer.ID, req string, c cid.Cid) ([]byte, error) {
+    //Send WANT request
+    err := s.sendString(peerID, fmt.Sprintf("%s%s\n", req, c.String()))
+    if err != nil {
+        return nil, err
+    }
+
+    //Wait for response
+    resp, err := s.readString(peerID, '\n', fileShareWantTimeout)
+    if err != nil {
+        return nil, err
+    }
+    if resp == "DON'T HAVE\n" {
+        return nil, nil
+    } else if resp != "HERE\n" {
+        return nil, unexpectedResponse
+    }
+
+    //Response of the form HERE\n<size>\n<byte><byte>...
+    //The provider knew the request, so closing the stream now isn't reported as streamClosed
+    sizeStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, unexpectedResponse
+    }
+    size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
+    if err != nil || size <= 0 || size > fileShareMaxMetaSize {
+        return nil, unexpectedResponse
+    }
+    return s.read(peerID, size, fileShareWantHaveTimeout)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/ethereum/go-ethereum/rpc"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -194,6 +195,9 @@ func (s *P2PService) Logout() (string, error) {
 	if s.username == nil {
 		return "", notLoggedIn
 	}
+	if s.fsNode != nil {
+		s.fsNode.Close()
+	}
 	(*s.p2pHost).Close()
 	s.proxyNode.Close()
 	s.username = nil
@@ -248,12 +252,27 @@ func (s *P2PService) Register(username string, password string, seed string) (st
 	return "success", nil
 }
 
-func (s *P2PService) PutFile(inputFile string, price float64) (string, error) {
+func (s *P2PService) PutFile(inputFile string, price float64, description *string, mimeType *string, tags *[]string,
+	noCopy *bool) (string, error) {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to put file when not logged in\n")
 		return "", notLoggedIn
 	}
-	cid, err := s.fsNode.PutFile(context.Background(), inputFile, price)
+	details := FileShareMetaDetails{}
+	if description != nil {
+		details.Description = *description
+	}
+	if mimeType != nil {
+		details.MimeType = *mimeType
+	}
+	if tags != nil {
+		details.Tags = *tags
+	}
+	noCopyFlag := false
+	if noCopy != nil {
+		noCopyFlag = *noCopy
+	}
+	cid, err := s.fsNode.PutFile(context.Background(), inputFile, price, details, noCopyFlag)
 	if err != nil {
 		return "", err
 	}
@@ -261,19 +280,292 @@ func (s *P2PService) PutFile(inputFile string, price float64) (string, error) {
 	return cid.String(), nil
 }
 
-func (s *P2PService) GetFile(providerID string, cid string, outputFile string) (int, error) {
+func (s *P2PService) PutDirectory(inputDir string, price float64) (string, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to put directory when not logged in\n")
+		return "", notLoggedIn
+	}
+	cid, err := s.fsNode.PutDirectory(context.Background(), inputDir, price)
+	if err != nil {
+		return "", err
+	}
+
+	return cid.String(), nil
+}
+
+// priority is optional, downloads with a higher priority are started first
+func (s *P2PService) GetFile(providerID string, cid string, outputFile string, priority *int, txID *string, policy *string,
+	seed *bool, seedPrice *float64) (int, error) {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to put file when not logged in\n")
 		return -1, notLoggedIn
 	}
+	if priority == nil {
+		priority = new(int)
+	}
+	if txID == nil {
+		txID = new(string)
+	}
+	if policy == nil {
+		policy = new(string)
+	}
+	seedSettings := s.fsNode.GetSeedSettings()
+	if seed != nil {
+		seedSettings.Enabled = *seed
+	}
+	if seedPrice != nil {
+		seedSettings.Price = *seedPrice
+	}
 	// err := bitswapGetFile(context.Background(), s.exchange, s.bstore, cid, outputFile)
-	sessionID, err := s.fsNode.GetFile(context.Background(), providerID, cid, outputFile)
+	sessionID, err := s.fsNode.GetFile(context.Background(), providerID, cid, outputFile, *priority, *txID, *policy, seedSettings)
 	if err != nil {
 		return -1, err
 	}
 	return sessionID, nil
 }
 
+func (s *P2PService) GetFileSwarm(cid string, outputFile string, priority *int) (int, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get file when not logged in\n")
+		return -1, notLoggedIn
+	}
+	if priority == nil {
+		priority = new(int)
+	}
+	sessionID, err := s.fsNode.GetFileSwarm(context.Background(), cid, outputFile, *priority)
+	if err != nil {
+		return -1, err
+	}
+	return sessionID, nil
+}
+
+func (s *P2PService) GetFileEncrypted(providerID string, cid string, outputFile string, priority *int) (int, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get file when not logged in\n")
+		return -1, notLoggedIn
+	}
+	if priority == nil {
+		priority = new(int)
+	}
+	sessionID, err := s.fsNode.GetFileEncrypted(context.Background(), providerID, cid, outputFile, *priority)
+	if err != nil {
+		return -1, err
+	}
+	return sessionID, nil
+}
+
+func (s *P2PService) GetLockedDownloads() ([]FileShareLockedDownload, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get locked downloads when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetLockedDownloads()
+}
+
+func (s *P2PService) UnlockDownload(downloadID int, txID *string) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to unlock download when not logged in\n")
+		return notLoggedIn
+	}
+	if txID == nil {
+		txID = new(string)
+	}
+	return s.fsNode.UnlockDownload(context.Background(), downloadID, *txID)
+}
+
+func (s *P2PService) GetPartialDownloads() ([]FileSharePartialDownload, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get partial downloads when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetPartialDownloads()
+}
+
+func (s *P2PService) ResumeDownload(downloadID int) (int, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to resume download when not logged in\n")
+		return -1, notLoggedIn
+	}
+	sessionID, err := s.fsNode.ResumeDownload(context.Background(), downloadID)
+	if err != nil {
+		return -1, err
+	}
+	return sessionID, nil
+}
+
+func (s *P2PService) GetQueue() ([]*FileShareSession, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get download queue when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetQueue(), nil
+}
+
+func (s *P2PService) SetPriority(sessionID int, priority int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set download priority when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetPriority(sessionID, priority)
+}
+
+func (s *P2PService) ReorderQueue(sessionIDs []int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to reorder download queue when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.ReorderQueue(sessionIDs)
+}
+
+func (s *P2PService) Promote(sessionID int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to promote download when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.MoveInQueue(sessionID, true)
+}
+
+func (s *P2PService) Demote(sessionID int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to demote download when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.MoveInQueue(sessionID, false)
+}
+
+func (s *P2PService) GetMaxActiveDownloads() (int, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get maximum active downloads when not logged in\n")
+		return -1, notLoggedIn
+	}
+	return s.fsNode.GetMaxActiveDownloads(), nil
+}
+
+func (s *P2PService) SetMaxActiveDownloads(maxActive int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set maximum active downloads when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetMaxActiveDownloads(maxActive)
+}
+
+func (s *P2PService) GetUploadLimits() (FileShareUploadLimits, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get upload limits when not logged in\n")
+		return FileShareUploadLimits{}, notLoggedIn
+	}
+	return s.fsNode.GetUploadLimits(), nil
+}
+
+func (s *P2PService) SetUploadLimits(uploadRate int64, peerUploadRate int64, maxSessions int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set upload limits when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetUploadLimits(FileShareUploadLimits{
+		UploadRate:     uploadRate,
+		PeerUploadRate: peerUploadRate,
+		MaxSessions:    maxSessions,
+	})
+}
+
+func (s *P2PService) GetSeedSettings() (FileShareSeedSettings, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get seed settings when not logged in\n")
+		return FileShareSeedSettings{}, notLoggedIn
+	}
+	return s.fsNode.GetSeedSettings(), nil
+}
+
+func (s *P2PService) SetSeedSettings(enabled bool, price float64) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set seed settings when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetSeedSettings(FileShareSeedSettings{
+		Enabled: enabled,
+		Price:   price,
+	})
+}
+
+func (s *P2PService) GetPaymentSettings() (FileSharePaymentSettings, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get payment settings when not logged in\n")
+		return FileSharePaymentSettings{}, notLoggedIn
+	}
+	return s.fsNode.GetPaymentSettings(), nil
+}
+
+// The RPC password of the wallet is read from P2P_WALLET_RPC_PASSWORD when logging in
+func (s *P2PService) SetPaymentSettings(walletRPCHost string, walletRPCUser string, minConfirmations int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set payment settings when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetPaymentSettings(FileSharePaymentSettings{
+		WalletRPCHost:    walletRPCHost,
+		WalletRPCUser:    walletRPCUser,
+		MinConfirmations: minConfirmations,
+	})
+}
+
+func (s *P2PService) GetPayments() ([]FileSharePayment, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get payments when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetPayments()
+}
+
+// Interval is the width of the time series buckets in seconds, an hour by default
+func (s *P2PService) GetUploadStats(cid *string, interval *int64) (FileShareUploadStats, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get upload stats when not logged in\n")
+		return FileShareUploadStats{}, notLoggedIn
+	}
+	if cid == nil {
+		cid = new(string)
+	}
+	statsInterval := fileShareDefaultStatsInterval
+	if interval != nil {
+		statsInterval = time.Duration(*interval) * time.Second
+	}
+	return s.fsNode.GetUploadStats(*cid, statsInterval)
+}
+
+func (s *P2PService) GetProvideStatus() ([]FileShareProvideStatus, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get provide status when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetProvideStatus(), nil
+}
+
+// Exposed as p2p_gc
+func (s *P2PService) Gc() (FileShareGCResult, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to collect garbage when not logged in\n")
+		return FileShareGCResult{}, notLoggedIn
+	}
+	return s.fsNode.CollectGarbage()
+}
+
+func (s *P2PService) GetStorageInfo() (FileShareStorageInfo, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get storage info when not logged in\n")
+		return FileShareStorageInfo{}, notLoggedIn
+	}
+	return s.fsNode.GetStorageInfo()
+}
+
+func (s *P2PService) SetStorageQuota(quota int64) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to set storage quota when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.SetStorageQuota(quota)
+}
+
 func (s *P2PService) DeleteFile(cid string) error {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to delete file when not logged in\n")
@@ -322,6 +614,14 @@ func (s *P2PService) Resume(sessionID int) error {
 	return nil
 }
 
+func (s *P2PService) Cancel(sessionID int) error {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to cancel session when not logged in\n")
+		return notLoggedIn
+	}
+	return s.fsNode.CancelSession(sessionID)
+}
+
 func (s *P2PService) GetSession(sessionID int) (*FileShareSession, error) {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to get session when not logged in\n")
@@ -334,6 +634,82 @@ func (s *P2PService) GetSession(sessionID int) (*FileShareSession, error) {
 	return session, nil
 }
 
+// state is optional, one of "active", "paused", "completed" or "failed"
+func (s *P2PService) GetSessions(state *string) ([]*FileShareSession, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get sessions when not logged in\n")
+		return nil, notLoggedIn
+	}
+	if state == nil {
+		state = new(string)
+	}
+	return s.fsNode.GetSessions(*state)
+}
+
+func (s *P2PService) GetSessionHistory() ([]FileShareSessionRecord, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get session history when not logged in\n")
+		return nil, notLoggedIn
+	}
+	return s.fsNode.GetSessionHistory()
+}
+
+// Subscription over WebSocket, started with p2p_subscribe("events", topics) and ended with p2p_unsubscribe.
+// topics is optional, every topic is sent if it is empty.
+func (s *P2PService) Events(ctx context.Context, topics *[]string) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	if topics == nil {
+		topics = &[]string{}
+	}
+	for _, topic := range *topics {
+		if !validEventTopic(topic) {
+			return nil, invalidParams
+		}
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	subscriberID, subscriber := events.subscribe(*topics)
+	go func() {
+		defer events.unsubscribe(subscriberID)
+		ticker := time.NewTicker(eventProgressInterval)
+		defer ticker.Stop()
+		//Progress is polled rather than published on every chunk, and only sent when it changes
+		lastRxBytes := make(map[int]int64)
+		for {
+			select {
+			case event := <-subscriber.events:
+				notifier.Notify(rpcSub.ID, event)
+			case <-ticker.C:
+				if !subscriber.wants(eventSessionProgress) || s.fsNode == nil {
+					continue
+				}
+				sessions, err := s.fsNode.GetSessions(fileShareSessionActive)
+				if err != nil {
+					continue
+				}
+				rxBytes := make(map[int]int64)
+				for _, session := range sessions {
+					if session.Type == fileShareSessionDiscovery {
+						continue
+					}
+					rxBytes[session.SessionID] = session.RxBytes
+					last, ok := lastRxBytes[session.SessionID]
+					if !ok || last != session.RxBytes {
+						notifier.Notify(rpcSub.ID, P2PEvent{Topic: eventSessionProgress, Data: session})
+					}
+				}
+				lastRxBytes = rxBytes
+			case <-rpcSub.Err():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
 func (s *P2PService) FindProviders(cid string) ([]peer.AddrInfo, error) {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to find providers when not logged in\n")
@@ -361,6 +737,68 @@ func (s *P2PService) DiscoverFiles() ([]FileShareFileDiscoveryInfo, error) {
 	return s.fsNode.Discover(context.Background()), nil
 }
 
+func (s *P2PService) StartDiscovery() (int, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to start discovery when not logged in\n")
+		return -1, notLoggedIn
+	}
+	return s.fsNode.StartDiscovery(), nil
+}
+
+// offset and limit are optional, the first 100 files are returned by default
+func (s *P2PService) GetDiscovery(discoveryID int, offset *int, limit *int) (FileShareDiscoveryPage, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get discovery when not logged in\n")
+		return FileShareDiscoveryPage{}, notLoggedIn
+	}
+	if offset == nil {
+		offset = new(int)
+	}
+	pageLimit := fileShareDefaultDiscoveryLimit
+	if limit != nil {
+		pageLimit = *limit
+	}
+	return s.fsNode.GetDiscovery(discoveryID, *offset, pageLimit)
+}
+
+// cursor and limit are optional, the first 50 files are returned by default
+func (s *P2PService) GetPeerCatalog(peerID string, cursor *string, limit *int) (FileSharePeerCatalog, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get peer catalog when not logged in\n")
+		return FileSharePeerCatalog{}, notLoggedIn
+	}
+	if cursor == nil {
+		cursor = new(string)
+	}
+	pageLimit := fileShareDefaultCatalogLimit
+	if limit != nil {
+		pageLimit = *limit
+	}
+	return s.fsNode.GetPeerCatalog(context.Background(), peerID, *cursor, pageLimit)
+}
+
+func (s *P2PService) GetProviderReputation(peerID *string) ([]FileShareReputation, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to get provider reputation when not logged in\n")
+		return nil, notLoggedIn
+	}
+	if peerID == nil {
+		peerID = new(string)
+	}
+	return s.fsNode.GetReputations(*peerID)
+}
+
+func (s *P2PService) SearchFiles(query string, filters *FileShareSearchFilters) ([]FileShareSearchResult, error) {
+	if s.username == nil || s.fsNode == nil {
+		log.Printf("Attempted to search files when not logged in\n")
+		return nil, notLoggedIn
+	}
+	if filters == nil {
+		filters = &FileShareSearchFilters{}
+	}
+	return s.fsNode.SearchFiles(context.Background(), query, *filters)
+}
+
 func (s *P2PService) DiscoverFile(reqCid string) (*FileShareFileDiscoveryInfo, error) {
 	if s.username == nil || s.fsNode == nil {
 		log.Printf("Attempted to discover file when not logged in\n")
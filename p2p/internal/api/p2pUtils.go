@@ -486,6 +486,9 @@ func (s *P2PStream) ReadString(delim byte, timeout time.Duration) (string, error
 		if err == context.DeadlineExceeded {
 			return "", timeoutError
 		}
+		if err == io.EOF {
+			return "", streamClosed
+		}
 		return "", internalError
 	}
 	return str, nil
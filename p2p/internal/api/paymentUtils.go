@@ -0,0 +1,368 @@
+package api
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "math"
+    "time"
+    "bytes"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Settings of the wallet backend that payments for our files are checked against
+const fileShareWalletRPCHostSetting = "wallet_rpc_host"
+const fileShareWalletRPCUserSetting = "wallet_rpc_user"
+//Only kept by older versions, the password is no longer stored
+const fileShareWalletRPCPasswordSetting = "wallet_rpc_password"
+const fileShareMinConfirmationsSetting = "min_confirmations"
+//The RPC password is read from the environment so it is never written to the database
+const fileShareWalletRPCPasswordEnv = "P2P_WALLET_RPC_PASSWORD"
+//Default host matches the btcwallet run by the btcd service, there are no default credentials
+const fileShareDefaultWalletRPCHost = "localhost:8332"
+const fileShareDefaultMinConfirmations = 1
+const fileShareWalletRPCTimeout = time.Second * 10
+//Amounts are compared in satoshis so prices don't need to match to the last float bit
+const satoshisPerCoin = 1e8
+
+type FileSharePaymentSettings struct {
+    WalletRPCHost string        `json:"wallet_rpc_host"`
+    WalletRPCUser string        `json:"wallet_rpc_user"`
+    MinConfirmations int        `json:"min_confirmations"`
+    walletRPCPassword string
+}
+
+//Payment a peer made for one of our files. A transaction can only pay for one file, for one peer.
+type FileSharePayment struct {
+    TxID string             `json:"tx_id"`
+    PayerID string          `json:"payer_id"`
+    Cid string              `json:"cid"`
+    Amount float64          `json:"amount"`
+    Confirmations int64     `json:"confirmations"`
+    Timestamp string        `json:"timestamp"`
+}
+
+//Result of the gettransaction call of the wallet, only the fields we need
+type walletTransaction struct {
+    Confirmations int64                 `json:"confirmations"`
+    Details []walletTransactionDetail   `json:"details"`
+}
+
+type walletTransactionDetail struct {
+    Address string          `json:"address"`
+    Category string         `json:"category"`
+    Amount float64          `json:"amount"`
+}
+
+func toSatoshis(amount float64) int64 {
+    return int64(math.Round(amount * satoshisPerCoin))
+}
+
+func (f *FileShareNode) loadPaymentSettings() {
+    settings := FileSharePaymentSettings{
+        WalletRPCHost: fileShareDefaultWalletRPCHost,
+        MinConfirmations: fileShareDefaultMinConfirmations,
+        walletRPCPassword: os.Getenv(fileShareWalletRPCPasswordEnv),
+    }
+    peerID := f.host.ID().String()
+    //Don't leave a password stored by an older version in the database
+    dbRemoveSetting(nil, peerID, fileShareWalletRPCPasswordSetting)
+    for key, value := range map[string]*string{ fileShareWalletRPCHostSetting: &settings.WalletRPCHost,
+                                                fileShareWalletRPCUserSetting: &settings.WalletRPCUser } {
+        valueStr, err := dbGetSetting(nil, peerID, key)
+        if err == nil {
+            *value = valueStr
+        }
+    }
+    minConfirmationsStr, err := dbGetSetting(nil, peerID, fileShareMinConfirmationsSetting)
+    if err == nil {
+        settings.MinConfirmations, _ = strconv.Atoi(minConfirmationsStr)
+    }
+    f.paymentLock.Lock()
+    f.paymentSettings = settings
+    f.paymentLock.Unlock()
+}
+
+func (f *FileShareNode) GetPaymentSettings() FileSharePaymentSettings {
+    f.paymentLock.Lock()
+    defer f.paymentLock.Unlock()
+    return f.paymentSettings
+}
+
+//The RPC password always comes from the environment
+func (f *FileShareNode) SetPaymentSettings(settings FileSharePaymentSettings) error {
+    if settings.WalletRPCHost == "" || settings.WalletRPCUser == "" || settings.MinConfirmations < 0 {
+        return invalidParams
+    }
+    f.paymentLock.Lock()
+    defer f.paymentLock.Unlock()
+    settings.walletRPCPassword = f.paymentSettings.walletRPCPassword
+    peerID := f.host.ID().String()
+    for key, value := range map[string]string{ fileShareWalletRPCHostSetting: settings.WalletRPCHost,
+                                               fileShareWalletRPCUserSetting: settings.WalletRPCUser,
+                                               fileShareMinConfirmationsSetting: strconv.Itoa(settings.MinConfirmations) } {
+        err := dbSetSetting(nil, peerID, key, value)
+        if err != nil {
+            return err
+        }
+    }
+    f.paymentSettings = settings
+    log.Printf("Payments are checked against wallet at %v with %d confirmations required\n",
+               settings.WalletRPCHost, settings.MinConfirmations)
+    return nil
+}
+
+func (f *FileShareNode) GetPayments() ([]FileSharePayment, error) {
+    return dbGetPayments(nil, f.host.ID().String())
+}
+
+//Looks a transaction up in our wallet over its JSON-RPC interface
+//Payments aren't checked until the RPC user and password are set
+//Caller must hold paymentLock
+func (f *FileShareNode) walletGetTransaction(txID string) (*walletTransaction, error) {
+    if f.paymentSettings.WalletRPCUser == "" || f.paymentSettings.walletRPCPassword == "" {
+        log.Printf("Can't check payments until the wallet RPC user and %v are set\n", fileShareWalletRPCPasswordEnv)
+        return nil, walletUnavailable
+    }
+    reqBytes, err := json.Marshal(map[string]interface{}{
+        "jsonrpc": "1.0",
+        "id": 0,
+        "method": "gettransaction",
+        "params": []string{ txID },
+    })
+    if err != nil {
+        return nil, internalError
+    }
+    req, err := http.NewRequest(http.MethodPost, "http://" + f.paymentSettings.WalletRPCHost, bytes.NewReader(reqBytes))
+    if err != nil {
+        log.Printf("Failed to create wallet request. %v\n", err)
+        return nil, walletUnavailable
+    }
+    req.SetBasicAuth(f.paymentSettings.WalletRPCUser, f.paymentSettings.walletRPCPassword)
+    req.Header.Set("Content-Type", "application/json")
+
+    client := http.Client{ Timeout: fileShareWalletRPCTimeout }
+    resp, err := client.Do(req)
+    if err != nil {
+        log.Printf("Failed to reach wallet. %v\n", err)
+        return nil, walletUnavailable
+    }
+    defer resp.Body.Close()
+
+    var rpcResp struct {
+        Result *walletTransaction   `json:"result"`
+        Error *struct {
+            Code int                `json:"code"`
+            Message string          `json:"message"`
+        }                           `json:"error"`
+    }
+    err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+    if err != nil {
+        log.Printf("Failed to decode wallet response (status %v). %v\n", resp.Status, err)
+        return nil, walletUnavailable
+    }
+    if rpcResp.Error != nil {
+        log.Printf("Wallet could not look up transaction %v. %v\n", txID, rpcResp.Error.Message)
+        return nil, paymentNotFound
+    }
+    if rpcResp.Result == nil {
+        return nil, paymentNotFound
+    }
+    return rpcResp.Result, nil
+}
+
+//Checks that a transaction pays our wallet at least the price of the file and records it for the payer
+//Paying again with a transaction the payer already used for the same file is accepted
+//Nothing ties the transaction to the payer, so whoever presents it first gets the file. Payers must keep
+//the transaction ID to themselves until it is redeemed.
+func (f *FileShareNode) redeemPayment(payerID peer.ID, c cid.Cid, txID string) error {
+    f.mstoreLock.Lock()
+    fileMeta, ok := f.mstore[c]
+    f.mstoreLock.Unlock()
+    if !ok {
+        return contentNotFound
+    }
+    if fileMeta.Price <= 0 {
+        return nil
+    }
+
+    //Only one payment is checked at a time so a transaction can't be redeemed twice
+    f.paymentLock.Lock()
+    defer f.paymentLock.Unlock()
+    payment, err := dbGetPayment(nil, f.host.ID().String(), txID)
+    if err == nil {
+        if payment.PayerID == payerID.String() && payment.Cid == c.String() {
+            return nil
+        }
+        return paymentAlreadyUsed
+    }
+    if err != paymentNotFound {
+        return err
+    }
+
+    f.walletLock.Lock()
+    walletAddress := f.walletAddress
+    f.walletLock.Unlock()
+    if walletAddress == "" {
+        log.Printf("Can't accept payments without a wallet address\n")
+        return walletUnavailable
+    }
+    tx, err := f.walletGetTransaction(txID)
+    if err != nil {
+        return err
+    }
+    amount := float64(0)
+    for _, detail := range tx.Details {
+        if detail.Category == "receive" && detail.Address == walletAddress {
+            amount += detail.Amount
+        }
+    }
+    if toSatoshis(amount) < toSatoshis(fileMeta.Price) {
+        log.Printf("Transaction %v pays %v of %v for %v\n", txID, amount, fileMeta.Price, c)
+        return paymentTooLow
+    }
+    if tx.Confirmations < int64(f.paymentSettings.MinConfirmations) {
+        log.Printf("Transaction %v has %d of %d confirmations\n", txID, tx.Confirmations, f.paymentSettings.MinConfirmations)
+        return paymentUnconfirmed
+    }
+
+    return dbAddPayment(nil, f.host.ID().String(), FileSharePayment{
+        TxID: txID,
+        PayerID: payerID.String(),
+        Cid: c.String(),
+        Amount: amount,
+        Confirmations: tx.Confirmations,
+        Timestamp: time.Now().UTC().Format(time.RFC3339),
+    })
+}
+
+//Whether a peer may download a file. Free files can be downloaded by anyone, and paying for a directory
+//pays for every entry in it.
+func (f *FileShareNode) hasPaid(payerID peer.ID, c cid.Cid) bool {
+    f.mstoreLock.Lock()
+    fileMeta, ok := f.mstore[c]
+    f.mstoreLock.Unlock()
+    if !ok || fileMeta.Price <= 0 {
+        return true
+    }
+    paidCids, err := dbGetPaidCids(nil, f.host.ID().String(), payerID.String())
+    if err != nil {
+        return false
+    }
+    for _, paidCidStr := range paidCids {
+        if paidCidStr == c.String() {
+            return true
+        }
+        paidCid, err := cid.Decode(paidCidStr)
+        if err != nil {
+            continue
+        }
+        manifest := f.getManifest(paidCid)
+        if manifest == nil {
+            continue
+        }
+        for _, entry := range manifest.Entries {
+            if entry.Cid == c {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+//Tells the requester what to pay and where, in reply to a request for data that isn't paid for
+func (f *FileShareNode) sendPaymentRequired(stream *P2PStream, c cid.Cid) error {
+    f.mstoreLock.Lock()
+    fileMeta := f.mstore[c]
+    f.mstoreLock.Unlock()
+    f.walletLock.Lock()
+    walletAddress := f.walletAddress
+    f.walletLock.Unlock()
+    return stream.SendString(fmt.Sprintf("PAYMENT REQUIRED\n%v\n%s\n", fileMeta.Price, walletAddress))
+}
+
+//Request:  "PAY\n<cid>\n<tx_id>\n"
+//Response: "PAID\n"
+//          "PAYMENT REJECTED\n<reason>\n" if the transaction doesn't pay for the file
+//          "DON'T HAVE\n"
+func (f *FileShareNode) handlePay(stream *P2PStream) error {
+    cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    c, err := cid.Decode(cidStr[:len(cidStr) - 1])
+    if err != nil {
+        return err
+    }
+    txIDStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+
+    err = f.redeemPayment(stream.RemotePeerID, c, txIDStr[:len(txIDStr) - 1])
+    if err == contentNotFound {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    if err != nil {
+        log.Printf("Rejected payment from %v for %v. %v\n", stream.RemotePeerID, c, err)
+        return stream.SendString("PAYMENT REJECTED\n" + err.Error() + "\n")
+    }
+    return stream.SendString("PAID\n")
+}
+
+//Proves to a provider that we paid for the file of the session, once per provider
+//Does nothing if no transaction was given for the session
+//Caller must hold the request lock of the peer
+func (s *FileShareSession) SendPay(peerID peer.ID) error {
+    s.statsLock.Lock()
+    txID := s.txID
+    paid := s.paidPeers[peerID]
+    s.statsLock.Unlock()
+    if txID == "" || paid {
+        return nil
+    }
+
+    err := s.sendString(peerID, fmt.Sprintf("PAY\n%s\n%s\n", s.ReqCid, txID))
+    if err != nil {
+        return err
+    }
+    resp, err := s.readString(peerID, '\n', fileShareWalletRPCTimeout + fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    switch resp {
+        case "PAID\n":
+            s.statsLock.Lock()
+            s.paidPeers[peerID] = true
+            s.statsLock.Unlock()
+            return nil
+        case "PAYMENT REJECTED\n":
+            reason, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+            if err != nil {
+                return err
+            }
+            log.Printf("Provider %v rejected transaction %v. %v", peerID, txID, reason)
+            return paymentRejected
+        case "DON'T HAVE\n":
+            return contentNotFound
+    }
+    return unexpectedResponse
+}
+
+//Reads the rest of a PAYMENT REQUIRED response of the form PAYMENT REQUIRED\n<price>\n<wallet_address>\n
+func (s *FileShareSession) readPaymentRequired(peerID peer.ID) {
+    priceStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return
+    }
+    walletAddress, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return
+    }
+    log.Printf("Provider %v requires a payment of %v to %v\n", peerID, priceStr[:len(priceStr) - 1],
+               walletAddress[:len(walletAddress) - 1])
+}
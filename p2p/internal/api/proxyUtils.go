@@ -182,6 +182,7 @@ func (pn *ProxyNode) ConnectToProxy(proxyPeerID peer.ID) error {
 
 	pn.connected = true
 	pn.proxyPeerID = proxyPeerID
+	events.publish(eventProxy, ProxyEvent{PeerID: proxyPeerID.String(), Role: "proxy", Connected: true})
 	return nil
 }
 
@@ -192,6 +193,7 @@ func (pn *ProxyNode) DisconnectFromProxy() error {
 	if !pn.connected {
 		return fmt.Errorf("Not connected to a proxy")
 	}
+	events.publish(eventProxy, ProxyEvent{PeerID: pn.proxyPeerID.String(), Role: "proxy", Connected: false})
 	stream, err := p2pOpenStream(context.Background(), proxyProtocol, pn.host, pn.kadDHT, pn.proxyPeerID.String())
 	if err != nil {
 		pn.connected = false
@@ -233,11 +235,13 @@ func (pn *ProxyNode) proxyStreamHandler(s network.Stream) {
 		pn.proxyLock.Lock()
 		pn.clients[stream.RemotePeerID] = true
 		pn.proxyLock.Unlock()
+		events.publish(eventProxy, ProxyEvent{PeerID: stream.RemotePeerID.String(), Role: "client", Connected: true})
 
 	case "DISCONNECT\n":
 		pn.proxyLock.Lock()
 		pn.clients[stream.RemotePeerID] = false
 		pn.proxyLock.Unlock()
+		events.publish(eventProxy, ProxyEvent{PeerID: stream.RemotePeerID.String(), Role: "client", Connected: false})
 		return
 	default:
 		return
@@ -0,0 +1,275 @@
+package api
+
+import (
+    "log"
+    "time"
+    "sync"
+    "strconv"
+)
+
+//Setting holding the maximum number of downloads transferring at once, 0 means unlimited
+const fileShareMaxActiveDownloadsSetting = "max_active_downloads"
+const fileShareDefaultMaxActiveDownloads = 3
+
+//Downloads wait in the queue until fewer than maxActive downloads are transferring.
+//The queue is kept in the order jobs will start in. New jobs go after every job of the same or higher
+//priority, but the order can be changed freely afterwards.
+type fileShareQueue struct {
+    lock sync.Mutex
+    cond *sync.Cond
+    maxActive int
+    active int
+    queued []*FileShareSession
+}
+
+func newFileShareQueue() *fileShareQueue {
+    q := &fileShareQueue{
+        lock: sync.Mutex{},
+        maxActive: fileShareDefaultMaxActiveDownloads,
+        active: 0,
+        queued: []*FileShareSession{},
+    }
+    q.cond = sync.NewCond(&q.lock)
+    return q
+}
+
+//Caller must hold lock
+func (q *fileShareQueue) indexOf(session *FileShareSession) int {
+    for i, queuedSession := range q.queued {
+        if queuedSession == session {
+            return i
+        }
+    }
+    return -1
+}
+
+//Caller must hold lock
+func (q *fileShareQueue) insert(session *FileShareSession) {
+    i := 0
+    for ; i < len(q.queued); i ++ {
+        if q.queued[i].getPriority() < session.getPriority() {
+            break
+        }
+    }
+    q.queued = append(q.queued[:i], append([]*FileShareSession{ session }, q.queued[i:]...)...)
+}
+
+//Caller must hold lock
+func (q *fileShareQueue) remove(i int) {
+    q.queued = append(q.queued[:i], q.queued[i + 1:]...)
+}
+
+//Blocks until the session may start transferring
+//Returns false if the session was cancelled instead, in which case done must not be called
+func (q *fileShareQueue) wait(session *FileShareSession) bool {
+    q.lock.Lock()
+    defer q.lock.Unlock()
+    if session.isCancelled() {
+        return false
+    }
+    if len(q.queued) == 0 && (q.maxActive == 0 || q.active < q.maxActive) {
+        q.active ++
+        session.startTransfer()
+        return true
+    }
+    session.setQueued(true)
+    q.insert(session)
+    for {
+        i := q.indexOf(session)
+        if i < 0 {
+            return false
+        }
+        if i == 0 && (q.maxActive == 0 || q.active < q.maxActive) {
+            break
+        }
+        q.cond.Wait()
+    }
+    q.remove(0)
+    q.active ++
+    session.setQueued(false)
+    session.startTransfer()
+    //The next job may be able to start too
+    q.cond.Broadcast()
+    return true
+}
+
+//Takes a session out of the queue. Returns false if it was not queued.
+func (q *fileShareQueue) cancel(session *FileShareSession) bool {
+    q.lock.Lock()
+    defer q.lock.Unlock()
+    i := q.indexOf(session)
+    if i < 0 {
+        return false
+    }
+    q.remove(i)
+    session.setQueued(false)
+    q.cond.Broadcast()
+    return true
+}
+
+//Called once a session that was allowed to start has finished transferring
+func (q *fileShareQueue) done() {
+    q.lock.Lock()
+    q.active --
+    q.lock.Unlock()
+    q.cond.Broadcast()
+}
+
+func (q *fileShareQueue) setMaxActive(maxActive int) {
+    q.lock.Lock()
+    q.maxActive = maxActive
+    q.lock.Unlock()
+    q.cond.Broadcast()
+}
+
+func (s *FileShareSession) getPriority() int {
+    s.statsLock.Lock()
+    defer s.statsLock.Unlock()
+    return s.Priority
+}
+
+//Time spent in the queue doesn't count towards the speed of a download
+func (s *FileShareSession) startTransfer() {
+    s.statsLock.Lock()
+    s.transferStart = time.Now()
+    s.statsLock.Unlock()
+}
+
+func (s *FileShareSession) setQueued(queued bool) {
+    s.statsLock.Lock()
+    s.Queued = queued
+    s.statsLock.Unlock()
+}
+
+func (f *FileShareNode) loadMaxActiveDownloads() {
+    maxActiveStr, err := dbGetSetting(nil, f.host.ID().String(), fileShareMaxActiveDownloadsSetting)
+    if err != nil {
+        return
+    }
+    maxActive, err := strconv.Atoi(maxActiveStr)
+    if err != nil || maxActive < 0 {
+        log.Printf("Ignoring invalid maximum number of active downloads '%v'\n", maxActiveStr)
+        return
+    }
+    f.queue.setMaxActive(maxActive)
+}
+
+func (f *FileShareNode) GetMaxActiveDownloads() int {
+    f.queue.lock.Lock()
+    defer f.queue.lock.Unlock()
+    return f.queue.maxActive
+}
+
+//Sets how many downloads may transfer at once, 0 for no limit
+//Downloads already transferring are not stopped if the limit is lowered
+func (f *FileShareNode) SetMaxActiveDownloads(maxActive int) error {
+    if maxActive < 0 {
+        return invalidParams
+    }
+    err := dbSetSetting(nil, f.host.ID().String(), fileShareMaxActiveDownloadsSetting, strconv.Itoa(maxActive))
+    if err != nil {
+        return err
+    }
+    f.queue.setMaxActive(maxActive)
+    return nil
+}
+
+//Lists queued downloads in the order they will start
+func (f *FileShareNode) GetQueue() []*FileShareSession {
+    f.queue.lock.Lock()
+    queued := make([]*FileShareSession, len(f.queue.queued))
+    copy(queued, f.queue.queued)
+    f.queue.lock.Unlock()
+
+    sessions := make([]*FileShareSession, 0, len(queued))
+    for _, session := range queued {
+        sessionCpy, err := f.GetSession(session.SessionID)
+        if err == nil {
+            sessions = append(sessions, sessionCpy)
+        }
+    }
+    return sessions
+}
+
+//Changes the priority of a download. A queued download is moved behind the jobs of the same or higher priority.
+func (f *FileShareNode) SetPriority(sessionID int, priority int) error {
+    session, ok := f.getSessionRef(sessionID)
+    if !ok {
+        return sessionNotFound
+    }
+    f.queue.lock.Lock()
+    defer f.queue.lock.Unlock()
+    session.statsLock.Lock()
+    session.Priority = priority
+    session.statsLock.Unlock()
+    i := f.queue.indexOf(session)
+    if i >= 0 {
+        f.queue.remove(i)
+        f.queue.insert(session)
+        f.queue.cond.Broadcast()
+    }
+    return nil
+}
+
+//Moves a queued download one place towards the front, or back if demoting.
+//The download takes on the priority of the job it overtakes, so later jobs keep their place relative to it.
+func (f *FileShareNode) MoveInQueue(sessionID int, promote bool) error {
+    session, ok := f.getSessionRef(sessionID)
+    if !ok {
+        return sessionNotFound
+    }
+    f.queue.lock.Lock()
+    defer f.queue.lock.Unlock()
+    i := f.queue.indexOf(session)
+    if i < 0 {
+        return sessionNotQueued
+    }
+    j := i + 1
+    if promote {
+        j = i - 1
+    }
+    if j < 0 || j >= len(f.queue.queued) {
+        return nil
+    }
+    other := f.queue.queued[j]
+    otherPriority := other.getPriority()
+    session.statsLock.Lock()
+    if (promote && session.Priority < otherPriority) || (!promote && session.Priority > otherPriority) {
+        session.Priority = otherPriority
+    }
+    session.statsLock.Unlock()
+    f.queue.queued[i], f.queue.queued[j] = other, session
+    f.queue.cond.Broadcast()
+    return nil
+}
+
+//Puts queued downloads in the given order. Listed downloads go first, the rest keep their order after them.
+func (f *FileShareNode) ReorderQueue(sessionIDs []int) error {
+    f.queue.lock.Lock()
+    defer f.queue.lock.Unlock()
+    reordered := make([]*FileShareSession, 0, len(f.queue.queued))
+    listed := make(map[*FileShareSession]bool)
+    for _, sessionID := range sessionIDs {
+        session, ok := f.getSessionRef(sessionID)
+        if !ok || f.queue.indexOf(session) < 0 || listed[session] {
+            return sessionNotQueued
+        }
+        reordered = append(reordered, session)
+        listed[session] = true
+    }
+    for _, session := range f.queue.queued {
+        if !listed[session] {
+            reordered = append(reordered, session)
+        }
+    }
+    f.queue.queued = reordered
+    f.queue.cond.Broadcast()
+    return nil
+}
+
+func (f *FileShareNode) getSessionRef(sessionID int) (*FileShareSession, bool) {
+    f.sessionStoreLock.Lock()
+    defer f.sessionStoreLock.Unlock()
+    session, ok := f.sessionStore[sessionID]
+    return session, ok
+}
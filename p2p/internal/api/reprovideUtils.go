@@ -0,0 +1,186 @@
+package api
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "context"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Provider records expire after about a day, so everything we share is announced again well before then
+const fileShareReprovideInterval = time.Hour * 12
+//How often the reprovider wakes up. CIDs whose last announce failed are retried this often.
+const fileShareReprovideCheckInterval = time.Minute * 10
+//CIDs are announced this many at a time, so large collections don't flood the DHT
+const fileShareReprovideBatchSize = 16
+const fileShareProvideTimeout = time.Minute
+
+type FileShareProvideStatus struct {
+    Cid string              `json:"cid"`
+    //Empty if the CID was never announced successfully
+    LastAnnounce string     `json:"last_announce"`
+    LastAttempt string      `json:"last_attempt"`
+    NextAnnounce string     `json:"next_announce"`
+    //Failures since the last successful announce
+    Failures int            `json:"failures"`
+    TotalFailures int       `json:"total_failures"`
+    LastError string        `json:"last_error"`
+    lastAnnounce time.Time
+    lastAttempt time.Time
+}
+
+//Caller must hold provideLock
+func (s *FileShareProvideStatus) due(now time.Time) time.Time {
+    if s.Failures > 0 {
+        return s.lastAttempt.Add(fileShareReprovideCheckInterval)
+    }
+    return s.lastAnnounce.Add(fileShareReprovideInterval)
+}
+
+//Announces that we provide a CID and records the outcome for the reprovider
+func (f *FileShareNode) provide(ctx context.Context, c cid.Cid) error {
+    timeoutCtx, cancel := context.WithTimeout(ctx, fileShareProvideTimeout)
+    err := f.kadDHT.Provide(timeoutCtx, c, true)
+    cancel()
+
+    now := time.Now()
+    f.provideLock.Lock()
+    defer f.provideLock.Unlock()
+    status, ok := f.provideStatus[c]
+    if !ok {
+        status = &FileShareProvideStatus{ Cid: c.String() }
+        f.provideStatus[c] = status
+    }
+    status.lastAttempt = now
+    status.LastAttempt = now.UTC().Format(time.RFC3339)
+    if err != nil {
+        status.Failures ++
+        status.TotalFailures ++
+        status.LastError = err.Error()
+        log.Printf("Failed to provide cid %v. %v\n", c, err)
+        return err
+    }
+    status.lastAnnounce = now
+    status.LastAnnounce = status.LastAttempt
+    status.Failures = 0
+    status.LastError = ""
+    return nil
+}
+
+//CIDs of the files and directories we share
+func (f *FileShareNode) sharedCids() []cid.Cid {
+    cids := []cid.Cid{}
+    f.fstoreLock.Lock()
+    for c := range f.fstore {
+        cids = append(cids, c)
+    }
+    f.fstoreLock.Unlock()
+
+    f.bstoreLock.Lock()
+    roots := make([]cid.Cid, 0, len(f.bstore))
+    for c := range f.bstore {
+        roots = append(roots, c)
+    }
+    f.bstoreLock.Unlock()
+    for _, c := range roots {
+        if f.getManifest(c) != nil {
+            cids = append(cids, c)
+        }
+    }
+    return cids
+}
+
+//Announces the shared CIDs that are due, a batch at a time, and forgets about CIDs no longer shared
+func (f *FileShareNode) reprovide(ctx context.Context) {
+    now := time.Now()
+    shared := make(map[cid.Cid]bool)
+    due := []cid.Cid{}
+    cids := f.sharedCids()
+    f.provideLock.Lock()
+    for _, c := range cids {
+        shared[c] = true
+        status, ok := f.provideStatus[c]
+        if !ok || !status.due(now).After(now) {
+            due = append(due, c)
+        }
+    }
+    for c := range f.provideStatus {
+        if !shared[c] {
+            delete(f.provideStatus, c)
+        }
+    }
+    f.provideLock.Unlock()
+    if len(due) == 0 {
+        return
+    }
+
+    log.Printf("Reproviding %d cids\n", len(due))
+    failures := 0
+    failuresLock := sync.Mutex{}
+    for start := 0; start < len(due); start += fileShareReprovideBatchSize {
+        if ctx.Err() != nil {
+            return
+        }
+        end := min(start + fileShareReprovideBatchSize, len(due))
+        var wg sync.WaitGroup
+        for _, c := range due[start:end] {
+            wg.Add(1)
+            go func(c cid.Cid) {
+                defer wg.Done()
+                if f.provide(ctx, c) != nil {
+                    failuresLock.Lock()
+                    failures ++
+                    failuresLock.Unlock()
+                }
+            }(c)
+        }
+        wg.Wait()
+    }
+    log.Printf("Reprovided %d cids, %d failed\n", len(due), failures)
+}
+
+//Runs until the node is closed
+func (f *FileShareNode) runReprovider(ctx context.Context) {
+    ticker := time.NewTicker(fileShareReprovideCheckInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <- ctx.Done():
+                return
+            case <- ticker.C:
+                f.checkSources()
+                f.reprovide(ctx)
+        }
+    }
+}
+
+//Stops the background work of the node
+func (f *FileShareNode) Close() {
+    f.stop()
+}
+
+//Lists when each shared CID was last announced and how announcing it went
+func (f *FileShareNode) GetProvideStatus() []FileShareProvideStatus {
+    now := time.Now()
+    statuses := []FileShareProvideStatus{}
+    cids := f.sharedCids()
+    f.provideLock.Lock()
+    for _, c := range cids {
+        status, ok := f.provideStatus[c]
+        if !ok {
+            //Never attempted, the reprovider picks it up on its next run
+            statuses = append(statuses, FileShareProvideStatus{ Cid: c.String() })
+            continue
+        }
+        statusCpy := *status
+        statusCpy.NextAnnounce = status.due(now).UTC().Format(time.RFC3339)
+        statuses = append(statuses, statusCpy)
+    }
+    f.provideLock.Unlock()
+    sort.Slice(statuses, func(i int, j int) bool {
+        return statuses[i].Cid < statuses[j].Cid
+    })
+    return statuses
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+    "log"
+    "math"
+    "sort"
+    "time"
+    "github.com/libp2p/go-libp2p/core/peer"
+)
+
+//Weights of the parts of a provider's score
+const reputationReliabilityWeight = 0.6
+const reputationThroughputWeight = 0.25
+const reputationLatencyWeight = 0.15
+//A transfer that fails integrity checks counts as this many failures
+const reputationIntegrityPenalty = 3
+//Throughput that earns the full throughput part of the score, in bytes per second
+const reputationFullThroughput = 10 * 1024 * 1024
+
+//Outcomes of our downloads from a provider
+type FileShareReputation struct {
+    PeerID string                   `json:"peer_id"`
+    Successes int                   `json:"successes"`
+    Failures int                    `json:"failures"`
+    IntegrityFailures int           `json:"integrity_failures"`
+    RxBytes int64                   `json:"rx_bytes"`
+    //Seconds spent receiving data from the provider
+    TransferTime float64            `json:"transfer_time"`
+    //Bytes per second, 0 if nothing was received
+    Throughput float64              `json:"throughput"`
+    //Average seconds between asking for data and the provider answering, 0 if never measured
+    Latency float64                 `json:"latency"`
+    LatencySamples int              `json:"latency_samples"`
+    //Between 0 and 100, providers we know nothing about score 50
+    Score float64                   `json:"score"`
+    LastSeen string                 `json:"last_seen"`
+    latencyTotal float64
+}
+
+//What a session observed of one provider
+type fileShareProviderSample struct {
+    rxBytes int64
+    transferStart time.Time
+    lastReceived time.Time
+    latencyTotal time.Duration
+    latencySamples int
+    //Set when the outcome for this provider differs from the outcome of the session
+    result *int
+}
+
+//Caller must hold statsLock
+func (s *FileShareSession) providerSample(peerID peer.ID) *fileShareProviderSample {
+    sample, ok := s.providerSamples[peerID]
+    if !ok {
+        sample = &fileShareProviderSample{}
+        s.providerSamples[peerID] = sample
+    }
+    return sample
+}
+
+//Called before asking a provider for data, so it is judged by the outcome of the session even if it never answers
+func (s *FileShareSession) trackProvider(peerID peer.ID) {
+    s.statsLock.Lock()
+    s.providerSample(peerID)
+    s.statsLock.Unlock()
+}
+
+//Records how long a provider took to answer a request for data
+func (s *FileShareSession) recordLatency(peerID peer.ID, requested time.Time) {
+    latency := time.Since(requested)
+    s.statsLock.Lock()
+    defer s.statsLock.Unlock()
+    sample := s.providerSample(peerID)
+    sample.latencyTotal += latency
+    sample.latencySamples ++
+}
+
+//Called once the provider starts sending data. Caller must hold statsLock
+func (sample *fileShareProviderSample) startTransfer() {
+    if sample.transferStart.IsZero() {
+        sample.transferStart = time.Now()
+    }
+}
+
+//Caller must hold statsLock
+func (s *FileShareSession) recordReceived(peerID peer.ID, n int64) {
+    sample := s.providerSample(peerID)
+    sample.rxBytes += n
+    sample.lastReceived = time.Now()
+}
+
+//Records an outcome for a provider that overrides the outcome of the session, such as corrupt data
+//from one provider of a swarm. Integrity failures are never overridden.
+func (s *FileShareSession) setProviderResult(peerID peer.ID, result int) {
+    s.statsLock.Lock()
+    defer s.statsLock.Unlock()
+    sample := s.providerSample(peerID)
+    if sample.result == nil || *sample.result != -1 {
+        sample.result = &result
+    }
+}
+
+func (r *FileShareReputation) computeScore() {
+    r.Throughput = 0
+    if r.TransferTime > 0 {
+        r.Throughput = float64(r.RxBytes) / r.TransferTime
+    }
+    r.Latency = 0
+    if r.LatencySamples > 0 {
+        r.Latency = r.latencyTotal / float64(r.LatencySamples)
+    }
+
+    //Every provider starts with one success and one failure so a single outcome doesn't decide everything
+    reliability := float64(r.Successes + 1) / float64(r.Successes + r.Failures + reputationIntegrityPenalty * r.IntegrityFailures + 2)
+    throughput := 0.5
+    if r.TransferTime > 0 {
+        throughput = math.Min(1, math.Log1p(r.Throughput) / math.Log1p(reputationFullThroughput))
+    }
+    latency := 0.5
+    if r.LatencySamples > 0 {
+        latency = 1 / (1 + r.Latency)
+    }
+    //Being fast doesn't make up for being unreliable, so speed only counts fully for providers at least as
+    //reliable as one we know nothing about
+    performance := min(1, 2 * reliability) * (reputationThroughputWeight * throughput + reputationLatencyWeight * latency)
+    r.Score = 100 * (reputationReliabilityWeight * reliability + performance)
+}
+
+func (f *FileShareNode) loadReputations() {
+    reputations, err := dbGetReputations(nil, f.host.ID().String())
+    if err != nil {
+        return
+    }
+    f.reputationLock.Lock()
+    defer f.reputationLock.Unlock()
+    for _, reputation := range reputations {
+        peerID, err := peer.Decode(reputation.PeerID)
+        if err != nil {
+            continue
+        }
+        reputation.computeScore()
+        f.reputations[peerID] = reputation
+    }
+}
+
+//Adds what a finished session observed of each provider it used to their reputations
+//Cancelled sessions and providers that were only busy are left out
+func (f *FileShareNode) recordProviderOutcomes(session *FileShareSession) {
+    session.statsLock.Lock()
+    sessionResult := session.Result
+    samples := make(map[peer.ID]fileShareProviderSample)
+    for peerID, sample := range session.providerSamples {
+        _, busy := session.retryAfter[peerID]
+        if !busy || sample.rxBytes > 0 {
+            samples[peerID] = *sample
+        }
+    }
+    session.statsLock.Unlock()
+
+    timestamp := time.Now().UTC().Format(time.RFC3339)
+    for peerID, sample := range samples {
+        result := sessionResult
+        if sample.result != nil {
+            result = *sample.result
+        }
+        if result == fileShareResultCancelled {
+            continue
+        }
+
+        f.reputationLock.Lock()
+        reputation, ok := f.reputations[peerID]
+        if !ok {
+            reputation = &FileShareReputation{ PeerID: peerID.String() }
+            f.reputations[peerID] = reputation
+        }
+        switch result {
+            case 0:
+                reputation.Successes ++
+            case -1:
+                reputation.IntegrityFailures ++
+            default:
+                reputation.Failures ++
+        }
+        if sample.rxBytes > 0 && sample.lastReceived.After(sample.transferStart) {
+            reputation.RxBytes += sample.rxBytes
+            reputation.TransferTime += sample.lastReceived.Sub(sample.transferStart).Seconds()
+        }
+        reputation.latencyTotal += sample.latencyTotal.Seconds()
+        reputation.LatencySamples += sample.latencySamples
+        reputation.LastSeen = timestamp
+        reputation.computeScore()
+        reputationCpy := *reputation
+        f.reputationLock.Unlock()
+
+        err := dbSetReputation(nil, f.host.ID().String(), reputationCpy)
+        if err != nil {
+            log.Printf("Failed to record reputation of %v\n", peerID)
+        }
+    }
+}
+
+//Score of a provider, 50 if we never downloaded from it
+func (f *FileShareNode) providerScore(peerID peer.ID) float64 {
+    f.reputationLock.Lock()
+    defer f.reputationLock.Unlock()
+    reputation, ok := f.reputations[peerID]
+    if !ok {
+        unknown := FileShareReputation{}
+        unknown.computeScore()
+        return unknown.Score
+    }
+    return reputation.Score
+}
+
+//Highest score first
+func sortProvidersByScore(providers []FileShareProvider) {
+    sort.SliceStable(providers, func(i int, j int) bool {
+        return providers[i].Score > providers[j].Score
+    })
+}
+
+//Reputations of every provider we downloaded from, or only of the given one if peerIDStr is set
+func (f *FileShareNode) GetReputations(peerIDStr string) ([]FileShareReputation, error) {
+    var filterID peer.ID
+    if peerIDStr != "" {
+        var err error
+        filterID, err = peer.Decode(peerIDStr)
+        if err != nil {
+            return nil, invalidParams
+        }
+    }
+    reputations := []FileShareReputation{}
+    f.reputationLock.Lock()
+    for peerID, reputation := range f.reputations {
+        if peerIDStr == "" || peerID == filterID {
+            reputations = append(reputations, *reputation)
+        }
+    }
+    f.reputationLock.Unlock()
+    sort.Slice(reputations, func(i int, j int) bool {
+        return reputations[i].Score > reputations[j].Score
+    })
+    return reputations, nil
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+    "os"
+    "log"
+    "time"
+    "context"
+    "encoding/hex"
+)
+
+//Persist progress of a sequential download at least every this many bytes
+const fileSharePersistInterval = 16 * 1024 * 1024
+
+//Download that has not completed yet. Progress is tracked as a bitmap of the ranges written to
+//<output_file>.tmp so the download can continue from where it stopped after a restart.
+type FileSharePartialDownload struct {
+    DownloadID int          `json:"download_id"`
+    Timestamp string        `json:"timestamp"`
+    FileShareFile
+    OutputFile string       `json:"output_file"`
+    RxBytes int64           `json:"rx_bytes"`
+    rangeSize int64
+    ranges []bool
+    //Ranges before this one are all complete, so markUpTo doesn't look at them again
+    markedUpTo int64
+}
+
+//Size of the ranges a download is split into. Ranges line up with blocks of the DAG if there is one.
+func fileShareRangeSize(dag *FileShareDag) int64 {
+    if dag != nil {
+        return dag.ChunkSize * int64(swarmRangeSize / chunkSize)
+    }
+    return int64(swarmRangeSize)
+}
+
+func newPartialDownload(providerID string, dataCid string, outputFile string, fileMeta FileShareMeta, rangeSize int64) *FileSharePartialDownload {
+    numRanges := (fileMeta.Size + rangeSize - 1) / rangeSize
+    return &FileSharePartialDownload{
+        DownloadID: -1,
+        Timestamp: time.Now().UTC().Format(time.RFC3339),
+        FileShareFile: FileShareFile{
+            FileShareMeta: fileMeta,
+            DataCid: dataCid,
+            ProviderID: providerID,
+        },
+        OutputFile: outputFile,
+        RxBytes: 0,
+        rangeSize: rangeSize,
+        ranges: make([]bool, numRanges),
+    }
+}
+
+func (d *FileSharePartialDownload) rangeLength(index int64) int64 {
+    return min(d.rangeSize, d.Size - index * d.rangeSize)
+}
+
+func (d *FileSharePartialDownload) markRange(index int64) {
+    if !d.ranges[index] {
+        d.ranges[index] = true
+        d.RxBytes += d.rangeLength(index)
+    }
+}
+
+//Marks every range that lies entirely before offset as complete
+func (d *FileSharePartialDownload) markUpTo(offset int64) {
+    for ; d.markedUpTo < int64(len(d.ranges)); d.markedUpTo ++ {
+        if d.markedUpTo * d.rangeSize + d.rangeLength(d.markedUpTo) > offset {
+            break
+        }
+        d.markRange(d.markedUpTo)
+    }
+}
+
+//Offset a sequential download should continue from
+func (d *FileSharePartialDownload) resumeOffset() int64 {
+    for index, done := range d.ranges {
+        if !done {
+            return int64(index) * d.rangeSize
+        }
+    }
+    return d.Size
+}
+
+func (d *FileSharePartialDownload) pendingRanges() []int64 {
+    pending := []int64{}
+    for index, done := range d.ranges {
+        if !done {
+            pending = append(pending, int64(index))
+        }
+    }
+    return pending
+}
+
+func (d *FileSharePartialDownload) encodeRanges() string {
+    bitmap := make([]byte, (len(d.ranges) + 7) / 8)
+    for index, done := range d.ranges {
+        if done {
+            bitmap[index / 8] |= 1 << (index % 8)
+        }
+    }
+    return hex.EncodeToString(bitmap)
+}
+
+func (d *FileSharePartialDownload) decodeRanges(rangesStr string) error {
+    bitmap, err := hex.DecodeString(rangesStr)
+    if err != nil || d.rangeSize <= 0 {
+        return invalidParams
+    }
+    numRanges := (d.Size + d.rangeSize - 1) / d.rangeSize
+    if int64(len(bitmap)) != (numRanges + 7) / 8 {
+        return invalidParams
+    }
+    d.ranges = make([]bool, numRanges)
+    d.RxBytes = 0
+    d.markedUpTo = 0
+    for index := int64(0); index < numRanges; index ++ {
+        if bitmap[index / 8] & (1 << (index % 8)) != 0 {
+            d.markRange(index)
+        }
+    }
+    return nil
+}
+
+//Records a new download in the database and marks it as active
+func (f *FileShareNode) addPartialDownload(partial *FileSharePartialDownload) error {
+    downloadID, err := dbAddPartialDownload(nil, f.host.ID().String(), partial)
+    if err != nil {
+        return err
+    }
+    partial.DownloadID = downloadID
+    f.claimPartialDownload(downloadID)
+    return nil
+}
+
+func (f *FileShareNode) savePartialDownload(partial *FileSharePartialDownload, rangesStr string) {
+    err := dbUpdatePartialDownload(nil, f.host.ID().String(), partial.DownloadID, rangesStr)
+    if err != nil {
+        log.Printf("Failed to save progress of download %d.\n", partial.DownloadID)
+    }
+}
+
+func (f *FileShareNode) savePartialDownloadProvider(partial *FileSharePartialDownload) {
+    err := dbSetPartialDownloadProvider(nil, f.host.ID().String(), partial.DownloadID, partial.ProviderID, partial.Price)
+    if err != nil {
+        log.Printf("Failed to save provider of download %d.\n", partial.DownloadID)
+    }
+}
+
+//Called when a download has stopped, either keeping its progress for later or discarding it
+func (f *FileShareNode) releasePartialDownload(partial *FileSharePartialDownload, keep bool) {
+    if keep {
+        f.savePartialDownload(partial, partial.encodeRanges())
+    } else {
+        dbRemovePartialDownload(nil, f.host.ID().String(), partial.DownloadID)
+    }
+    f.activeDownloadsLock.Lock()
+    delete(f.activeDownloads, partial.DownloadID)
+    f.activeDownloadsLock.Unlock()
+}
+
+//Returns false if the download is already active
+func (f *FileShareNode) claimPartialDownload(downloadID int) bool {
+    f.activeDownloadsLock.Lock()
+    defer f.activeDownloadsLock.Unlock()
+    if f.activeDownloads[downloadID] {
+        return false
+    }
+    f.activeDownloads[downloadID] = true
+    return true
+}
+
+//Lists downloads that stopped before completing and are not currently active
+func (f *FileShareNode) GetPartialDownloads() ([]FileSharePartialDownload, error) {
+    partials, err := dbGetPartialDownloads(nil, f.host.ID().String())
+    if err != nil {
+        return nil, err
+    }
+    inactive := make([]FileSharePartialDownload, 0, len(partials))
+    f.activeDownloadsLock.Lock()
+    for _, partial := range partials {
+        if !f.activeDownloads[partial.DownloadID] {
+            inactive = append(inactive, partial)
+        }
+    }
+    f.activeDownloadsLock.Unlock()
+    return inactive, nil
+}
+
+//Continues a download from where it stopped. Returns the session ID of the download
+func (f *FileShareNode) ResumeDownload(ctx context.Context, downloadID int) (int, error) {
+    partials, err := dbGetPartialDownloads(nil, f.host.ID().String())
+    if err != nil {
+        return -1, err
+    }
+    for i, partial := range partials {
+        if partial.DownloadID != downloadID {
+            continue
+        }
+        if !f.claimPartialDownload(downloadID) {
+            return -1, downloadInProgress
+        }
+        //Downloads without a single provider were swarmed
+        if partial.ProviderID == "" {
+            return f.getFileSwarm(ctx, partial.DataCid, partial.OutputFile, &partials[i], 0)
+        }
+        return f.getFile(ctx, partial.ProviderID, partial.DataCid, partial.OutputFile, &partials[i], 0, "", "", f.GetSeedSettings())
+    }
+    return -1, downloadNotFound
+}
+
+//Drops records of partial downloads whose temporary file no longer exists
+func (f *FileShareNode) loadPartialDownloads() {
+    partials, err := dbGetPartialDownloads(nil, f.host.ID().String())
+    if err != nil {
+        return
+    }
+    count := 0
+    for _, partial := range partials {
+        _, err := os.Stat(partial.OutputFile + ".tmp")
+        if err != nil {
+            dbRemovePartialDownload(nil, f.host.ID().String(), partial.DownloadID)
+            continue
+        }
+        count ++
+    }
+    if count > 0 {
+        log.Printf("Found %d unfinished download(s) that can be resumed\n", count)
+    }
+}
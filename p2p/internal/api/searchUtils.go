@@ -0,0 +1,509 @@
+package api
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "context"
+    "strings"
+    "strconv"
+    "unicode"
+    "encoding/json"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Most results returned for a search, by us and by peers we ask
+const fileShareMaxSearchResults = 100
+//How long we wait for peers to answer a search
+const fileShareSearchTimeout = time.Second * 10
+//Peers asked at once
+const fileShareSearchWorkers = 16
+const fileShareMaxSearchRequestSize = 64 * 1024
+const fileShareMaxSearchResponseSize = 4 * 1024 * 1024
+//Providers learned from discovery are forgotten if not seen again within this long
+const fileShareSearchIndexTTL = time.Hour * 24
+
+//Weight of a query word matching each field
+const fileShareSearchNameWeight = 3
+const fileShareSearchTagWeight = 2
+const fileShareSearchDescriptionWeight = 1
+
+//Unset bounds don't filter
+type FileShareSearchFilters struct {
+    MinPrice *float64       `json:"min_price"`
+    MaxPrice *float64       `json:"max_price"`
+    MinSize *int64          `json:"min_size"`
+    MaxSize *int64          `json:"max_size"`
+    MinProviders int        `json:"min_providers"`
+}
+
+type FileShareSearchResult struct {
+    FileShareFileDiscoveryInfo
+    Score int               `json:"score"`
+}
+
+type fileShareSearchRequest struct {
+    Query string                    `json:"query"`
+    Filters FileShareSearchFilters  `json:"filters"`
+    MaxResults int                  `json:"max_results"`
+}
+
+type fileShareIndexProvider struct {
+    FileShareProvider
+    seen time.Time
+}
+
+type fileShareIndexEntry struct {
+    size int64
+    providers map[peer.ID]*fileShareIndexProvider
+    tokens []string
+}
+
+//Inverted index over the names, tags and descriptions of the files we share and the files we discovered
+type fileShareSearchIndex struct {
+    lock sync.Mutex
+    entries map[cid.Cid]*fileShareIndexEntry
+    tokens map[string]map[cid.Cid]bool
+}
+
+func newFileShareSearchIndex() *fileShareSearchIndex {
+    return &fileShareSearchIndex{
+        lock: sync.Mutex{},
+        entries: make(map[cid.Cid]*fileShareIndexEntry),
+        tokens: make(map[string]map[cid.Cid]bool),
+    }
+}
+
+//Lowercased words of a text, without punctuation
+func searchTokens(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+func (p *FileShareProvider) searchFields() [][]string {
+    tags := []string{}
+    for _, tag := range p.Tags {
+        tags = append(tags, searchTokens(tag)...)
+    }
+    return [][]string{ searchTokens(p.Name), tags, searchTokens(p.Description) }
+}
+
+//Adds up the weight of the best field each query word matched
+//Returns false if some query word matched none of the provider's fields
+func (p *FileShareProvider) searchScore(queryTokens []string) (int, bool) {
+    weights := []int{ fileShareSearchNameWeight, fileShareSearchTagWeight, fileShareSearchDescriptionWeight }
+    fields := p.searchFields()
+    score := 0
+    matchedAll := true
+    for _, queryToken := range queryTokens {
+        best := 0
+        for field, tokens := range fields {
+            for _, token := range tokens {
+                if strings.HasPrefix(token, queryToken) {
+                    best = max(best, weights[field])
+                    break
+                }
+            }
+        }
+        score += best
+        matchedAll = matchedAll && best > 0
+    }
+    return score, matchedAll
+}
+
+func (f *FileShareSearchFilters) validate() error {
+    if f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+        return invalidParams
+    }
+    if f.MinSize != nil && f.MaxSize != nil && *f.MinSize > *f.MaxSize {
+        return invalidParams
+    }
+    if f.MinProviders < 0 {
+        return invalidParams
+    }
+    return nil
+}
+
+func (f *FileShareSearchFilters) matchesPrice(price float64) bool {
+    return (f.MinPrice == nil || price >= *f.MinPrice) && (f.MaxPrice == nil || price <= *f.MaxPrice)
+}
+
+func (f *FileShareSearchFilters) matchesSize(size int64) bool {
+    return (f.MinSize == nil || size >= *f.MinSize) && (f.MaxSize == nil || size <= *f.MaxSize)
+}
+
+//Adds or refreshes a provider of a CID
+func (i *fileShareSearchIndex) add(c cid.Cid, size int64, provider FileShareProvider) {
+    i.lock.Lock()
+    defer i.lock.Unlock()
+    entry, ok := i.entries[c]
+    if !ok {
+        entry = &fileShareIndexEntry{ providers: make(map[peer.ID]*fileShareIndexProvider) }
+        i.entries[c] = entry
+    }
+    entry.size = size
+    entry.providers[provider.PeerID] = &fileShareIndexProvider{ FileShareProvider: provider, seen: time.Now() }
+    i.reindex(c, entry)
+}
+
+func (i *fileShareSearchIndex) remove(c cid.Cid, providerID peer.ID) {
+    i.lock.Lock()
+    defer i.lock.Unlock()
+    entry, ok := i.entries[c]
+    if !ok {
+        return
+    }
+    delete(entry.providers, providerID)
+    i.reindex(c, entry)
+}
+
+//Caller must hold lock
+func (i *fileShareSearchIndex) reindex(c cid.Cid, entry *fileShareIndexEntry) {
+    for _, token := range entry.tokens {
+        delete(i.tokens[token], c)
+        if len(i.tokens[token]) == 0 {
+            delete(i.tokens, token)
+        }
+    }
+    entry.tokens = nil
+    if len(entry.providers) == 0 {
+        delete(i.entries, c)
+        return
+    }
+    tokens := make(map[string]bool)
+    for _, provider := range entry.providers {
+        for _, field := range provider.searchFields() {
+            for _, token := range field {
+                tokens[token] = true
+            }
+        }
+    }
+    for token := range tokens {
+        if i.tokens[token] == nil {
+            i.tokens[token] = make(map[cid.Cid]bool)
+        }
+        i.tokens[token][c] = true
+        entry.tokens = append(entry.tokens, token)
+    }
+}
+
+//Forgets providers learned from discovery that haven't been seen in a while
+//Caller must hold lock
+func (i *fileShareSearchIndex) prune(selfID peer.ID) {
+    expiry := time.Now().Add(-fileShareSearchIndexTTL)
+    for c, entry := range i.entries {
+        expired := false
+        for providerID, provider := range entry.providers {
+            if providerID != selfID && provider.seen.Before(expiry) {
+                delete(entry.providers, providerID)
+                expired = true
+            }
+        }
+        if expired {
+            i.reindex(c, entry)
+        }
+    }
+}
+
+//Every query word must start a word of the name, tags or description of some provider of a file
+//The score adds up the weight of the best field each query word matched
+func (i *fileShareSearchIndex) search(query string, filters FileShareSearchFilters, selfID peer.ID, selfWallet string,
+                                     maxResults int) []FileShareSearchResult {
+    i.lock.Lock()
+    defer i.lock.Unlock()
+    i.prune(selfID)
+
+    queryTokens := searchTokens(query)
+    var candidates map[cid.Cid]bool
+    if len(queryTokens) == 0 {
+        candidates = make(map[cid.Cid]bool)
+        for c := range i.entries {
+            candidates[c] = true
+        }
+    }
+    for _, queryToken := range queryTokens {
+        matches := make(map[cid.Cid]bool)
+        for token, cids := range i.tokens {
+            if !strings.HasPrefix(token, queryToken) {
+                continue
+            }
+            for c := range cids {
+                if candidates == nil || candidates[c] {
+                    matches[c] = true
+                }
+            }
+        }
+        candidates = matches
+    }
+
+    results := []FileShareSearchResult{}
+    for c := range candidates {
+        entry := i.entries[c]
+        if !filters.matchesSize(entry.size) {
+            continue
+        }
+        result := FileShareSearchResult{
+            FileShareFileDiscoveryInfo: FileShareFileDiscoveryInfo{
+                Size: entry.size,
+                DataCid: c.String(),
+                Providers: []FileShareProvider{},
+            },
+        }
+        for providerID, provider := range entry.providers {
+            if !filters.matchesPrice(provider.Price) {
+                continue
+            }
+            score, _ := provider.searchScore(queryTokens)
+            result.Score = max(result.Score, score)
+            resultProvider := provider.FileShareProvider
+            if providerID == selfID {
+                resultProvider.WalletAddress = selfWallet
+            }
+            result.Providers = append(result.Providers, resultProvider)
+        }
+        if len(result.Providers) == 0 || len(result.Providers) < filters.MinProviders {
+            continue
+        }
+        results = append(results, result)
+    }
+    sortSearchResults(results)
+    if len(results) > maxResults {
+        results = results[:maxResults]
+    }
+    return results
+}
+
+//Best matches first, then the most provided
+func sortSearchResults(results []FileShareSearchResult) {
+    sort.Slice(results, func(i int, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        if len(results[i].Providers) != len(results[j].Providers) {
+            return len(results[i].Providers) > len(results[j].Providers)
+        }
+        return results[i].DataCid < results[j].DataCid
+    })
+}
+
+//Makes a file or directory we share searchable
+func (f *FileShareNode) indexShared(c cid.Cid, fileMeta FileShareMeta) {
+    f.searchIndex.add(c, fileMeta.Size, FileShareProvider{
+        PeerID: f.host.ID(),
+        Price: fileMeta.Price,
+        Name: fileMeta.Name,
+        Verified: true,
+        FileShareMetaDetails: fileMeta.FileShareMetaDetails,
+    })
+}
+
+func (f *FileShareNode) searchLocal(query string, filters FileShareSearchFilters, maxResults int) []FileShareSearchResult {
+    f.walletLock.Lock()
+    walletAddress := f.walletAddress
+    f.walletLock.Unlock()
+    return f.searchIndex.search(query, filters, f.host.ID(), walletAddress, maxResults)
+}
+
+//Request:  "SEARCH\n<size>\n<byte1><byte2>..." with the JSON encoded query, filters and maximum number of results
+//Response: "FOUND\n<size>\n<byte1><byte2>..." with the JSON encoded results from our index
+func (f *FileShareNode) handleSearch(stream *P2PStream) error {
+    sizeStr, err := stream.ReadString('\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
+    if err != nil || size <= 0 || size > fileShareMaxSearchRequestSize {
+        return invalidParams
+    }
+    reqBytes, err := stream.Read(size, fileShareWantHaveTimeout)
+    if err != nil {
+        return err
+    }
+    req := fileShareSearchRequest{}
+    err = json.Unmarshal(reqBytes, &req)
+    if err != nil || req.Filters.validate() != nil {
+        return invalidParams
+    }
+    maxResults := fileShareMaxSearchResults
+    if req.MaxResults > 0 {
+        maxResults = min(maxResults, req.MaxResults)
+    }
+
+    results := f.searchLocal(req.Query, req.Filters, maxResults)
+    respBytes, err := json.Marshal(results)
+    if err != nil {
+        return err
+    }
+    err = stream.SendString(fmt.Sprintf("FOUND\n%d\n", len(respBytes)))
+    if err != nil {
+        return err
+    }
+    return stream.Send(respBytes)
+}
+
+//Asks a peer to search its index, giving up once ctx is done
+func (s *FileShareSession) SendSearch(ctx context.Context, peerID peer.ID, req fileShareSearchRequest) []FileShareSearchResult {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+
+    //The peer only has whatever is left of the search to answer
+    timeout := fileShareWantTimeout
+    deadline, ok := ctx.Deadline()
+    if ok {
+        timeout = min(timeout, time.Until(deadline))
+    }
+    if ctx.Err() != nil || timeout <= 0 {
+        return nil
+    }
+
+    reqBytes, err := json.Marshal(req)
+    if err != nil {
+        return nil
+    }
+    err = s.sendString(peerID, fmt.Sprintf("SEARCH\n%d\n%s", len(reqBytes), reqBytes))
+    if err != nil {
+        return nil
+    }
+
+    resp, err := s.readString(peerID, '\n', timeout)
+    if err != nil || resp != "FOUND\n" {
+        return nil
+    }
+    sizeStr, err := s.readString(peerID, '\n', min(timeout, fileShareWantHaveTimeout))
+    if err != nil {
+        return nil
+    }
+    size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
+    if err != nil || size <= 0 || size > fileShareMaxSearchResponseSize {
+        return nil
+    }
+    respBytes, err := s.read(peerID, size, min(timeout, fileShareWantHaveTimeout))
+    if err != nil {
+        return nil
+    }
+    results := []FileShareSearchResult{}
+    err = json.Unmarshal(respBytes, &results)
+    if err != nil {
+        log.Printf("Failed to parse search results from %v\n", peerID)
+        return nil
+    }
+    return results
+}
+
+//Searches our index and the indices of the peers we know about for files whose name, tags or description match the query
+//Providers learned from peers' indices are second hand, so they are never marked verified, they are scored by us
+//and only count towards the minimum number of providers if we know about them ourselves
+func (f *FileShareNode) SearchFiles(ctx context.Context, query string, filters FileShareSearchFilters) ([]FileShareSearchResult, error) {
+    err := filters.validate()
+    if err != nil {
+        return nil, err
+    }
+    //Provider counts are only known once results from every peer are merged
+    peerFilters := filters
+    peerFilters.MinProviders = 0
+
+    queryTokens := searchTokens(query)
+    merged := make(map[string]*FileShareSearchResult)
+    mergedProviders := make(map[string]map[peer.ID]bool)
+    //Providers of each result that we learned ourselves
+    knownProviders := make(map[string]int)
+    mergeLock := sync.Mutex{}
+    merge := func(results []FileShareSearchResult, verified bool) {
+        mergeLock.Lock()
+        defer mergeLock.Unlock()
+        for _, result := range results {
+            if len(merged) >= fileShareMaxSearchResults * 10 && merged[result.DataCid] == nil {
+                continue
+            }
+            if _, err := cid.Decode(result.DataCid); err != nil {
+                continue
+            }
+            mergedResult, ok := merged[result.DataCid]
+            if !ok {
+                mergedResult = &FileShareSearchResult{
+                    FileShareFileDiscoveryInfo: FileShareFileDiscoveryInfo{
+                        Size: result.Size,
+                        DataCid: result.DataCid,
+                        Providers: []FileShareProvider{},
+                    },
+                }
+                merged[result.DataCid] = mergedResult
+                mergedProviders[result.DataCid] = make(map[peer.ID]bool)
+            }
+            for _, provider := range result.Providers {
+                //Our own results are merged first, so what we learned ourselves about a provider is kept over
+                //what peers claim about it
+                if mergedProviders[result.DataCid][provider.PeerID] || !peerFilters.matchesPrice(provider.Price) {
+                    continue
+                }
+                //Peers could send anything, so their providers have to match the query by themselves
+                score, matchedAll := provider.searchScore(queryTokens)
+                if !verified && !matchedAll {
+                    continue
+                }
+                mergedProviders[result.DataCid][provider.PeerID] = true
+                provider.Verified = provider.Verified && verified
+                mergedResult.Providers = append(mergedResult.Providers, provider)
+                mergedResult.Score = max(mergedResult.Score, score)
+                if verified {
+                    knownProviders[result.DataCid] ++
+                }
+            }
+        }
+    }
+    merge(f.searchLocal(query, peerFilters, fileShareMaxSearchResults), true)
+
+    searchCtx, cancel := context.WithTimeout(ctx, fileShareSearchTimeout)
+    defer cancel()
+    session := f.SessionCreate(searchCtx, "", fileShareSessionDiscovery)
+    defer f.SessionCleanup(session, 0)
+
+    //Peers are asked by a fixed number of workers until the deadline
+    req := fileShareSearchRequest{ Query: query, Filters: peerFilters, MaxResults: fileShareMaxSearchResults }
+    peerIDs := make(chan peer.ID)
+    wg := sync.WaitGroup{}
+    wg.Add(fileShareSearchWorkers)
+    for i := 0; i < fileShareSearchWorkers; i ++ {
+        go func() {
+            defer wg.Done()
+            for peerID := range peerIDs {
+                results := session.SendSearch(searchCtx, peerID, req)
+                if results != nil {
+                    merge(results, false)
+                }
+            }
+        }()
+    }
+    for _, peerID := range f.host.Peerstore().Peers() {
+        if peerID == f.host.ID() {
+            continue
+        }
+        select {
+            case peerIDs <- peerID:
+            case <- searchCtx.Done():
+        }
+        if searchCtx.Err() != nil {
+            break
+        }
+    }
+    close(peerIDs)
+    wg.Wait()
+
+    results := []FileShareSearchResult{}
+    for _, result := range merged {
+        if len(result.Providers) == 0 || knownProviders[result.DataCid] < filters.MinProviders || !filters.matchesSize(result.Size) {
+            continue
+        }
+        results = append(results, *result)
+    }
+    sortSearchResults(results)
+    if len(results) > fileShareMaxSearchResults {
+        results = results[:fileShareMaxSearchResults]
+    }
+    return results, nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+    "log"
+    "context"
+    "strconv"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Settings holding whether downloads are shared once they finish and at what price, unless the download says otherwise
+const fileShareSeedSetting = "seed_downloads"
+const fileShareSeedPriceSetting = "seed_price"
+
+type FileShareSeedSettings struct {
+    Enabled bool            `json:"enabled"`
+    Price float64           `json:"price"`
+}
+
+func (f *FileShareNode) loadSeedSettings() {
+    settings := FileShareSeedSettings{ Enabled: false, Price: 0 }
+    peerID := f.host.ID().String()
+    enabledStr, err := dbGetSetting(nil, peerID, fileShareSeedSetting)
+    if err == nil {
+        settings.Enabled, _ = strconv.ParseBool(enabledStr)
+    }
+    priceStr, err := dbGetSetting(nil, peerID, fileShareSeedPriceSetting)
+    if err == nil {
+        settings.Price, _ = strconv.ParseFloat(priceStr, 64)
+    }
+    f.seedLock.Lock()
+    f.seedSettings = settings
+    f.seedLock.Unlock()
+}
+
+func (f *FileShareNode) GetSeedSettings() FileShareSeedSettings {
+    f.seedLock.Lock()
+    defer f.seedLock.Unlock()
+    return f.seedSettings
+}
+
+func (f *FileShareNode) SetSeedSettings(settings FileShareSeedSettings) error {
+    if settings.Price < 0 {
+        return invalidParams
+    }
+    peerID := f.host.ID().String()
+    err := dbSetSetting(nil, peerID, fileShareSeedSetting, strconv.FormatBool(settings.Enabled))
+    if err != nil {
+        return err
+    }
+    err = dbSetSetting(nil, peerID, fileShareSeedPriceSetting, strconv.FormatFloat(settings.Price, 'f', -1, 64))
+    if err != nil {
+        return err
+    }
+    f.seedLock.Lock()
+    f.seedSettings = settings
+    f.seedLock.Unlock()
+    log.Printf("Seeding downloads set to %v at price %v\n", settings.Enabled, settings.Price)
+    return nil
+}
+
+//Shares a verified download under the CID it was downloaded as, and links the download to the upload
+//Only the details of the file are kept from the provider, we share it from now on
+//The download is shared without a copy, so it is withdrawn if it is changed or moved
+func (f *FileShareNode) seedDownload(reqCid cid.Cid, outputFile string, fileMeta FileShareMeta, price float64, downloadID int) {
+    if f.HasFile(reqCid) {
+        return
+    }
+    details := fileMeta.FileShareMetaDetails
+    details.Created = ""
+    //Providers may have split the file into blocks differently, in which case we would be sharing another CID
+    dataCid, err := f.putFile(context.Background(), outputFile, fileMeta.Name, price, reqCid, details, true)
+    if err == cidMismatch {
+        log.Printf("Not seeding %v, the download splits into blocks differently\n", reqCid)
+        return
+    } else if err != nil {
+        log.Printf("Failed to seed %v. %v\n", reqCid, err)
+        return
+    }
+    err = dbAddDownloadSeed(nil, f.host.ID().String(), downloadID, dataCid.String())
+    if err != nil {
+        log.Printf("Failed to link download of %v to its upload\n", reqCid)
+        return
+    }
+    log.Printf("Seeding %v at price %v\n", reqCid, price)
+}
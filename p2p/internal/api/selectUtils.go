@@ -0,0 +1,97 @@
+package api
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "context"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Given instead of a provider ID to have the provider picked for us
+const fileShareAutoProvider = "auto"
+
+//Policies for picking a provider automatically
+const fileShareSelectFastest = "fastest"
+const fileShareSelectReputation = "reputation"
+
+func validSelectPolicy(policy string) bool {
+    return policy == fileShareSelectFastest || policy == fileShareSelectReputation
+}
+
+//Finds the providers of a CID that confirm they have it, best first by the given policy
+//  fastest:    highest throughput we measured in past downloads first, providers never measured last
+//  reputation: highest score first
+//Ties are broken by reputation
+//Providers charging for the file are left out. A transaction pays one provider's wallet, so it has to be
+//made after picking the provider, which auto mode can't do.
+func (s *FileShareSession) selectProviders(ctx context.Context, reqCid cid.Cid, policy string) []peer.ID {
+    fileDiscovery := s.DiscoverFile(ctx, reqCid, 1000)
+    if fileDiscovery == nil {
+        return nil
+    }
+
+    //Providers are only listed if they still have the file
+    available := make([]bool, len(fileDiscovery.Providers))
+    wg := sync.WaitGroup{}
+    for i, provider := range fileDiscovery.Providers {
+        if provider.PeerID == s.node.host.ID() || provider.Price > 0 {
+            continue
+        }
+        wg.Add(1)
+        go func(i int, providerID peer.ID) {
+            defer wg.Done()
+            haveCids := s.SendWantHave(providerID, []cid.Cid{reqCid})
+            available[i] = len(haveCids) == 1 && haveCids[0] == reqCid
+        }(i, provider.PeerID)
+    }
+    wg.Wait()
+
+    type candidate struct {
+        FileShareProvider
+        throughput float64
+    }
+    candidates := []candidate{}
+    for i, provider := range fileDiscovery.Providers {
+        if !available[i] {
+            continue
+        }
+        throughput := float64(0)
+        reputations, err := s.node.GetReputations(provider.PeerID.String())
+        if err == nil && len(reputations) == 1 {
+            throughput = reputations[0].Throughput
+        }
+        candidates = append(candidates, candidate{ FileShareProvider: provider, throughput: throughput })
+    }
+
+    //Providers are already sorted by score
+    sort.SliceStable(candidates, func(i int, j int) bool {
+        if policy == fileShareSelectFastest {
+            return candidates[i].throughput > candidates[j].throughput
+        }
+        return false
+    })
+
+    providerIDs := make([]peer.ID, 0, len(candidates))
+    for _, candidate := range candidates {
+        providerIDs = append(providerIDs, candidate.PeerID)
+    }
+    log.Printf("Selected %d providers of %v by %s\n", len(providerIDs), reqCid, policy)
+    return providerIDs
+}
+
+//Gets the metadata a candidate serves the file with
+//Returns false if the candidate doesn't answer or now charges for the file
+func (s *FileShareSession) candidateMeta(providerID peer.ID, reqCid cid.Cid) (FileShareMeta, bool) {
+    fileMeta := FileShareMeta{}
+    bytes := s.SendWantMeta(providerID, reqCid)
+    if bytes == nil || fileMeta.Unmarshal(bytes) != nil {
+        return fileMeta, false
+    }
+    if fileMeta.Price > 0 {
+        log.Printf("Skipping %v, it charges %v for %v\n", providerID, fileMeta.Price, reqCid)
+        return fileMeta, false
+    }
+    return fileMeta, true
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+    "log"
+    "sort"
+    "time"
+)
+
+//Kinds of sessions, only downloads are recorded once they finish
+const fileShareSessionDownload = "download"
+const fileShareSessionDiscovery = "discovery"
+const fileShareSessionGateway = "gateway"
+//How long a finished session can still be looked up before it is evicted
+const fileShareSessionRetention = time.Minute * 10
+
+//States sessions can be filtered by
+const fileShareSessionActive = "active"
+const fileShareSessionPaused = "paused"
+const fileShareSessionCompleted = "completed"
+const fileShareSessionFailed = "failed"
+
+//Outcome of a finished download, kept after the session itself is evicted
+type FileShareSessionRecord struct {
+    SessionID int             `json:"session_id"`
+    ReqCid string             `json:"req_cid"`
+    Result int                `json:"result"`
+    RxBytes int64             `json:"rx_bytes"`
+    TotalBytes int64          `json:"total_bytes"`
+    StartTime string          `json:"start_time"`
+    EndTime string            `json:"end_time"`
+    Duration float64          `json:"duration"`
+    AverageSpeed float64      `json:"average_speed"`
+}
+
+//Records a finished download and evicts the session once the retention period is over
+func (f *FileShareNode) finishSession(session *FileShareSession) {
+    session.statsLock.Lock()
+    sessionType := session.Type
+    endTime := time.Now()
+    //Speed only counts the bytes received by this session over the time it was transferring
+    transferTime := endTime.Sub(session.startTime)
+    if !session.transferStart.IsZero() {
+        transferTime = endTime.Sub(session.transferStart)
+    }
+    averageSpeed := float64(0)
+    if transferTime > 0 {
+        averageSpeed = float64(session.RxBytes - session.resumedBytes) / transferTime.Seconds()
+    }
+    record := FileShareSessionRecord{
+        SessionID: session.SessionID,
+        ReqCid: session.ReqCid,
+        Result: session.Result,
+        RxBytes: session.RxBytes,
+        TotalBytes: session.TotalBytes,
+        StartTime: session.StartTime,
+        EndTime: session.EndTime,
+        Duration: endTime.Sub(session.startTime).Seconds(),
+        AverageSpeed: averageSpeed,
+    }
+    session.statsLock.Unlock()
+
+    if sessionType == fileShareSessionDownload {
+        err := dbAddSessionRecord(nil, f.host.ID().String(), record)
+        if err != nil {
+            log.Printf("Failed to record session %d\n", session.SessionID)
+        }
+    }
+
+    if sessionType != fileShareSessionDiscovery {
+        f.recordProviderOutcomes(session)
+        sessionCpy, err := f.GetSession(session.SessionID)
+        if err == nil {
+            events.publish(eventSessionComplete, sessionCpy)
+        }
+    }
+
+    time.AfterFunc(fileShareSessionRetention, func() {
+        f.sessionStoreLock.Lock()
+        delete(f.sessionStore, session.SessionID)
+        f.sessionStoreLock.Unlock()
+    })
+}
+
+//Caller must hold the session's statsLock
+func (s *FileShareSession) state() string {
+    if s.Complete {
+        if s.Result == 0 {
+            return fileShareSessionCompleted
+        }
+        return fileShareSessionFailed
+    }
+    s.pauseLock.Lock()
+    defer s.pauseLock.Unlock()
+    if s.Paused != 0 {
+        return fileShareSessionPaused
+    }
+    return fileShareSessionActive
+}
+
+//Lists sessions in the given state, or every session if state is empty
+//Finished sessions are only listed until they are evicted
+func (f *FileShareNode) GetSessions(state string) ([]*FileShareSession, error) {
+    switch state {
+        case "", fileShareSessionActive, fileShareSessionPaused, fileShareSessionCompleted, fileShareSessionFailed:
+        default:
+            return nil, invalidParams
+    }
+
+    f.sessionStoreLock.Lock()
+    sessionIDs := make([]int, 0, len(f.sessionStore))
+    for sessionID := range f.sessionStore {
+        sessionIDs = append(sessionIDs, sessionID)
+    }
+    f.sessionStoreLock.Unlock()
+    sort.Ints(sessionIDs)
+
+    sessions := []*FileShareSession{}
+    for _, sessionID := range sessionIDs {
+        session, ok := f.getSessionRef(sessionID)
+        if !ok {
+            continue
+        }
+        session.statsLock.Lock()
+        sessionState := session.state()
+        session.statsLock.Unlock()
+        if state != "" && sessionState != state {
+            continue
+        }
+        sessionCpy, err := f.GetSession(sessionID)
+        if err == nil {
+            sessions = append(sessions, sessionCpy)
+        }
+    }
+    return sessions, nil
+}
+
+func (f *FileShareNode) GetSessionHistory() ([]FileShareSessionRecord, error) {
+    return dbGetSessionRecords(nil, f.host.ID().String())
+}
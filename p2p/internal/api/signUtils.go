@@ -0,0 +1,198 @@
+package api
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+    "encoding/json"
+    "github.com/libp2p/go-libp2p/core/peer"
+    "github.com/libp2p/go-libp2p/core/host"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Keeps signatures over metadata from being valid for anything else signed with the same key
+const fileShareSignedMetaDomain = "seawolf-fileshare-meta"
+
+//Metadata of a CID in the versioned encoding and the provider's wallet address, signed with the provider's
+//libp2p key so they can be checked against its peer ID no matter who relayed them
+type FileShareSignedMeta struct {
+    Meta []byte             `json:"meta"`
+    WalletAddress string    `json:"wallet_address"`
+    Signature []byte        `json:"signature"`
+}
+
+func (m *FileShareSignedMeta) signedBytes(c cid.Cid) []byte {
+    header := fmt.Sprintf("%s\n%s\n%s\n", fileShareSignedMetaDomain, c.String(), m.WalletAddress)
+    return append([]byte(header), m.Meta...)
+}
+
+//Checks that the metadata of c was signed by the given provider
+func (m *FileShareSignedMeta) verify(h host.Host, providerID peer.ID, c cid.Cid) error {
+    pubKey, err := providerID.ExtractPublicKey()
+    if err != nil {
+        //Peer IDs of keys too large to inline only have a hash of the key, which identify gives us
+        pubKey = h.Peerstore().PubKey(providerID)
+        if pubKey == nil {
+            return signatureInvalid
+        }
+    }
+    ok, err := pubKey.Verify(m.signedBytes(c), m.Signature)
+    if err != nil || !ok {
+        return signatureInvalid
+    }
+    return nil
+}
+
+func (f *FileShareNode) signMeta(c cid.Cid, fileMeta FileShareMeta) (*FileShareSignedMeta, error) {
+    metaBytes, err := fileMeta.Marshal()
+    if err != nil {
+        return nil, err
+    }
+    f.walletLock.Lock()
+    signedMeta := &FileShareSignedMeta{ Meta: metaBytes, WalletAddress: f.walletAddress }
+    f.walletLock.Unlock()
+
+    privKey := f.host.Peerstore().PrivKey(f.host.ID())
+    if privKey == nil {
+        log.Printf("Failed to find our private key\n")
+        return nil, keyNotFound
+    }
+    signedMeta.Signature, err = privKey.Sign(signedMeta.signedBytes(c))
+    if err != nil {
+        log.Printf("Failed to sign metadata of %v. %v\n", c, err)
+        return nil, internalError
+    }
+    return signedMeta, nil
+}
+
+//Request:  "WANT SIGNED META\n<cid>\n"
+//Response: "HERE\n<size>\n<byte1><byte2>..." with the JSON encoded signed metadata
+//          "DON'T HAVE\n"
+func (f *FileShareNode) handleWantSignedMeta(stream *P2PStream) error {
+    cidStr, err := stream.ReadString('\n', fileShareWantTimeout)
+    if err != nil {
+        return err
+    }
+    c, err := cid.Decode(cidStr[:len(cidStr) - 1])
+    if err != nil {
+        return err
+    }
+
+    f.mstoreLock.Lock()
+    fileMeta, ok := f.mstore[c]
+    f.mstoreLock.Unlock()
+    //Only sign metadata of what we share ourselves, mstore also holds metadata of discovered files
+    f.fstoreLock.Lock()
+    _, shared := f.fstore[c]
+    f.fstoreLock.Unlock()
+    if !ok || !(shared || f.getManifest(c) != nil) {
+        return stream.SendString("DON'T HAVE\n")
+    }
+    signedMeta, err := f.signMeta(c, fileMeta)
+    if err != nil {
+        return err
+    }
+    rawData, err := json.Marshal(signedMeta)
+    if err != nil {
+        return err
+    }
+    err = stream.SendString(fmt.Sprintf("HERE\n%d\n", len(rawData)))
+    if err != nil {
+        return err
+    }
+    return stream.Send(rawData)
+}
+
+//Gets the signed metadata of a CID from a provider without checking the signature
+//Providers that don't know about signed metadata close the stream, after which we don't ask them again
+func (s *FileShareSession) SendWantSignedMeta(peerID peer.ID, c cid.Cid) (*FileShareSignedMeta, error) {
+    reqLock := s.GetRequestLock(peerID)
+    reqLock.Lock()
+    defer reqLock.Unlock()
+
+    err := s.sendString(peerID, fmt.Sprintf("WANT SIGNED META\n%s\n", c.String()))
+    if err == nil {
+        var resp string
+        resp, err = s.readString(peerID, '\n', fileShareWantTimeout)
+        if err == nil && resp == "DON'T HAVE\n" {
+            return nil, contentNotFound
+        } else if err == nil && resp != "HERE\n" {
+            return nil, unexpectedResponse
+        }
+    }
+    //Only a provider closing the stream on the request means it doesn't know it, other errors can be transient
+    if err == streamClosed {
+        log.Printf("Provider %v does not support signed metadata\n", peerID)
+        s.DeleteStream(peerID)
+        s.streamLock.Lock()
+        s.unsignedMetaPeers[peerID] = true
+        s.streamLock.Unlock()
+        return nil, err
+    } else if err != nil {
+        s.DeleteStream(peerID)
+        return nil, err
+    }
+
+    sizeStr, err := s.readString(peerID, '\n', fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, err
+    }
+    size, err := strconv.Atoi(sizeStr[:len(sizeStr) - 1])
+    if err != nil || size <= 0 || size > 2 * fileShareMaxMetaSize {
+        return nil, unexpectedResponse
+    }
+    rawData, err := s.read(peerID, size, fileShareWantHaveTimeout)
+    if err != nil {
+        return nil, err
+    }
+    signedMeta := &FileShareSignedMeta{}
+    err = json.Unmarshal(rawData, signedMeta)
+    if err != nil {
+        return nil, unexpectedResponse
+    }
+    return signedMeta, nil
+}
+
+//Gets the metadata and wallet address of a provider's copy of a CID
+//Verified is only set if they were signed by the provider. Metadata with a bad signature is rejected
+//since the provider would have signed it if it came from them, while providers that don't sign
+//metadata at all have nothing tying what they send to their identity.
+func (s *FileShareSession) getProviderMeta(peerID peer.ID, c cid.Cid) (fileMeta FileShareMeta, walletAddress string, verified bool, err error) {
+    s.streamLock.Lock()
+    unsigned := s.unsignedMetaPeers[peerID]
+    s.streamLock.Unlock()
+    if !unsigned {
+        var signedMeta *FileShareSignedMeta
+        signedMeta, err = s.SendWantSignedMeta(peerID, c)
+        if err == nil {
+            err = signedMeta.verify(s.node.host, peerID, c)
+            if err != nil {
+                log.Printf("Metadata of %v from %v failed verification\n", c, peerID)
+                return fileMeta, "", false, err
+            }
+            err = fileMeta.Unmarshal(signedMeta.Meta)
+            if err != nil {
+                log.Printf("Error unmarshalling file metadata\n")
+                return fileMeta, "", false, err
+            }
+            return fileMeta, signedMeta.WalletAddress, true, nil
+        }
+        s.streamLock.Lock()
+        unsigned = s.unsignedMetaPeers[peerID]
+        s.streamLock.Unlock()
+        if !unsigned {
+            return fileMeta, "", false, err
+        }
+    }
+
+    bytes := s.SendWantMeta(peerID, c)
+    if bytes == nil {
+        return fileMeta, "", false, contentNotFound
+    }
+    err = fileMeta.Unmarshal(bytes)
+    if err != nil {
+        log.Printf("Error unmarshalling file metadata\n")
+        return fileMeta, "", false, err
+    }
+    return fileMeta, s.SendWantWallet(peerID), false, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+    "os"
+    "log"
+    "time"
+    "path/filepath"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Files shared without a copy are served straight from where they are. Their size and modification time
+//are kept from when they were shared, and a file that no longer matches is withdrawn since its data
+//may no longer match its CID.
+type fileShareSource struct {
+    Path string
+    Size int64
+    ModTime string
+}
+
+func statSource(filePath string) (fileShareSource, error) {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return fileShareSource{}, err
+    }
+    stat, err := os.Stat(absPath)
+    if err != nil {
+        return fileShareSource{}, err
+    }
+    if !stat.Mode().IsRegular() {
+        return fileShareSource{}, failedToOpenFile
+    }
+    return fileShareSource{
+        Path: absPath,
+        Size: stat.Size(),
+        ModTime: stat.ModTime().UTC().Format(time.RFC3339Nano),
+    }, nil
+}
+
+//Whether the file is still the way it was when it was shared
+func (s fileShareSource) unchanged() bool {
+    current, err := statSource(s.Path)
+    return err == nil && current == s
+}
+
+//Checks that a CID shared without a copy can still be served, and withdraws it if it can't
+//CIDs kept in the content store always can
+func (f *FileShareNode) checkSource(c cid.Cid) bool {
+    f.fstoreLock.Lock()
+    source, ok := f.sources[c]
+    f.fstoreLock.Unlock()
+    if !ok || source.unchanged() {
+        return true
+    }
+    log.Printf("Source file %v of %v changed or is missing, withdrawing it\n", source.Path, c)
+    err := f.DeleteFile(c.String())
+    if err != nil && err != contentNotFound {
+        log.Printf("Failed to withdraw %v. %v\n", c, err)
+    }
+    return false
+}
+
+//Withdraws every CID whose source file changed or is missing
+func (f *FileShareNode) checkSources() {
+    cids := []cid.Cid{}
+    f.fstoreLock.Lock()
+    for c := range f.sources {
+        cids = append(cids, c)
+    }
+    f.fstoreLock.Unlock()
+    for _, c := range cids {
+        f.checkSource(c)
+    }
+}
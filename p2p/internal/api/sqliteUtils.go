@@ -2,6 +2,7 @@ package api
 
 import (
     "log"
+    "strings"
     "encoding/hex"
     "database/sql"
     _ "github.com/mattn/go-sqlite3"
@@ -13,12 +14,57 @@ const createUserTableQuery = `CREATE TABLE IF NOT EXISTS users
                                private_key_ciphertext TEXT, private_key_iv TEXT, private_key_salt TEXT, wallet_address TEXT)`
 
 const createUploadTableQuery = `CREATE TABLE IF NOT EXISTS uploads
-                              (id INTEGER PRIMARY KEY, peer_id TEXT, cid TEXT, filename TEXT, price FLOAT, size INTEGER, timestamp TEXT)`
+                              (id INTEGER PRIMARY KEY, peer_id TEXT, cid TEXT, filename TEXT, price FLOAT, size INTEGER, timestamp TEXT,
+                               source_path TEXT, source_size INTEGER, source_mtime TEXT)`
 
+//Columns added to the uploads table after it was first released
+var uploadSourceColumns = []string{"source_path TEXT", "source_size INTEGER", "source_mtime TEXT"}
 
 const createDownloadTableQuery = `CREATE TABLE IF NOT EXISTS downloads
                                  (id INTEGER PRIMARY KEY, peer_id TEXT, provider_id TEXT, cid TEXT, filename TEXT, price FLOAT, size INTEGER, timestamp TEXT)`
 
+const createDownloadSeedTableQuery = `CREATE TABLE IF NOT EXISTS download_seeds
+                                     (id INTEGER PRIMARY KEY, peer_id TEXT, download_id INTEGER, upload_cid TEXT)`
+
+const createPartialDownloadTableQuery = `CREATE TABLE IF NOT EXISTS partial_downloads
+                                        (id INTEGER PRIMARY KEY, peer_id TEXT, provider_id TEXT, cid TEXT, filename TEXT, price FLOAT, size INTEGER,
+                                         output_file TEXT, range_size INTEGER, ranges TEXT, timestamp TEXT)`
+
+const createManifestTableQuery = `CREATE TABLE IF NOT EXISTS manifests
+                                 (id INTEGER PRIMARY KEY, peer_id TEXT, cid TEXT, manifest TEXT)`
+
+const createFileDetailsTableQuery = `CREATE TABLE IF NOT EXISTS file_details
+                                    (id INTEGER PRIMARY KEY, peer_id TEXT, cid TEXT, details TEXT)`
+
+const createContentRefTableQuery = `CREATE TABLE IF NOT EXISTS content_refs
+                                   (id INTEGER PRIMARY KEY, peer_id TEXT, content_key TEXT, ref_type TEXT, ref_id TEXT)`
+
+const createSettingTableQuery = `CREATE TABLE IF NOT EXISTS settings
+                                (id INTEGER PRIMARY KEY, peer_id TEXT, key TEXT, value TEXT)`
+
+const createPaymentTableQuery = `CREATE TABLE IF NOT EXISTS payments
+                                (id INTEGER PRIMARY KEY, peer_id TEXT, tx_id TEXT, payer_id TEXT, cid TEXT, amount FLOAT,
+                                 confirmations INTEGER, timestamp TEXT, UNIQUE(peer_id, tx_id))`
+
+const createLockedDownloadTableQuery = `CREATE TABLE IF NOT EXISTS locked_downloads
+                                       (id INTEGER PRIMARY KEY, peer_id TEXT, provider_id TEXT, cid TEXT, filename TEXT, price FLOAT, size INTEGER,
+                                        output_file TEXT, wallet_address TEXT, key_id TEXT, key_hash TEXT, timestamp TEXT)`
+
+const createDeliveryKeyTableQuery = `CREATE TABLE IF NOT EXISTS delivery_keys
+                                    (id INTEGER PRIMARY KEY, peer_id TEXT, key_id TEXT, requester_id TEXT, cid TEXT, key TEXT, timestamp TEXT)`
+
+const createUploadRecordTableQuery = `CREATE TABLE IF NOT EXISTS upload_records
+                                     (id INTEGER PRIMARY KEY, peer_id TEXT, cid TEXT, requester_id TEXT, tx_bytes INTEGER, complete BOOLEAN, timestamp TEXT)`
+
+const createSessionHistoryTableQuery = `CREATE TABLE IF NOT EXISTS session_history
+                                       (id INTEGER PRIMARY KEY, peer_id TEXT, session_id INTEGER, cid TEXT, result INTEGER, rx_bytes INTEGER,
+                                        total_bytes INTEGER, start_time TEXT, end_time TEXT, duration FLOAT, average_speed FLOAT)`
+
+const createReputationTableQuery = `CREATE TABLE IF NOT EXISTS provider_reputation
+                                   (id INTEGER PRIMARY KEY, peer_id TEXT, provider_id TEXT, successes INTEGER, failures INTEGER,
+                                    integrity_failures INTEGER, rx_bytes INTEGER, transfer_time FLOAT, latency_total FLOAT,
+                                    latency_samples INTEGER, last_seen TEXT)`
+
 func dbOpen() (*sql.DB, error) {
     db, err := sql.Open("sqlite3", databasePath)
     if err != nil {
@@ -41,6 +87,12 @@ func dbOpen() (*sql.DB, error) {
         log.Printf("Failed to create file table. %v\n", err)
         return db, internalError
     }
+    err = dbAddMissingColumns(db, "uploads", uploadSourceColumns)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to add columns to file table. %v\n", err)
+        return db, internalError
+    }
 
     //Create downloads table if doesn't exist
     _, err = db.Exec(createDownloadTableQuery)
@@ -50,11 +102,138 @@ func dbOpen() (*sql.DB, error) {
         return db, internalError
     }
 
+    //Create download seeds table if doesn't exist
+    _, err = db.Exec(createDownloadSeedTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create download seeds table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create partial downloads table if doesn't exist
+    _, err = db.Exec(createPartialDownloadTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create partial downloads table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create manifests table if doesn't exist
+    _, err = db.Exec(createManifestTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create manifests table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create file details table if doesn't exist
+    _, err = db.Exec(createFileDetailsTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create file details table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create content references table if doesn't exist
+    _, err = db.Exec(createContentRefTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create content references table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create settings table if doesn't exist
+    _, err = db.Exec(createSettingTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create settings table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create session history table if doesn't exist
+    _, err = db.Exec(createSessionHistoryTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create session history table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create payments table if doesn't exist
+    _, err = db.Exec(createPaymentTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create payments table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create locked downloads table if doesn't exist
+    _, err = db.Exec(createLockedDownloadTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create locked downloads table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create delivery keys table if doesn't exist
+    _, err = db.Exec(createDeliveryKeyTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create delivery keys table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create upload records table if doesn't exist
+    _, err = db.Exec(createUploadRecordTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create upload records table. %v\n", err)
+        return db, internalError
+    }
+
+    //Create provider reputation table if doesn't exist
+    _, err = db.Exec(createReputationTableQuery)
+    if err != nil {
+        db.Close()
+        log.Printf("Failed to create provider reputation table. %v\n", err)
+        return db, internalError
+    }
+
 
 
     return db, nil
 }
 
+//Adds the columns that tables created by older versions don't have yet
+func dbAddMissingColumns(db *sql.DB, table string, columns []string) error {
+    rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+    if err != nil {
+        return err
+    }
+    existing := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        err = rows.Scan(&name)
+        if err != nil {
+            rows.Close()
+            return err
+        }
+        existing[name] = true
+    }
+    rows.Close()
+
+    for _, column := range columns {
+        name := strings.Fields(column)[0]
+        if existing[name] {
+            continue
+        }
+        _, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 func dbGetUser(db *sql.DB, username string, passwordHash *[]byte, privateKeyCiphertext *[]byte, 
                 privateKeyIV *[]byte, privateKeySalt *[]byte, walletAddress *string) (int, error) {
     var err error
@@ -260,7 +439,8 @@ func dbGetUploads(db *sql.DB, peerID string) ([]FileShareUpload, error) {
 
     files := []FileShareUpload{}
 
-    rows, err := db.Query(`SELECT cid, filename, price, size, timestamp FROM uploads WHERE peer_id= ?`, peerID)
+    rows, err := db.Query(`SELECT cid, filename, price, size, timestamp, COALESCE(source_path, ''), COALESCE(source_size, 0),
+                           COALESCE(source_mtime, '') FROM uploads WHERE peer_id= ?`, peerID)
     if err != nil {
         if err == sql.ErrNoRows {
             return files, nil
@@ -274,8 +454,11 @@ func dbGetUploads(db *sql.DB, peerID string) ([]FileShareUpload, error) {
     var price float64
     var size int64
     var timestamp string
+    var sourcePath string
+    var sourceSize int64
+    var sourceModTime string
     for rows.Next() {
-        err := rows.Scan(&cid, &filename, &price, &size, &timestamp)
+        err := rows.Scan(&cid, &filename, &price, &size, &timestamp, &sourcePath, &sourceSize, &sourceModTime)
         if err != nil {
             log.Printf("Failed to scan rows from SQL query. %v\n", err);
             return nil, internalError
@@ -290,12 +473,41 @@ func dbGetUploads(db *sql.DB, peerID string) ([]FileShareUpload, error) {
                                     },
                                     cid,
                                     peerID,
-                                }})
+                                },
+                                sourcePath,
+                                sourceSize,
+                                sourceModTime})
     }
 
     return files, nil
 }
 
+//Records where a file shared without a copy is, or clears it if sourcePath is empty
+func dbSetUploadSource(db *sql.DB, peerID string, cid string, sourcePath string, sourceSize int64, sourceModTime string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`UPDATE uploads SET source_path=?, source_size=?, source_mtime=? WHERE cid=? AND peer_id=?`,
+                     sourcePath,
+                     sourceSize,
+                     sourceModTime,
+                     cid,
+                     peerID)
+    if err != nil {
+        log.Printf("Failed to record source of file into database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
 func dbRemoveUpload(db *sql.DB, peerID string, cidStr string) error {
     var err error
     //Establish connection to database if doesn't exist
@@ -319,17 +531,17 @@ func dbRemoveUpload(db *sql.DB, peerID string, cidStr string) error {
     return nil
 }
 
-func dbAddDownload(db *sql.DB, peerID string, providerID string, cid string, filename string, price float64, size int64, timestamp string) error {
+func dbAddDownload(db *sql.DB, peerID string, providerID string, cid string, filename string, price float64, size int64, timestamp string) (int, error) {
     var err error
     // Establish connection to database if doesn't exist
     if db == nil {
         db, err = dbOpen()
         if err != nil {
-            return err
+            return -1, err
         }
         defer db.Close()
     }
-    _, err = db.Exec(`INSERT INTO downloads (peer_id, provider_id, cid, filename, price, size, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+    result, err := db.Exec(`INSERT INTO downloads (peer_id, provider_id, cid, filename, price, size, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
                      peerID,
                      providerID,
                      cid,
@@ -340,10 +552,15 @@ func dbAddDownload(db *sql.DB, peerID string, providerID string, cid string, fil
 
     if err != nil {
         log.Printf("Failed to push downloads into database. %v\n", err)
-        return internalError
+        return -1, internalError
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        log.Printf("Failed to get id of download. %v\n", err)
+        return -1, internalError
     }
 
-    return nil
+    return int(id), nil
 }
 
 func dbGetDownloads(db *sql.DB, peerID string) ([]FileShareDownload, error) {
@@ -359,7 +576,9 @@ func dbGetDownloads(db *sql.DB, peerID string) ([]FileShareDownload, error) {
 
     files := []FileShareDownload{}
 
-    rows, err := db.Query(`SELECT provider_id, cid, filename, price, size, timestamp FROM downloads WHERE peer_id= ?`, peerID)
+    rows, err := db.Query(`SELECT provider_id, downloads.cid, filename, price, size, timestamp, COALESCE(upload_cid, '')
+                           FROM downloads LEFT JOIN download_seeds ON download_seeds.peer_id=downloads.peer_id
+                           AND download_id=downloads.id WHERE downloads.peer_id= ? ORDER BY downloads.id`, peerID)
     if err != nil {
         if err == sql.ErrNoRows {
             return files, nil
@@ -374,8 +593,9 @@ func dbGetDownloads(db *sql.DB, peerID string) ([]FileShareDownload, error) {
     var price float64
     var size int64
     var timestamp string
+    var uploadCid string
     for rows.Next() {
-        err := rows.Scan(&providerID, &cid, &filename, &price, &size, &timestamp)
+        err := rows.Scan(&providerID, &cid, &filename, &price, &size, &timestamp, &uploadCid)
         if err != nil {
             log.Printf("Failed to scan rows from SQL query. %v\n", err);
             return nil, internalError
@@ -390,12 +610,149 @@ func dbGetDownloads(db *sql.DB, peerID string) ([]FileShareDownload, error) {
                             },
                             cid,
                             providerID,
-                        }})
+                        },
+                        uploadCid})
     }
 
     return files, nil
 }
 
+func dbAddPartialDownload(db *sql.DB, peerID string, partial *FileSharePartialDownload) (int, error) {
+    var err error
+    // Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return -1, err
+        }
+        defer db.Close()
+    }
+    result, err := db.Exec(`INSERT INTO partial_downloads
+                            (peer_id, provider_id, cid, filename, price, size, output_file, range_size, ranges, timestamp)
+                            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                           peerID,
+                           partial.ProviderID,
+                           partial.DataCid,
+                           partial.Name,
+                           partial.Price,
+                           partial.Size,
+                           partial.OutputFile,
+                           partial.rangeSize,
+                           partial.encodeRanges(),
+                           partial.Timestamp)
+    if err != nil {
+        log.Printf("Failed to push partial download into database. %v\n", err)
+        return -1, internalError
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        log.Printf("Failed to get id of partial download. %v\n", err)
+        return -1, internalError
+    }
+
+    return int(id), nil
+}
+
+func dbUpdatePartialDownload(db *sql.DB, peerID string, downloadID int, ranges string) error {
+    var err error
+    // Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+    _, err = db.Exec(`UPDATE partial_downloads SET ranges=? WHERE id=? AND peer_id=?`, ranges, downloadID, peerID)
+    if err != nil {
+        log.Printf("Failed to update partial download. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbSetPartialDownloadProvider(db *sql.DB, peerID string, downloadID int, providerID string, price float64) error {
+    var err error
+    // Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+    _, err = db.Exec(`UPDATE partial_downloads SET provider_id=?, price=? WHERE id=? AND peer_id=?`,
+                     providerID, price, downloadID, peerID)
+    if err != nil {
+        log.Printf("Failed to update partial download. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbRemovePartialDownload(db *sql.DB, peerID string, downloadID int) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM partial_downloads WHERE id=? AND peer_id=?`, downloadID, peerID)
+    if err != nil {
+        log.Printf("Failed to delete partial download from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetPartialDownloads(db *sql.DB, peerID string) ([]FileSharePartialDownload, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    partials := []FileSharePartialDownload{}
+
+    rows, err := db.Query(`SELECT id, provider_id, cid, filename, price, size, output_file, range_size, ranges, timestamp
+                           FROM partial_downloads WHERE peer_id= ?`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    var ranges string
+    for rows.Next() {
+        partial := FileSharePartialDownload{}
+        err := rows.Scan(&partial.DownloadID, &partial.ProviderID, &partial.DataCid, &partial.Name, &partial.Price,
+                         &partial.Size, &partial.OutputFile, &partial.rangeSize, &ranges, &partial.Timestamp)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err);
+            return nil, internalError
+        }
+        err = partial.decodeRanges(ranges)
+        if err != nil {
+            log.Printf("Skipping corrupted partial download %d\n", partial.DownloadID)
+            continue
+        }
+        partials = append(partials, partial)
+    }
+
+    return partials, nil
+}
+
 func dbSetWalletAddress(db *sql.DB, username string, walletAddress string) error {
      var err error
     //Establish connection to database if doesn't exist
@@ -415,3 +772,890 @@ func dbSetWalletAddress(db *sql.DB, username string, walletAddress string) error
     }
     return nil
 }
+
+func dbAddManifest(db *sql.DB, peerID string, cid string, manifest string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM manifests WHERE peer_id=? AND cid=?`, peerID, cid)
+    if err != nil {
+        log.Printf("Failed to replace manifest in SQLITE database. %v\n", err)
+        return internalError
+    }
+    _, err = db.Exec(`INSERT INTO manifests (peer_id, cid, manifest) VALUES (?, ?, ?)`, peerID, cid, manifest)
+    if err != nil {
+        log.Printf("Failed to insert manifest into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetManifest(db *sql.DB, peerID string, cid string) (string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", err
+        }
+        defer db.Close()
+    }
+
+    var manifest string
+    err = db.QueryRow(`SELECT manifest FROM manifests WHERE peer_id=? AND cid=?`, peerID, cid).Scan(&manifest)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", contentNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", internalError
+    }
+
+    return manifest, nil
+}
+
+func dbRemoveManifest(db *sql.DB, peerID string, cid string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM manifests WHERE peer_id=? AND cid=?`, peerID, cid)
+    if err != nil {
+        log.Printf("Failed to delete manifest from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Details are the JSON encoded metadata fields beyond size, price and name
+func dbSetFileDetails(db *sql.DB, peerID string, cid string, details string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM file_details WHERE peer_id=? AND cid=?`, peerID, cid)
+    if err != nil {
+        log.Printf("Failed to replace file details in SQLITE database. %v\n", err)
+        return internalError
+    }
+    _, err = db.Exec(`INSERT INTO file_details (peer_id, cid, details) VALUES (?, ?, ?)`, peerID, cid, details)
+    if err != nil {
+        log.Printf("Failed to insert file details into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetFileDetails(db *sql.DB, peerID string, cid string) (string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", err
+        }
+        defer db.Close()
+    }
+
+    var details string
+    err = db.QueryRow(`SELECT details FROM file_details WHERE peer_id=? AND cid=?`, peerID, cid).Scan(&details)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", contentNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", internalError
+    }
+
+    return details, nil
+}
+
+func dbRemoveFileDetails(db *sql.DB, peerID string, cid string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM file_details WHERE peer_id=? AND cid=?`, peerID, cid)
+    if err != nil {
+        log.Printf("Failed to delete file details from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Records that refID of type refType uses the stored content contentKey. Adding an existing reference does nothing.
+func dbAddContentRef(db *sql.DB, peerID string, contentKey string, refType string, refID string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM content_refs WHERE peer_id=? AND ref_type=? AND ref_id=?`, peerID, refType, refID)
+    if err != nil {
+        log.Printf("Failed to replace content reference in SQLITE database. %v\n", err)
+        return internalError
+    }
+    _, err = db.Exec(`INSERT INTO content_refs (peer_id, content_key, ref_type, ref_id) VALUES (?, ?, ?, ?)`,
+                     peerID, contentKey, refType, refID)
+    if err != nil {
+        log.Printf("Failed to insert content reference into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Gets the stored content used by a reference
+func dbGetContentRef(db *sql.DB, peerID string, refType string, refID string) (string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", err
+        }
+        defer db.Close()
+    }
+
+    var contentKey string
+    err = db.QueryRow(`SELECT content_key FROM content_refs WHERE peer_id=? AND ref_type=? AND ref_id=?`, peerID, refType, refID).
+                      Scan(&contentKey)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", contentNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", internalError
+    }
+
+    return contentKey, nil
+}
+
+func dbRemoveContentRef(db *sql.DB, peerID string, refType string, refID string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM content_refs WHERE peer_id=? AND ref_type=? AND ref_id=?`, peerID, refType, refID)
+    if err != nil {
+        log.Printf("Failed to delete content reference from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Returns the content key held by any directory for the entry
+func dbGetEntryContentRef(db *sql.DB, peerID string, entryCid string) (string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", err
+        }
+        defer db.Close()
+    }
+
+    var contentKey string
+    err = db.QueryRow(`SELECT content_key FROM content_refs WHERE peer_id=? AND ref_type=? AND ref_id LIKE ? LIMIT 1`,
+                      peerID, fileShareRefManifest, "%/" + entryCid).Scan(&contentKey)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", contentNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", internalError
+    }
+
+    return contentKey, nil
+}
+
+//Returns the IDs of every reference of the given type
+func dbGetContentRefIDs(db *sql.DB, peerID string, refType string) ([]string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    rows, err := db.Query(`SELECT ref_id FROM content_refs WHERE peer_id=? AND ref_type=?`, peerID, refType)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    refIDs := []string{}
+    var refID string
+    for rows.Next() {
+        err := rows.Scan(&refID)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err);
+            return nil, internalError
+        }
+        refIDs = append(refIDs, refID)
+    }
+
+    return refIDs, nil
+}
+
+//Returns the number of references to every stored content that is referenced at least once
+func dbGetContentRefCounts(db *sql.DB, peerID string) (map[string]int, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    rows, err := db.Query(`SELECT content_key, COUNT(*) FROM content_refs WHERE peer_id=? GROUP BY content_key`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    refCounts := make(map[string]int)
+    var contentKey string
+    var count int
+    for rows.Next() {
+        err := rows.Scan(&contentKey, &count)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        refCounts[contentKey] = count
+    }
+
+    return refCounts, nil
+}
+
+func dbSetSetting(db *sql.DB, peerID string, key string, value string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM settings WHERE peer_id=? AND key=?`, peerID, key)
+    if err != nil {
+        log.Printf("Failed to replace setting in SQLITE database. %v\n", err)
+        return internalError
+    }
+    _, err = db.Exec(`INSERT INTO settings (peer_id, key, value) VALUES (?, ?, ?)`, peerID, key, value)
+    if err != nil {
+        log.Printf("Failed to insert setting into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbRemoveSetting(db *sql.DB, peerID string, key string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM settings WHERE peer_id=? AND key=?`, peerID, key)
+    if err != nil {
+        log.Printf("Failed to remove setting from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetSetting(db *sql.DB, peerID string, key string) (string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", err
+        }
+        defer db.Close()
+    }
+
+    var value string
+    err = db.QueryRow(`SELECT value FROM settings WHERE peer_id=? AND key=?`, peerID, key).Scan(&value)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", keyNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", internalError
+    }
+
+    return value, nil
+}
+
+func dbAddSessionRecord(db *sql.DB, peerID string, record FileShareSessionRecord) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`INSERT INTO session_history
+                      (peer_id, session_id, cid, result, rx_bytes, total_bytes, start_time, end_time, duration, average_speed)
+                      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                     peerID,
+                     record.SessionID,
+                     record.ReqCid,
+                     record.Result,
+                     record.RxBytes,
+                     record.TotalBytes,
+                     record.StartTime,
+                     record.EndTime,
+                     record.Duration,
+                     record.AverageSpeed)
+    if err != nil {
+        log.Printf("Failed to push session record into database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetSessionRecords(db *sql.DB, peerID string) ([]FileShareSessionRecord, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    records := []FileShareSessionRecord{}
+    rows, err := db.Query(`SELECT session_id, cid, result, rx_bytes, total_bytes, start_time, end_time, duration, average_speed
+                           FROM session_history WHERE peer_id= ? ORDER BY id`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        record := FileShareSessionRecord{}
+        err := rows.Scan(&record.SessionID, &record.ReqCid, &record.Result, &record.RxBytes, &record.TotalBytes,
+                         &record.StartTime, &record.EndTime, &record.Duration, &record.AverageSpeed)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        records = append(records, record)
+    }
+
+    return records, nil
+}
+
+func dbAddPayment(db *sql.DB, peerID string, payment FileSharePayment) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`INSERT INTO payments (peer_id, tx_id, payer_id, cid, amount, confirmations, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+                     peerID,
+                     payment.TxID,
+                     payment.PayerID,
+                     payment.Cid,
+                     payment.Amount,
+                     payment.Confirmations,
+                     payment.Timestamp)
+    if err != nil {
+        log.Printf("Failed to push payment into database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetPayment(db *sql.DB, peerID string, txID string) (FileSharePayment, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return FileSharePayment{}, err
+        }
+        defer db.Close()
+    }
+
+    payment := FileSharePayment{}
+    err = db.QueryRow(`SELECT tx_id, payer_id, cid, amount, confirmations, timestamp FROM payments WHERE peer_id=? AND tx_id=?`, peerID, txID).
+             Scan(&payment.TxID, &payment.PayerID, &payment.Cid, &payment.Amount, &payment.Confirmations, &payment.Timestamp)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return FileSharePayment{}, paymentNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return FileSharePayment{}, internalError
+    }
+
+    return payment, nil
+}
+
+func dbGetPayments(db *sql.DB, peerID string) ([]FileSharePayment, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    payments := []FileSharePayment{}
+    rows, err := db.Query(`SELECT tx_id, payer_id, cid, amount, confirmations, timestamp FROM payments WHERE peer_id= ? ORDER BY id`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        payment := FileSharePayment{}
+        err := rows.Scan(&payment.TxID, &payment.PayerID, &payment.Cid, &payment.Amount, &payment.Confirmations, &payment.Timestamp)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        payments = append(payments, payment)
+    }
+
+    return payments, nil
+}
+
+//CIDs a peer has paid us for
+func dbGetPaidCids(db *sql.DB, peerID string, payerID string) ([]string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    cids := []string{}
+    rows, err := db.Query(`SELECT cid FROM payments WHERE peer_id=? AND payer_id=?`, peerID, payerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var cidStr string
+        err := rows.Scan(&cidStr)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        cids = append(cids, cidStr)
+    }
+
+    return cids, nil
+}
+
+func dbAddLockedDownload(db *sql.DB, peerID string, locked *FileShareLockedDownload) (int, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return -1, err
+        }
+        defer db.Close()
+    }
+
+    result, err := db.Exec(`INSERT INTO locked_downloads
+                            (peer_id, provider_id, cid, filename, price, size, output_file, wallet_address, key_id, key_hash, timestamp)
+                            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                           peerID,
+                           locked.ProviderID,
+                           locked.DataCid,
+                           locked.Name,
+                           locked.Price,
+                           locked.Size,
+                           locked.OutputFile,
+                           locked.WalletAddress,
+                           locked.keyID,
+                           locked.keyHash,
+                           locked.Timestamp)
+    if err != nil {
+        log.Printf("Failed to push locked download into database. %v\n", err)
+        return -1, internalError
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        log.Printf("Failed to get ID of locked download. %v\n", err)
+        return -1, internalError
+    }
+
+    return int(id), nil
+}
+
+func dbRemoveLockedDownload(db *sql.DB, peerID string, downloadID int) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM locked_downloads WHERE id=? AND peer_id=?`, downloadID, peerID)
+    if err != nil {
+        log.Printf("Failed to delete locked download from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+func dbGetLockedDownloads(db *sql.DB, peerID string) ([]FileShareLockedDownload, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    lockedDownloads := []FileShareLockedDownload{}
+    rows, err := db.Query(`SELECT id, provider_id, cid, filename, price, size, output_file, wallet_address, key_id, key_hash, timestamp
+                           FROM locked_downloads WHERE peer_id= ? ORDER BY id`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        locked := FileShareLockedDownload{}
+        err := rows.Scan(&locked.DownloadID, &locked.ProviderID, &locked.DataCid, &locked.Name, &locked.Price, &locked.Size,
+                         &locked.OutputFile, &locked.WalletAddress, &locked.keyID, &locked.keyHash, &locked.Timestamp)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        lockedDownloads = append(lockedDownloads, locked)
+    }
+
+    return lockedDownloads, nil
+}
+
+func dbAddDeliveryKey(db *sql.DB, peerID string, keyID string, requesterID string, cid string, key string, timestamp string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`INSERT INTO delivery_keys (peer_id, key_id, requester_id, cid, key, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+                     peerID, keyID, requesterID, cid, key, timestamp)
+    if err != nil {
+        log.Printf("Failed to push delivery key into database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Returns the requester the key was made for, the CID it encrypts and the hex encoded key
+func dbGetDeliveryKey(db *sql.DB, peerID string, keyID string) (string, string, string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", "", "", err
+        }
+        defer db.Close()
+    }
+
+    var requesterID string
+    var cid string
+    var key string
+    err = db.QueryRow(`SELECT requester_id, cid, key FROM delivery_keys WHERE peer_id=? AND key_id=?`, peerID, keyID).
+             Scan(&requesterID, &cid, &key)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", "", "", keyNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", "", "", internalError
+    }
+
+    return requesterID, cid, key, nil
+}
+
+//Returns the ID and hex encoded key of the key made for a requester to get a CID
+func dbGetRequesterDeliveryKey(db *sql.DB, peerID string, requesterID string, cid string) (string, string, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return "", "", err
+        }
+        defer db.Close()
+    }
+
+    var keyID string
+    var key string
+    err = db.QueryRow(`SELECT key_id, key FROM delivery_keys WHERE peer_id=? AND requester_id=? AND cid=? ORDER BY id LIMIT 1`,
+                      peerID, requesterID, cid).Scan(&keyID, &key)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", "", keyNotFound
+        }
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return "", "", internalError
+    }
+
+    return keyID, key, nil
+}
+
+func dbAddUploadRecord(db *sql.DB, peerID string, record FileShareUploadRecord) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`INSERT INTO upload_records (peer_id, cid, requester_id, tx_bytes, complete, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+                     peerID, record.Cid, record.RequesterID, record.TxBytes, record.Complete, record.Timestamp)
+    if err != nil {
+        log.Printf("Failed to push upload record into database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Gets upload records in the order they were made, only those of the given CID if it is set
+func dbGetUploadRecords(db *sql.DB, peerID string, cid string) ([]FileShareUploadRecord, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    records := []FileShareUploadRecord{}
+    rows, err := db.Query(`SELECT cid, requester_id, tx_bytes, complete, timestamp FROM upload_records
+                           WHERE peer_id=? AND (?='' OR cid=?) ORDER BY id`, peerID, cid, cid)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        record := FileShareUploadRecord{}
+        err := rows.Scan(&record.Cid, &record.RequesterID, &record.TxBytes, &record.Complete, &record.Timestamp)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        records = append(records, record)
+    }
+
+    return records, nil
+}
+
+func dbSetReputation(db *sql.DB, peerID string, reputation FileShareReputation) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM provider_reputation WHERE peer_id=? AND provider_id=?`, peerID, reputation.PeerID)
+    if err != nil {
+        log.Printf("Failed to replace provider reputation in SQLITE database. %v\n", err)
+        return internalError
+    }
+    _, err = db.Exec(`INSERT INTO provider_reputation (peer_id, provider_id, successes, failures, integrity_failures, rx_bytes,
+                      transfer_time, latency_total, latency_samples, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                     peerID, reputation.PeerID, reputation.Successes, reputation.Failures, reputation.IntegrityFailures,
+                     reputation.RxBytes, reputation.TransferTime, reputation.latencyTotal, reputation.LatencySamples,
+                     reputation.LastSeen)
+    if err != nil {
+        log.Printf("Failed to insert provider reputation into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Scores are left for the caller to compute
+func dbGetReputations(db *sql.DB, peerID string) ([]*FileShareReputation, error) {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+    }
+
+    reputations := []*FileShareReputation{}
+    rows, err := db.Query(`SELECT provider_id, successes, failures, integrity_failures, rx_bytes, transfer_time, latency_total,
+                           latency_samples, last_seen FROM provider_reputation WHERE peer_id=?`, peerID)
+    if err != nil {
+        log.Printf("Failed to query SQLITE database. %v\n", err)
+        return nil, internalError
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        reputation := &FileShareReputation{}
+        err := rows.Scan(&reputation.PeerID, &reputation.Successes, &reputation.Failures, &reputation.IntegrityFailures,
+                         &reputation.RxBytes, &reputation.TransferTime, &reputation.latencyTotal, &reputation.LatencySamples,
+                         &reputation.LastSeen)
+        if err != nil {
+            log.Printf("Failed to scan rows from SQL query. %v\n", err)
+            return nil, internalError
+        }
+        reputations = append(reputations, reputation)
+    }
+
+    return reputations, nil
+}
+
+//Links a download to the upload it was seeded as
+func dbAddDownloadSeed(db *sql.DB, peerID string, downloadID int, uploadCid string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`INSERT INTO download_seeds (peer_id, download_id, upload_cid) VALUES (?, ?, ?)`, peerID, downloadID, uploadCid)
+    if err != nil {
+        log.Printf("Failed to insert download seed into SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
+
+//Unlinks every download seeded as the given upload
+func dbRemoveDownloadSeeds(db *sql.DB, peerID string, uploadCid string) error {
+    var err error
+    //Establish connection to database if doesn't exist
+    if db == nil {
+        db, err = dbOpen()
+        if err != nil {
+            return err
+        }
+        defer db.Close()
+    }
+
+    _, err = db.Exec(`DELETE FROM download_seeds WHERE peer_id=? AND upload_cid=?`, peerID, uploadCid)
+    if err != nil {
+        log.Printf("Failed to delete download seeds from SQLITE database. %v\n", err)
+        return internalError
+    }
+
+    return nil
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+    "os"
+    "log"
+    "strings"
+    "strconv"
+    "path/filepath"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Shared data is kept in a content store with one file per distinct content, named by the single-hash
+//CID of the whole file. Several CIDs can use the same stored file (the legacy and DAG CIDs of the same
+//data for example), so stored files are reference counted and only removed once nothing uses them.
+//Downloads are written where the requester asked and never enter the content store, so they hold no
+//references and don't count towards the quota. A download that is seeded is shared like any other file.
+const fileShareStoreDirectory = "fileshare/store"
+//Reference held by a file shared on its own, identified by its CID
+const fileShareRefUpload = "upload"
+//Reference held by a directory on each of its entries, identified by the manifest CID and entry CID
+//Entries are only withdrawn once neither their own reference nor any directory's is left
+const fileShareRefManifest = "manifest"
+//Setting holding the storage quota in bytes, 0 for no quota
+const fileShareQuotaSetting = "storage_quota"
+
+type FileShareStorageInfo struct {
+    Quota int64             `json:"quota"`
+    Used int64              `json:"used"`
+    Reclaimable int64       `json:"reclaimable"`
+}
+
+type FileShareGCResult struct {
+    Removed int             `json:"removed"`
+    Reclaimed int64         `json:"reclaimed_bytes"`
+}
+
+//Files shared without a copy are keyed by the absolute path of the file itself
+func contentPath(contentKey string) string {
+    if filepath.IsAbs(contentKey) {
+        return contentKey
+    }
+    return fileShareStoreDirectory + "/" + contentKey
+}
+
+func (f *FileShareNode) loadStorageQuota() {
+    quotaStr, err := dbGetSetting(nil, f.host.ID().String(), fileShareQuotaSetting)
+    if err != nil {
+        return
+    }
+    quota, err := strconv.ParseInt(quotaStr, 10, 64)
+    if err != nil || quota < 0 {
+        log.Printf("Ignoring invalid storage quota '%v'\n", quotaStr)
+        return
+    }
+    f.storeLock.Lock()
+    f.storageQuota = quota
+    f.storeLock.Unlock()
+}
+
+//Copies a file into the content store and records a reference to it
+//Nothing is copied if the content is already stored
+func (f *FileShareNode) storeContent(srcPath string, contentKey string, size int64, refType string, refID string) error {
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+
+    dstPath := contentPath(contentKey)
+    stat, err := os.Stat(dstPath)
+    if err != nil || stat.Size() != size {
+        err = f.reserveStorage(size)
+        if err != nil {
+            return err
+        }
+        err = os.MkdirAll(fileShareStoreDirectory, 0750)
+        if err != nil {
+            log.Printf("Failed to create content store directory. %v\n", err)
+            return internalError
+        }
+        err = copyFile(srcPath, dstPath)
+        if err != nil {
+            log.Printf("Failed to copy file to content store. %v\n", err)
+            return internalError
+        }
+    }
+    return dbAddContentRef(nil, f.host.ID().String(), contentKey, refType, refID)
+}
+
+//Drops a reference and removes the stored content if nothing else uses it
+func (f *FileShareNode) releaseContent(refType string, refID string) {
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+
+    peerID := f.host.ID().String()
+    contentKey, err := dbGetContentRef(nil, peerID, refType, refID)
+    if err != nil {
+        return
+    }
+    err = dbRemoveContentRef(nil, peerID, refType, refID)
+    if err != nil {
+        return
+    }
+    refCounts, err := dbGetContentRefCounts(nil, peerID)
+    if err != nil {
+        return
+    }
+    if refCounts[contentKey] == 0 {
+        os.Remove(contentPath(contentKey))
+    }
+}
+
+//Makes room for size more bytes, collecting garbage if the quota would be exceeded
+//Caller must hold storeLock
+func (f *FileShareNode) reserveStorage(size int64) error {
+    if f.storageQuota == 0 {
+        return nil
+    }
+    info, err := f.storageInfo()
+    if err != nil {
+        return err
+    }
+    if info.Used + size <= f.storageQuota {
+        return nil
+    }
+    if info.Used - info.Reclaimable + size > f.storageQuota {
+        log.Printf("Storing %d bytes would exceed the storage quota of %d bytes\n", size, f.storageQuota)
+        return storageQuotaExceeded
+    }
+    _, err = f.collectGarbage()
+    return err
+}
+
+//Caller must hold storeLock
+func (f *FileShareNode) storageInfo() (FileShareStorageInfo, error) {
+    info := FileShareStorageInfo{ Quota: f.storageQuota, Used: 0, Reclaimable: 0 }
+    refCounts, err := dbGetContentRefCounts(nil, f.host.ID().String())
+    if err != nil {
+        return info, err
+    }
+    entries, err := os.ReadDir(fileShareStoreDirectory)
+    if err != nil {
+        //Nothing has been stored yet
+        return info, nil
+    }
+    for _, entry := range entries {
+        stat, err := entry.Info()
+        if err != nil || !stat.Mode().IsRegular() {
+            continue
+        }
+        info.Used += stat.Size()
+        if refCounts[entry.Name()] == 0 {
+            info.Reclaimable += stat.Size()
+        }
+    }
+    return info, nil
+}
+
+//Removes stored content that nothing references, including copies left behind by interrupted uploads
+//Caller must hold storeLock
+func (f *FileShareNode) collectGarbage() (FileShareGCResult, error) {
+    result := FileShareGCResult{ Removed: 0, Reclaimed: 0 }
+    refCounts, err := dbGetContentRefCounts(nil, f.host.ID().String())
+    if err != nil {
+        return result, err
+    }
+    entries, err := os.ReadDir(fileShareStoreDirectory)
+    if err != nil {
+        return result, nil
+    }
+    for _, entry := range entries {
+        stat, err := entry.Info()
+        if err != nil || !stat.Mode().IsRegular() || refCounts[entry.Name()] > 0 {
+            continue
+        }
+        err = os.Remove(filepath.Join(fileShareStoreDirectory, entry.Name()))
+        if err != nil {
+            log.Printf("Failed to remove %v from content store. %v\n", entry.Name(), err)
+            continue
+        }
+        if !strings.HasSuffix(entry.Name(), ".tmp") {
+            result.Removed ++
+        }
+        result.Reclaimed += stat.Size()
+    }
+    if result.Reclaimed > 0 {
+        log.Printf("Reclaimed %d bytes from the content store\n", result.Reclaimed)
+    }
+    return result, nil
+}
+
+func (f *FileShareNode) CollectGarbage() (FileShareGCResult, error) {
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+    return f.collectGarbage()
+}
+
+func (f *FileShareNode) GetStorageInfo() (FileShareStorageInfo, error) {
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+    return f.storageInfo()
+}
+
+//Sets the storage quota in bytes, 0 removes the quota
+//Unreferenced content is reclaimed straight away if the store is over the new quota
+func (f *FileShareNode) SetStorageQuota(quota int64) error {
+    if quota < 0 {
+        return invalidParams
+    }
+    err := dbSetSetting(nil, f.host.ID().String(), fileShareQuotaSetting, strconv.FormatInt(quota, 10))
+    if err != nil {
+        return err
+    }
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+    f.storageQuota = quota
+    info, err := f.storageInfo()
+    if err != nil {
+        return err
+    }
+    if quota > 0 && info.Used > quota {
+        _, err = f.collectGarbage()
+    }
+    return err
+}
+
+func manifestRefID(manifestCid cid.Cid, entryCid cid.Cid) string {
+    return manifestCid.String() + "/" + entryCid.String()
+}
+
+//Has a directory hold a reference to the data of one of its entries
+//Unless the entry was shared on its own before, the entry's own reference is dropped so the entry goes
+//with the last directory holding it
+func (f *FileShareNode) refEntry(manifestCid cid.Cid, entryCid cid.Cid, shared bool) error {
+    f.storeLock.Lock()
+    defer f.storeLock.Unlock()
+
+    peerID := f.host.ID().String()
+    contentKey, err := dbGetContentRef(nil, peerID, fileShareRefUpload, entryCid.String())
+    if err != nil {
+        contentKey, err = dbGetEntryContentRef(nil, peerID, entryCid.String())
+        if err != nil {
+            return err
+        }
+    }
+    err = dbAddContentRef(nil, peerID, contentKey, fileShareRefManifest, manifestRefID(manifestCid, entryCid))
+    if err != nil {
+        return err
+    }
+    if !shared {
+        return dbRemoveContentRef(nil, peerID, fileShareRefUpload, entryCid.String())
+    }
+    return nil
+}
+
+//Drops a directory's reference to one of its entries
+//Returns whether the entry is still shared on its own or by another directory
+func (f *FileShareNode) releaseEntry(manifestCid cid.Cid, entryCid cid.Cid) bool {
+    peerID := f.host.ID().String()
+    refID := manifestRefID(manifestCid, entryCid)
+    //Directories shared before entries were referenced hold the entry's own reference instead
+    _, err := dbGetContentRef(nil, peerID, fileShareRefManifest, refID)
+    legacy := err != nil
+    f.releaseContent(fileShareRefManifest, refID)
+
+    _, err = dbGetEntryContentRef(nil, peerID, entryCid.String())
+    if err == nil {
+        return true
+    }
+    if legacy {
+        return false
+    }
+    _, err = dbGetContentRef(nil, peerID, fileShareRefUpload, entryCid.String())
+    return err == nil
+}
@@ -0,0 +1,501 @@
+package api
+
+import (
+    "os"
+    "log"
+    "time"
+    "sync"
+    "context"
+    "strings"
+    "path/filepath"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Number of failed range requests before a provider is dropped from the swarm
+const swarmMaxProviderFailures = 3
+//A provider is dropped if it is this many times slower than the fastest provider
+const swarmSlowFactor = 4
+//Number of ranges a provider must complete before its throughput is compared with others
+const swarmMinRangesBeforeRebalance = 2
+//Persist progress of a swarm download every this many completed ranges
+const swarmPersistRanges = 16
+
+var swarmRangeSize = 4 * chunkSize
+
+type fileShareSwarm struct {
+    session *FileShareSession
+    dataCid cid.Cid
+    dag *FileShareDag
+    file *os.File
+    partial *FileSharePartialDownload
+    size int64
+    rangeSize int64
+    numRanges int
+    completed int
+    sinceSaved int
+    pending []int64
+    activeWorkers int
+    rates map[peer.ID]float64
+    contributions map[peer.ID]int64
+    lock sync.Mutex
+    cond *sync.Cond
+}
+
+func newFileShareSwarm(session *FileShareSession, dataCid cid.Cid, dag *FileShareDag, file *os.File, partial *FileSharePartialDownload) *fileShareSwarm {
+    pending := partial.pendingRanges()
+    sw := &fileShareSwarm{
+        session: session,
+        dataCid: dataCid,
+        dag: dag,
+        file: file,
+        partial: partial,
+        size: partial.Size,
+        rangeSize: partial.rangeSize,
+        numRanges: len(partial.ranges),
+        completed: len(partial.ranges) - len(pending),
+        sinceSaved: 0,
+        pending: pending,
+        activeWorkers: 0,
+        rates: make(map[peer.ID]float64),
+        contributions: make(map[peer.ID]int64),
+        lock: sync.Mutex{},
+    }
+    sw.cond = sync.NewCond(&sw.lock)
+    return sw
+}
+
+//Fetches every range from the providers in parallel. Returns true if all ranges were received.
+func (sw *fileShareSwarm) run(providerIDs []peer.ID) bool {
+    wg := sync.WaitGroup{}
+    sw.lock.Lock()
+    sw.activeWorkers = len(providerIDs)
+    sw.lock.Unlock()
+    wg.Add(len(providerIDs))
+    for _, providerID := range providerIDs {
+        go func(providerID peer.ID) {
+            defer wg.Done()
+            sw.worker(providerID)
+        }(providerID)
+    }
+    wg.Wait()
+
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    return sw.completed == sw.numRanges
+}
+
+func (sw *fileShareSwarm) worker(providerID peer.ID) {
+    defer sw.workerDone(providerID)
+    failures := 0
+    rangesDone := 0
+    bytesDone := int64(0)
+    elapsed := time.Duration(0)
+    for {
+        if sw.session.isCancelled() {
+            return
+        }
+        index, ok := sw.nextRange()
+        if !ok {
+            return
+        }
+        offset := index * sw.rangeSize
+        length := min(sw.rangeSize, sw.size - offset)
+
+        start := time.Now()
+        err := sw.fetchRange(providerID, offset, length)
+        if err != nil {
+            sw.requeueRange(index)
+            failures ++
+            if err == integrityError {
+                log.Printf("Dropping provider %v from swarm for sending corrupt data\n", providerID)
+                return
+            }
+            //Leave a busy provider to the others, or wait as long as it asked if it is the only one left
+            if err == providerBusy {
+                retryAfter, _ := sw.session.RetryAfter(providerID)
+                if sw.otherWorkers() {
+                    log.Printf("Dropping busy provider %v from swarm\n", providerID)
+                    return
+                }
+                time.Sleep(retryAfter)
+            }
+            if failures >= swarmMaxProviderFailures {
+                log.Printf("Dropping provider %v from swarm after %d failed requests\n", providerID, failures)
+                return
+            }
+            continue
+        }
+        rangesDone ++
+        bytesDone += length
+        elapsed += time.Since(start)
+        sw.completeRange(providerID, index, length, float64(bytesDone) / elapsed.Seconds())
+
+        if rangesDone >= swarmMinRangesBeforeRebalance && sw.isSlow(providerID) {
+            log.Printf("Dropping slow provider %v from swarm\n", providerID)
+            return
+        }
+    }
+}
+
+//Requests a single range from a provider and writes it to its offset in the output file
+func (sw *fileShareSwarm) fetchRange(providerID peer.ID, offset int64, length int64) error {
+    dataChannel := sw.session.SendWantRange(providerID, sw.dataCid, offset, length)
+    if dataChannel == nil {
+        _, busy := sw.session.RetryAfter(providerID)
+        if busy {
+            return providerBusy
+        }
+        sw.session.DeleteStream(providerID)
+        sw.session.setProviderResult(providerID, 1)
+        return contentNotFound
+    }
+    var err error
+    var data []byte
+    written := int64(0)
+    //Always drain the channel so the reader goroutine can exit
+    for buf := range dataChannel {
+        if err != nil {
+            continue
+        }
+        if buf.err != nil {
+            err = buf.err
+            continue
+        }
+        //Hold on to the range until its blocks are verified
+        if sw.dag != nil {
+            data = append(data, buf.data...)
+            written += int64(len(buf.data))
+            continue
+        }
+        _, err = sw.file.WriteAt(buf.data, offset + written)
+        if err != nil {
+            log.Printf("Failed to write to file. %v\n", err)
+        }
+        written += int64(len(buf.data))
+    }
+    if err == nil && written != length {
+        err = unexpectedResponse
+    }
+    if err == nil && sw.dag != nil {
+        err = sw.verifyRange(providerID, offset, data)
+    }
+    if err != nil {
+        //Stream may be left in the middle of a response, start fresh on the next request
+        sw.session.DeleteStream(providerID)
+        sw.session.statsLock.Lock()
+        sw.session.RxBytes -= written
+        sw.session.statsLock.Unlock()
+        //The swarm may still finish with the other providers, this one failed either way
+        if err == integrityError {
+            sw.session.setProviderResult(providerID, -1)
+        } else {
+            sw.session.setProviderResult(providerID, 1)
+        }
+    }
+    return err
+}
+
+//Verifies every block of a range and writes it to the output file
+func (sw *fileShareSwarm) verifyRange(providerID peer.ID, offset int64, data []byte) error {
+    for pos := int64(0); pos < int64(len(data)); {
+        index := sw.dag.BlockIndex(offset + pos)
+        _, length := sw.dag.BlockRange(index)
+        if pos + length > int64(len(data)) || !sw.dag.VerifyBlock(index, data[pos:pos + length]) {
+            log.Printf("Rejecting corrupt block %d of %v from %v\n", index, sw.dataCid, providerID)
+            return integrityError
+        }
+        pos += length
+    }
+    _, err := sw.file.WriteAt(data, offset)
+    if err != nil {
+        log.Printf("Failed to write to file. %v\n", err)
+    }
+    return err
+}
+
+func (sw *fileShareSwarm) nextRange() (int64, bool) {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    for len(sw.pending) == 0 && sw.completed < sw.numRanges {
+        sw.cond.Wait()
+    }
+    if sw.completed == sw.numRanges {
+        return 0, false
+    }
+    index := sw.pending[0]
+    sw.pending = sw.pending[1:]
+    return index, true
+}
+
+func (sw *fileShareSwarm) requeueRange(index int64) {
+    sw.lock.Lock()
+    sw.pending = append(sw.pending, index)
+    sw.lock.Unlock()
+    sw.cond.Broadcast()
+}
+
+func (sw *fileShareSwarm) completeRange(providerID peer.ID, index int64, length int64, rate float64) {
+    rangesStr := ""
+    sw.lock.Lock()
+    sw.completed ++
+    sw.contributions[providerID] += length
+    sw.rates[providerID] = rate
+    sw.partial.markRange(index)
+    sw.sinceSaved ++
+    if sw.sinceSaved >= swarmPersistRanges {
+        rangesStr = sw.partial.encodeRanges()
+        sw.sinceSaved = 0
+    }
+    sw.lock.Unlock()
+    sw.cond.Broadcast()
+
+    //Periodically record which ranges we have in case the daemon stops
+    if rangesStr != "" {
+        sw.file.Sync()
+        sw.session.node.savePartialDownload(sw.partial, rangesStr)
+    }
+}
+
+//A provider is slow if another active provider is more than swarmSlowFactor times faster
+func (sw *fileShareSwarm) isSlow(providerID peer.ID) bool {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    if sw.activeWorkers <= 1 || len(sw.pending) == 0 {
+        return false
+    }
+    rate := sw.rates[providerID]
+    for otherID, otherRate := range sw.rates {
+        if otherID != providerID && rate * swarmSlowFactor < otherRate {
+            return true
+        }
+    }
+    return false
+}
+
+func (sw *fileShareSwarm) otherWorkers() bool {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    return sw.activeWorkers > 1
+}
+
+func (sw *fileShareSwarm) workerDone(providerID peer.ID) {
+    sw.lock.Lock()
+    sw.activeWorkers --
+    delete(sw.rates, providerID)
+    sw.lock.Unlock()
+    sw.cond.Broadcast()
+}
+
+//Returns the providers that contributed to the download as a comma separated list
+func (sw *fileShareSwarm) contributors() string {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    providerIDs := make([]string, 0, len(sw.contributions))
+    for providerID, _ := range sw.contributions {
+        providerIDs = append(providerIDs, providerID.String())
+    }
+    return strings.Join(providerIDs, ",")
+}
+
+//Downloads a file from every provider of the CID at once
+//Only providers sharing the file for free take part, returns paymentRequired if every provider charges for it
+func (f *FileShareNode) GetFileSwarm(ctx context.Context, reqCidStr string, outputFile string, priority int) (int, error) {
+    return f.getFileSwarm(ctx, reqCidStr, outputFile, nil, priority)
+}
+
+//Same as GetFileSwarm but continues from where the download stopped if partial is set
+func (f *FileShareNode) getFileSwarm(ctx context.Context, reqCidStr string, outputFile string, partial *FileSharePartialDownload,
+                                     priority int) (int, error) {
+    resuming := partial != nil
+    //Release a resumed download if we fail before the transfer starts
+    deferRelease := resuming
+    defer func() {
+        if deferRelease {
+            f.releasePartialDownload(partial, true)
+        }
+    }()
+
+    reqCid, err := cid.Decode(reqCidStr)
+    if err != nil {
+        log.Printf("Failed to decode cid %v. %v", reqCidStr, err)
+        return -1, invalidParams
+    }
+
+    //Nothing to swarm if we have the file ourselves
+    if f.HasFile(reqCid) {
+        deferRelease = false
+        return f.getFile(ctx, f.host.ID().String(), reqCidStr, outputFile, partial, priority, "", "", FileShareSeedSettings{})
+    }
+
+    tmpOutputFile, err := filepath.Abs(outputFile + ".tmp")
+    if err != nil {
+        log.Printf("Failed to resolve filepath. %v\n", outputFile)
+        return -1, invalidParams
+    }
+    outputFile, err = filepath.Abs(outputFile)
+    if err != nil {
+        log.Printf("Failed to resolve filepath. %v\n", outputFile)
+        return -1, invalidParams
+    }
+
+    session := f.SessionCreate(ctx, reqCidStr, fileShareSessionDownload)
+    //The session can already be seen by others once it is created
+    session.statsLock.Lock()
+    session.Priority = priority
+    session.statsLock.Unlock()
+    fileDiscovery := session.DiscoverFile(ctx, reqCid, 1000)
+    if fileDiscovery == nil {
+        f.SessionCleanup(session, 1)
+        return -1, contentNotFound
+    }
+    //Swarms can't pay, a transaction only pays the one provider it was made out to
+    providers := make([]FileShareProvider, 0, len(fileDiscovery.Providers))
+    paidProviders := 0
+    for _, provider := range fileDiscovery.Providers {
+        if provider.PeerID == f.host.ID() {
+            continue
+        }
+        if provider.Price > 0 {
+            paidProviders ++
+            continue
+        }
+        providers = append(providers, provider)
+    }
+    if len(providers) == 0 {
+        f.SessionCleanup(session, 1)
+        if paidProviders > 0 {
+            log.Printf("Every provider of %v charges for it, it can't be downloaded in a swarm\n", reqCid)
+            return -1, paymentRequired
+        }
+        return -1, contentNotFound
+    }
+    providerIDs := make([]peer.ID, 0, len(providers))
+    for _, provider := range providers {
+        providerIDs = append(providerIDs, provider.PeerID)
+    }
+    fileMeta := FileShareMeta{
+        Size: fileDiscovery.Size,
+        Price: providers[0].Price,
+        Name: providers[0].Name,
+        FileShareMetaDetails: providers[0].FileShareMetaDetails,
+    }
+    //Any provider can supply the DAG node since it is checked against the CID
+    var dag *FileShareDag
+    if !isLegacyCid(reqCid) {
+        for _, providerID := range providerIDs {
+            dag, err = session.GetDag(providerID, reqCid)
+            if err == nil {
+                break
+            }
+        }
+        if dag == nil {
+            f.SessionCleanup(session, 1)
+            return -1, contentNotFound
+        }
+        fileMeta.Size = dag.Size
+    }
+
+    // Ensure download directory exists
+    os.MkdirAll(filepath.Dir(tmpOutputFile), 0751)
+    var file *os.File
+    if resuming {
+        if partial.Size != fileMeta.Size || partial.rangeSize != fileShareRangeSize(dag) {
+            log.Printf("Providers' file no longer matches the partial download.\n")
+            f.SessionCleanup(session, 1)
+            return -1, unexpectedResponse
+        }
+        file, err = os.OpenFile(tmpOutputFile, os.O_RDWR, 0644)
+    } else {
+        file, err = os.Create(tmpOutputFile)
+    }
+    if err != nil {
+        log.Printf("Error opening file: %v. %v\n", tmpOutputFile, err)
+        f.SessionCleanup(session, 1)
+        return -1, failedToOpenFile
+    }
+    //Ranges are written out of order so the file needs its full size up front
+    err = file.Truncate(fileMeta.Size)
+    if err != nil {
+        log.Printf("Failed to allocate file: %v. %v\n", tmpOutputFile, err)
+        file.Close()
+        if !resuming {
+            os.Remove(tmpOutputFile)
+        }
+        f.SessionCleanup(session, 1)
+        return -1, internalError
+    }
+    if !resuming {
+        //Swarm downloads are recorded without a single provider
+        partial = newPartialDownload("", reqCidStr, outputFile, fileMeta, fileShareRangeSize(dag))
+        err = f.addPartialDownload(partial)
+        if err != nil {
+            file.Close()
+            os.Remove(tmpOutputFile)
+            f.SessionCleanup(session, 1)
+            return -1, err
+        }
+    }
+    session.statsLock.Lock()
+    session.RxBytes = partial.RxBytes
+    session.resumedBytes = partial.RxBytes
+    session.TotalBytes = fileMeta.Size
+    session.statsLock.Unlock()
+
+    deferRelease = false
+    go func() {
+        sessionStatusCode := 1
+        var dataCid cid.Cid
+        var err error
+        var swarm *fileShareSwarm
+        ok := false
+        //Wait for our turn before asking for any data
+        if f.queue.wait(session) {
+            swarm = newFileShareSwarm(session, reqCid, dag, file, partial)
+            ok = swarm.run(providerIDs)
+            f.queue.done()
+        }
+        file.Sync()
+        file.Close()
+        if !ok {
+            log.Printf("Failed to get every range from the swarm.\n")
+            goto Failed
+        }
+
+        //Blocks of a DAG were already verified as they arrived
+        if dag == nil {
+            //Compute hash to verify integrity of file
+            dataCid, _, err = computeFileCid(tmpOutputFile)
+            if err != nil {
+                goto Failed
+            }
+            if dataCid != reqCid {
+                log.Printf("Cid mismatch!\n")
+                sessionStatusCode = -1
+                goto Failed
+            }
+        }
+
+        err = os.Rename(tmpOutputFile, outputFile)
+        if err != nil {
+            log.Printf("Failed to move temporary file to output file. %v\n", err)
+            goto Failed
+        }
+
+        f.releasePartialDownload(partial, false)
+        dbAddDownload(nil, f.host.ID().String(), swarm.contributors(), reqCidStr, fileMeta.Name, fileMeta.Price,
+                      fileMeta.Size, time.Now().UTC().Format(time.RFC3339))
+        f.SessionCleanup(session, 0)
+        return
+Failed:
+        //Keep what was downloaded so far unless the data is bad or the download was cancelled
+        if sessionStatusCode == -1 || session.isCancelled() {
+            os.Remove(tmpOutputFile)
+            f.releasePartialDownload(partial, false)
+        } else {
+            f.releasePartialDownload(partial, true)
+        }
+        f.SessionCleanup(session, sessionStatusCode)
+    }()
+    return session.SessionID, nil
+}
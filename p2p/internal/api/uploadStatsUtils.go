@@ -0,0 +1,243 @@
+package api
+
+import (
+    "log"
+    "sort"
+    "time"
+    "github.com/libp2p/go-libp2p/core/peer"
+    cid "github.com/ipfs/go-cid"
+)
+
+//Width of the buckets of the time series when none is given
+const fileShareDefaultStatsInterval = time.Hour
+//What a remote session was served is forgotten once it hasn't asked for the CID for this long
+const fileShareServedRetention = time.Hour
+
+//Bytes we served to a peer for a single request. Complete is set if the request finished sending the
+//whole file to the requester's session, counting what earlier requests of the session sent.
+type FileShareUploadRecord struct {
+    Cid string              `json:"cid"`
+    RequesterID string      `json:"requester_id"`
+    TxBytes int64           `json:"tx_bytes"`
+    Complete bool           `json:"complete"`
+    Timestamp string        `json:"timestamp"`
+}
+
+type FileShareUploadStatsPoint struct {
+    Time string             `json:"time"`
+    TxBytes int64           `json:"tx_bytes"`
+    Transfers int           `json:"transfers"`
+}
+
+type FileShareFileUploadStats struct {
+    Cid string                          `json:"cid"`
+    Name string                         `json:"file_name"`
+    TxBytes int64                       `json:"tx_bytes"`
+    Transfers int                       `json:"transfers"`
+    Requesters []string                 `json:"requesters"`
+    Series []FileShareUploadStatsPoint  `json:"series"`
+}
+
+type FileSharePeerUploadStats struct {
+    PeerID string                       `json:"peer_id"`
+    TxBytes int64                       `json:"tx_bytes"`
+    Transfers int                       `json:"transfers"`
+    Cids []string                       `json:"cids"`
+    Series []FileShareUploadStatsPoint  `json:"series"`
+}
+
+type FileShareUploadStats struct {
+    TxBytes int64                       `json:"tx_bytes"`
+    Transfers int                       `json:"transfers"`
+    Requesters int                      `json:"requesters"`
+    Files []FileShareFileUploadStats    `json:"files"`
+    Peers []FileSharePeerUploadStats    `json:"peers"`
+}
+
+type fileShareServedKey struct {
+    requesterID peer.ID
+    remoteSessionID int
+    c cid.Cid
+}
+
+//Byte ranges of a file served to a remote session, sorted and without overlaps
+type fileShareServed struct {
+    ranges [][2]int64
+    lastServed time.Time
+}
+
+//Adds [start, end) to the ranges, merging it with the ranges it overlaps or touches
+func (s *fileShareServed) add(start int64, end int64) {
+    merged := [][2]int64{}
+    for _, r := range s.ranges {
+        if r[1] < start || r[0] > end {
+            merged = append(merged, r)
+            continue
+        }
+        start = min(start, r[0])
+        end = max(end, r[1])
+    }
+    merged = append(merged, [2]int64{ start, end })
+    sort.Slice(merged, func(i, j int) bool {
+        return merged[i][0] < merged[j][0]
+    })
+    s.ranges = merged
+}
+
+//Marks length bytes from offset as served to a remote session
+//Returns true if the session now has the whole file, after which we start over for the next transfer
+//A file with no data is whole as soon as a request for it succeeds
+func (f *FileShareNode) markServed(rSession *FileShareRemoteSession, c cid.Cid, offset int64, length int64, succeeded bool) bool {
+    f.mstoreLock.Lock()
+    fileMeta, ok := f.mstore[c]
+    f.mstoreLock.Unlock()
+    if !ok {
+        return false
+    }
+    if fileMeta.Size == 0 {
+        return succeeded
+    }
+    if length <= 0 {
+        return false
+    }
+
+    f.servedLock.Lock()
+    defer f.servedLock.Unlock()
+    now := time.Now()
+    for key, served := range f.served {
+        if now.Sub(served.lastServed) > fileShareServedRetention {
+            delete(f.served, key)
+        }
+    }
+    key := fileShareServedKey{ requesterID: rSession.remotePeerID, remoteSessionID: rSession.remoteSessionID, c: c }
+    served, ok := f.served[key]
+    if !ok {
+        served = &fileShareServed{}
+        f.served[key] = served
+    }
+    served.add(offset, offset + length)
+    served.lastServed = now
+    if len(served.ranges) == 1 && served.ranges[0][0] <= 0 && served.ranges[0][1] >= fileMeta.Size {
+        delete(f.served, key)
+        return true
+    }
+    return false
+}
+
+//Records what was served for a request once it is over, even if it failed part way
+func (f *FileShareNode) recordUpload(requesterID peer.ID, c cid.Cid, txBytes int64, complete bool) {
+    if txBytes == 0 && !complete {
+        return
+    }
+    err := dbAddUploadRecord(nil, f.host.ID().String(), FileShareUploadRecord{
+        Cid: c.String(),
+        RequesterID: requesterID.String(),
+        TxBytes: txBytes,
+        Complete: complete,
+        Timestamp: time.Now().UTC().Format(time.RFC3339),
+    })
+    if err != nil {
+        log.Printf("Failed to record upload of %v to %v\n", c, requesterID)
+    }
+}
+
+//Adds a record to a time series kept in order of time
+func addStatsPoint(series []FileShareUploadStatsPoint, bucket string, record FileShareUploadRecord) []FileShareUploadStatsPoint {
+    if len(series) == 0 || series[len(series) - 1].Time != bucket {
+        series = append(series, FileShareUploadStatsPoint{ Time: bucket })
+    }
+    point := &series[len(series) - 1]
+    point.TxBytes += record.TxBytes
+    if record.Complete {
+        point.Transfers ++
+    }
+    return series
+}
+
+//Totals of what we served, per file and per peer, with time series in buckets of interval
+//Only the given file is included if cidStr is set
+func (f *FileShareNode) GetUploadStats(cidStr string, interval time.Duration) (FileShareUploadStats, error) {
+    if interval <= 0 {
+        return FileShareUploadStats{}, invalidParams
+    }
+    if cidStr != "" {
+        _, err := cid.Decode(cidStr)
+        if err != nil {
+            return FileShareUploadStats{}, invalidParams
+        }
+    }
+    records, err := dbGetUploadRecords(nil, f.host.ID().String(), cidStr)
+    if err != nil {
+        return FileShareUploadStats{}, err
+    }
+    uploads, err := dbGetUploads(nil, f.host.ID().String())
+    if err != nil {
+        return FileShareUploadStats{}, err
+    }
+    names := make(map[string]string)
+    for _, upload := range uploads {
+        names[upload.DataCid] = upload.Name
+    }
+
+    stats := FileShareUploadStats{ Files: []FileShareFileUploadStats{}, Peers: []FileSharePeerUploadStats{} }
+    files := make(map[string]*FileShareFileUploadStats)
+    peers := make(map[string]*FileSharePeerUploadStats)
+    fileRequesters := make(map[string]map[string]bool)
+    peerCids := make(map[string]map[string]bool)
+    //Records are in the order they were made, so the series come out sorted
+    for _, record := range records {
+        timestamp, err := time.Parse(time.RFC3339, record.Timestamp)
+        if err != nil {
+            continue
+        }
+        bucket := timestamp.Truncate(interval).Format(time.RFC3339)
+
+        file, ok := files[record.Cid]
+        if !ok {
+            file = &FileShareFileUploadStats{ Cid: record.Cid, Name: names[record.Cid], Requesters: []string{} }
+            files[record.Cid] = file
+            fileRequesters[record.Cid] = make(map[string]bool)
+        }
+        peerStats, ok := peers[record.RequesterID]
+        if !ok {
+            peerStats = &FileSharePeerUploadStats{ PeerID: record.RequesterID, Cids: []string{} }
+            peers[record.RequesterID] = peerStats
+            peerCids[record.RequesterID] = make(map[string]bool)
+        }
+
+        stats.TxBytes += record.TxBytes
+        file.TxBytes += record.TxBytes
+        peerStats.TxBytes += record.TxBytes
+        if record.Complete {
+            stats.Transfers ++
+            file.Transfers ++
+            peerStats.Transfers ++
+        }
+        if !fileRequesters[record.Cid][record.RequesterID] {
+            fileRequesters[record.Cid][record.RequesterID] = true
+            file.Requesters = append(file.Requesters, record.RequesterID)
+        }
+        if !peerCids[record.RequesterID][record.Cid] {
+            peerCids[record.RequesterID][record.Cid] = true
+            peerStats.Cids = append(peerStats.Cids, record.Cid)
+        }
+        file.Series = addStatsPoint(file.Series, bucket, record)
+        peerStats.Series = addStatsPoint(peerStats.Series, bucket, record)
+    }
+    stats.Requesters = len(peers)
+
+    //Most served first
+    for _, file := range files {
+        stats.Files = append(stats.Files, *file)
+    }
+    sort.Slice(stats.Files, func(i int, j int) bool {
+        return stats.Files[i].TxBytes > stats.Files[j].TxBytes
+    })
+    for _, peerStats := range peers {
+        stats.Peers = append(stats.Peers, *peerStats)
+    }
+    sort.Slice(stats.Peers, func(i int, j int) bool {
+        return stats.Peers[i].TxBytes > stats.Peers[j].TxBytes
+    })
+    return stats, nil
+}